@@ -1,8 +1,10 @@
 module github.com/hzeller/stuff-org
 
-go 1.13
+go 1.16
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/prometheus/client_golang v1.7.1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
@@ -0,0 +1,472 @@
+// Versioned REST API to read and modify components and equivalence sets.
+//
+//	GET    /api/v1/components               list, filter with q=, category=;
+//	                                        paginate with offset=, limit=
+//	POST   /api/v1/components               create; next free id if none given
+//	GET    /api/v1/components/<id>
+//	PUT    /api/v1/components/<id>          replace, or create if new
+//	PATCH  /api/v1/components/<id>          only change the given fields
+//	GET    /api/v1/sets?component=<id>      sets of components matching <id>
+//	GET    /api/v1/sets/<set>
+//	PUT    /api/v1/sets/<set>/members/<id>  component joins the set
+//	DELETE /api/v1/sets/<set>/members/<id>  component leaves the set
+//
+// Requests and responses are JSON. Errors are reported with a proper
+// HTTP status code and a JsonApiError body.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	kApiV1Components = "/api/v1/components"
+	kApiV1Sets       = "/api/v1/sets"
+
+	kApiV1DefaultLimit = 100
+	kApiV1MaxLimit     = 1000
+	kApiV1MaxBodySize  = 1 << 20
+)
+
+type ApiV1Handler struct {
+	store StuffStore
+	auth  *Auth
+
+	create sync.Mutex // Picking a new id and storing it is one step.
+}
+
+func AddApiV1Handler(mux Router, store StuffStore, auth *Auth) {
+	handler := &ApiV1Handler{
+		store: store,
+		auth:  auth,
+	}
+	mux.Handle(kApiV1Components, handler)
+	mux.Handle(kApiV1Components+"/", handler)
+	mux.Handle(kApiV1Sets, handler)
+	mux.Handle(kApiV1Sets+"/", handler)
+}
+
+type JsonApiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"error"`
+}
+
+type JsonApiComponentList struct {
+	Total  int             `json:"total"` // Number of matches before pagination
+	Offset int             `json:"offset"`
+	Limit  int             `json:"limit"`
+	Items  []JsonComponent `json:"components"`
+}
+
+type JsonApiSet struct {
+	Id      int             `json:"id"`
+	Members []JsonComponent `json:"members"`
+}
+
+type JsonApiSetList struct {
+	Sets []JsonApiSet `json:"sets"`
+}
+
+type apiError struct {
+	status  int
+	message string
+	allow   string // Allowed methods for StatusMethodNotAllowed
+}
+
+func newApiError(status int, format string, args ...interface{}) *apiError {
+	return &apiError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+func methodNotAllowed(r *http.Request, allow string) *apiError {
+	return &apiError{
+		status:  http.StatusMethodNotAllowed,
+		message: fmt.Sprintf("%s not allowed on %s", r.Method, r.URL.Path),
+		allow:   allow,
+	}
+}
+
+// The JSON APIs that only return data answer nothing but GET; returns
+// false after telling the client so.
+func readOnlyRequest(out http.ResponseWriter, r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return true
+	}
+	out.Header().Set("Allow", "GET, HEAD")
+	http.Error(out, fmt.Sprintf("%s not allowed on %s", r.Method, r.URL.Path),
+		http.StatusMethodNotAllowed)
+	return false
+}
+
+func toJsonComponent(c *Component) JsonComponent {
+	return JsonComponent{
+		Component: *c,
+		Image:     fmt.Sprintf("/img/%d", c.Id),
+	}
+}
+
+func (h *ApiV1Handler) ServeHTTP(out http.ResponseWriter, r *http.Request) {
+	var status int
+	var result interface{}
+	var err *apiError
+	switch {
+	case strings.HasPrefix(r.URL.Path, kApiV1Components):
+		path := strings.Trim(r.URL.Path[len(kApiV1Components):], "/")
+		status, result, err = h.components(out, r, path)
+	default:
+		path := strings.Trim(r.URL.Path[len(kApiV1Sets):], "/")
+		status, result, err = h.sets(out, r, path)
+	}
+	out.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		if err.allow != "" {
+			out.Header().Set("Allow", err.allow)
+		}
+		status = err.status
+		result = &JsonApiError{Status: err.status, Message: err.message}
+	}
+	out.WriteHeader(status)
+	if result != nil {
+		json, _ := json.MarshalIndent(result, "", "  ")
+		out.Write(json)
+	}
+}
+
+func (h *ApiV1Handler) checkEditAllowed(r *http.Request) *apiError {
+	// Scripts on other sites must not use the browser of an editor.
+	if !sameOrigin(r) {
+		return newApiError(http.StatusForbidden, "Cross-origin modification not permitted")
+	}
+	if !h.auth.CanEdit(r) {
+		return newApiError(http.StatusForbidden, "Editing not permitted")
+	}
+	return nil
+}
+
+// Parse a non-negative id; anything else is not found.
+func parseApiId(value string, what string) (int, *apiError) {
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 0 {
+		return 0, newApiError(http.StatusNotFound, "No such %s '%s'", what, value)
+	}
+	return id, nil
+}
+
+func (h *ApiV1Handler) components(out http.ResponseWriter, r *http.Request, path string) (int, interface{}, *apiError) {
+	if path == "" {
+		switch r.Method {
+		case "GET", "HEAD":
+			return h.listComponents(r)
+		case "POST":
+			return h.createComponent(out, r)
+		}
+		return 0, nil, methodNotAllowed(r, "GET, POST")
+	}
+	id, err := parseApiId(path, "component")
+	if err != nil {
+		return 0, nil, err
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		c := h.store.FindById(id)
+		if c == nil {
+			return 0, nil, newApiError(http.StatusNotFound, "No component %d", id)
+		}
+		return http.StatusOK, toJsonComponent(c), nil
+	case "PUT":
+		return h.replaceComponent(out, r, id)
+	case "PATCH":
+		return h.patchComponent(r, id)
+	}
+	return 0, nil, methodNotAllowed(r, "GET, PUT, PATCH")
+}
+
+func parseNonNegative(r *http.Request, param string, default_value int) (int, *apiError) {
+	value := r.FormValue(param)
+	if value == "" {
+		return default_value, nil
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 0 {
+		return 0, newApiError(http.StatusBadRequest,
+			"%s needs to be a non-negative number, got '%s'", param, value)
+	}
+	return result, nil
+}
+
+func (h *ApiV1Handler) listComponents(r *http.Request) (int, interface{}, *apiError) {
+	offset, err := parseNonNegative(r, "offset", 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	limit, err := parseNonNegative(r, "limit", kApiV1DefaultLimit)
+	if err != nil {
+		return 0, nil, err
+	}
+	if limit == 0 || limit > kApiV1MaxLimit {
+		limit = kApiV1MaxLimit
+	}
+
+	// Search results are ranked, otherwise ordered by id.
+	var candidates []*Component
+	if query := r.FormValue("q"); query != "" {
+		candidates = h.store.Search(query, 0).Results
+	} else {
+		h.store.IterateAll(func(c *Component) bool {
+			candidates = append(candidates, c)
+			return true
+		})
+	}
+	category := r.FormValue("category")
+	result := &JsonApiComponentList{
+		Offset: offset,
+		Limit:  limit,
+		Items:  make([]JsonComponent, 0, 10),
+	}
+	for _, c := range candidates {
+		if category != "" && !strings.EqualFold(c.Category, category) {
+			continue
+		}
+		if result.Total >= offset && len(result.Items) < limit {
+			result.Items = append(result.Items, toJsonComponent(c))
+		}
+		result.Total++
+	}
+	return http.StatusOK, result, nil
+}
+
+// Read component from request body. The output of GET can be sent back,
+// fields that are not part of the component itself are ignored.
+func decodeApiComponent(r *http.Request, c *Component) *apiError {
+	body := &JsonComponent{Component: *c}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, kApiV1MaxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(body); err != nil {
+		return newApiError(http.StatusBadRequest, "Invalid component: %s", err)
+	}
+	*c = body.Component
+	return nil
+}
+
+// Validate, clean up and store component with given id. existing is the
+// current version or nil if it is new.
+func (h *ApiV1Handler) saveComponent(r *http.Request, id int, c Component, existing *Component) (*Component, *apiError) {
+	if c.Id != 0 && c.Id != id {
+		return nil, newApiError(http.StatusBadRequest,
+			"Component id %d does not match %d", c.Id, id)
+	}
+	c.Id = id
+	equiv_set := id
+	if existing != nil {
+		equiv_set = existing.Equiv_set
+	}
+	if c.Equiv_set != 0 && c.Equiv_set != equiv_set {
+		return nil, newApiError(http.StatusBadRequest,
+			"equiv_set can only be changed with %s", kApiV1Sets)
+	}
+	c.Equiv_set = 0 // Not modified by EditRecord() anyway.
+	if c.Drawersize < 0 {
+		return nil, newApiError(http.StatusBadRequest,
+			"drawersize needs to be non-negative")
+	}
+	cleanupComponent(&c)
+	if existing == nil && c == (Component{Id: id}) {
+		return nil, newApiError(http.StatusBadRequest, "Empty component")
+	}
+	saved, msg := h.store.EditRecord(h.auth.Editor(r), id, func(comp *Component) bool {
+		*comp = c
+		return true
+	})
+	if !saved && msg != "No change." {
+		return nil, newApiError(http.StatusInternalServerError,
+			"Component %d not stored: %s", id, msg)
+	}
+	return h.store.FindById(id), nil
+}
+
+func (h *ApiV1Handler) createComponent(out http.ResponseWriter, r *http.Request) (int, interface{}, *apiError) {
+	if err := h.checkEditAllowed(r); err != nil {
+		return 0, nil, err
+	}
+	var c Component
+	if err := decodeApiComponent(r, &c); err != nil {
+		return 0, nil, err
+	}
+	h.create.Lock()
+	defer h.create.Unlock()
+	id := c.Id
+	if id == 0 {
+		id = 1
+		h.store.IterateAll(func(existing *Component) bool {
+			if existing.Id >= id {
+				id = existing.Id + 1
+			}
+			return true
+		})
+	} else if id < 0 {
+		return 0, nil, newApiError(http.StatusBadRequest,
+			"Component id needs to be non-negative")
+	}
+	if h.store.FindById(id) != nil {
+		return 0, nil, newApiError(http.StatusConflict,
+			"Component %d already exists", id)
+	}
+	stored, err := h.saveComponent(r, id, c, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	out.Header().Set("Location", fmt.Sprintf("%s/%d", kApiV1Components, id))
+	return http.StatusCreated, toJsonComponent(stored), nil
+}
+
+func (h *ApiV1Handler) replaceComponent(out http.ResponseWriter, r *http.Request, id int) (int, interface{}, *apiError) {
+	if err := h.checkEditAllowed(r); err != nil {
+		return 0, nil, err
+	}
+	var c Component
+	if err := decodeApiComponent(r, &c); err != nil {
+		return 0, nil, err
+	}
+	existing := h.store.FindById(id)
+	stored, err := h.saveComponent(r, id, c, existing)
+	if err != nil {
+		return 0, nil, err
+	}
+	if existing == nil {
+		out.Header().Set("Location", fmt.Sprintf("%s/%d", kApiV1Components, id))
+		return http.StatusCreated, toJsonComponent(stored), nil
+	}
+	return http.StatusOK, toJsonComponent(stored), nil
+}
+
+func (h *ApiV1Handler) patchComponent(r *http.Request, id int) (int, interface{}, *apiError) {
+	if err := h.checkEditAllowed(r); err != nil {
+		return 0, nil, err
+	}
+	existing := h.store.FindById(id)
+	if existing == nil {
+		return 0, nil, newApiError(http.StatusNotFound, "No component %d", id)
+	}
+	c := *existing // Only fields present in the request are overwritten.
+	if err := decodeApiComponent(r, &c); err != nil {
+		return 0, nil, err
+	}
+	stored, err := h.saveComponent(r, id, c, existing)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, toJsonComponent(stored), nil
+}
+
+func (h *ApiV1Handler) sets(out http.ResponseWriter, r *http.Request, path string) (int, interface{}, *apiError) {
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "":
+		if r.Method != "GET" && r.Method != "HEAD" {
+			return 0, nil, methodNotAllowed(r, "GET")
+		}
+		return h.listMatchingSets(r)
+	case len(parts) == 1:
+		if r.Method != "GET" && r.Method != "HEAD" {
+			return 0, nil, methodNotAllowed(r, "GET")
+		}
+		set, err := parseApiId(parts[0], "set")
+		if err != nil {
+			return 0, nil, err
+		}
+		members := h.setMembers(set)
+		if len(members.Members) == 0 {
+			return 0, nil, newApiError(http.StatusNotFound, "No set %d", set)
+		}
+		return http.StatusOK, members, nil
+	case len(parts) == 3 && parts[1] == "members":
+		set, err := parseApiId(parts[0], "set")
+		if err != nil {
+			return 0, nil, err
+		}
+		id, err := parseApiId(parts[2], "component")
+		if err != nil {
+			return 0, nil, err
+		}
+		switch r.Method {
+		case "PUT":
+			return h.joinSet(out, r, set, id)
+		case "DELETE":
+			return h.leaveSet(r, set, id)
+		}
+		return 0, nil, methodNotAllowed(r, "PUT, DELETE")
+	}
+	return 0, nil, newApiError(http.StatusNotFound, "No such resource %s", r.URL.Path)
+}
+
+func (h *ApiV1Handler) setMembers(set int) *JsonApiSet {
+	result := &JsonApiSet{
+		Id:      set,
+		Members: make([]JsonComponent, 0, 5),
+	}
+	for _, c := range h.store.SetMembers(set) {
+		result.Members = append(result.Members, toJsonComponent(c))
+	}
+	return result
+}
+
+// The sets the drag'n drop UI on the form page shows: all sets that
+// contain components with the same category and value.
+func (h *ApiV1Handler) listMatchingSets(r *http.Request) (int, interface{}, *apiError) {
+	value := r.FormValue("component")
+	if value == "" {
+		return 0, nil, newApiError(http.StatusBadRequest,
+			"Required parameter 'component' missing")
+	}
+	id, err := parseApiId(value, "component")
+	if err != nil {
+		return 0, nil, err
+	}
+	result := &JsonApiSetList{
+		Sets: make([]JsonApiSet, 0, 5),
+	}
+	var current_set *JsonApiSet
+	for _, c := range h.store.MatchingEquivSetForComponent(id) {
+		if current_set == nil || c.Equiv_set != current_set.Id {
+			result.Sets = append(result.Sets, JsonApiSet{Id: c.Equiv_set})
+			current_set = &result.Sets[len(result.Sets)-1]
+		}
+		current_set.Members = append(current_set.Members, toJsonComponent(c))
+	}
+	return http.StatusOK, result, nil
+}
+
+func (h *ApiV1Handler) joinSet(out http.ResponseWriter, r *http.Request, set int, id int) (int, interface{}, *apiError) {
+	if err := h.checkEditAllowed(r); err != nil {
+		return 0, nil, err
+	}
+	if len(h.store.SetMembers(set)) == 0 {
+		return 0, nil, newApiError(http.StatusNotFound, "No set %d", set)
+	}
+	if h.store.FindById(id) == nil {
+		return 0, nil, newApiError(http.StatusNotFound, "No component %d", id)
+	}
+	h.store.JoinSet(h.auth.Editor(r), id, set)
+	// Sets are named after their lowest member, so joining can renumber it.
+	joined := h.store.FindById(id).Equiv_set
+	out.Header().Set("Location", fmt.Sprintf("%s/%d", kApiV1Sets, joined))
+	return http.StatusOK, h.setMembers(joined), nil
+}
+
+func (h *ApiV1Handler) leaveSet(r *http.Request, set int, id int) (int, interface{}, *apiError) {
+	if err := h.checkEditAllowed(r); err != nil {
+		return 0, nil, err
+	}
+	c := h.store.FindById(id)
+	if c == nil || c.Equiv_set != set {
+		return 0, nil, newApiError(http.StatusNotFound,
+			"Component %d is not in set %d", id, set)
+	}
+	h.store.LeaveSet(h.auth.Editor(r), id)
+	return http.StatusNoContent, nil, nil
+}
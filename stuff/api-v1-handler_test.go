@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func newApiV1TestHandler(t *testing.T, editNets []*net.IPNet) (*ApiV1Handler, func()) {
+	dbfile, _ := ioutil.TempFile("", "api-v1")
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, _ := NewDBBackend(db, true, kSearchEngineMemory, "")
+	handler := &ApiV1Handler{store: store, auth: NewAuth(nil, editNets, RoleEditor, nil)}
+	return handler, func() { syscall.Unlink(dbfile.Name()) }
+}
+
+func expectEqualInt(t *testing.T, a int, b int) {
+	if a != b {
+		t.Errorf("%d != %d", a, b)
+	}
+}
+
+// Send request and decode JSON response into result (if not nil).
+func apiRequest(t *testing.T, h http.Handler, method, url, body string, result interface{}) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	out := httptest.NewRecorder()
+	h.ServeHTTP(out, req)
+	if result != nil {
+		if err := json.Unmarshal(out.Body.Bytes(), result); err != nil {
+			t.Errorf("%s %s: can't decode '%s': %s", method, url, out.Body.String(), err)
+		}
+	}
+	return out
+}
+
+func TestApiV1Components(t *testing.T) {
+	h, cleanup := newApiV1TestHandler(t, nil)
+	defer cleanup()
+
+	var c JsonComponent
+	out := apiRequest(t, h, "POST", "/api/v1/components",
+		`{"category":"Resistor", "value":"10 kOhm", "quantity":"5"}`, &c)
+	expectEqualInt(t, out.Code, http.StatusCreated)
+	expectEqual(t, out.Header().Get("Location"), "/api/v1/components/1")
+	expectEqual(t, c.Value, "10k") // Cleaned up
+	expectEqualInt(t, c.Equiv_set, 1)
+
+	out = apiRequest(t, h, "POST", "/api/v1/components",
+		`{"id":42, "category":"Capacitor (C)", "value":"0.1uF"}`, &c)
+	expectEqualInt(t, out.Code, http.StatusCreated)
+	expectEqualInt(t, c.Id, 42)
+	expectEqual(t, c.Value, "100nF")
+
+	var apiErr JsonApiError
+	out = apiRequest(t, h, "POST", "/api/v1/components", `{"id":42, "value":"x"}`, &apiErr)
+	expectEqualInt(t, out.Code, http.StatusConflict)
+	expectEqualInt(t, apiErr.Status, http.StatusConflict)
+
+	// Next free id.
+	out = apiRequest(t, h, "POST", "/api/v1/components", `{"value":"foo"}`, &c)
+	expectEqualInt(t, c.Id, 43)
+
+	// Invalid input.
+	out = apiRequest(t, h, "POST", "/api/v1/components", `{"value":`, nil)
+	expectEqualInt(t, out.Code, http.StatusBadRequest)
+	out = apiRequest(t, h, "POST", "/api/v1/components", `{"colour":"red"}`, nil)
+	expectEqualInt(t, out.Code, http.StatusBadRequest)
+	out = apiRequest(t, h, "POST", "/api/v1/components", `{}`, nil)
+	expectEqualInt(t, out.Code, http.StatusBadRequest)
+
+	// Get, also what we get can be sent back.
+	out = apiRequest(t, h, "GET", "/api/v1/components/1", "", &c)
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqual(t, c.Image, "/img/1")
+	roundtrip, _ := json.Marshal(c)
+	out = apiRequest(t, h, "PUT", "/api/v1/components/1", string(roundtrip), &c)
+	expectEqualInt(t, out.Code, http.StatusOK)
+
+	out = apiRequest(t, h, "GET", "/api/v1/components/7", "", &apiErr)
+	expectEqualInt(t, out.Code, http.StatusNotFound)
+	out = apiRequest(t, h, "GET", "/api/v1/components/foo", "", nil)
+	expectEqualInt(t, out.Code, http.StatusNotFound)
+
+	// Put replaces everything.
+	out = apiRequest(t, h, "PUT", "/api/v1/components/1", `{"value":"22k"}`, &c)
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqual(t, c.Value, "22k")
+	expectEqual(t, c.Category, "")
+	out = apiRequest(t, h, "PUT", "/api/v1/components/1", `{"id":2, "value":"22k"}`, nil)
+	expectEqualInt(t, out.Code, http.StatusBadRequest)
+	out = apiRequest(t, h, "PUT", "/api/v1/components/2", `{"value":"new"}`, &c)
+	expectEqualInt(t, out.Code, http.StatusCreated)
+
+	// Patch only modifies what is given.
+	out = apiRequest(t, h, "PATCH", "/api/v1/components/42", `{"quantity":"100"}`, &c)
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqual(t, c.Value, "100nF")
+	expectEqual(t, c.Quantity, "100")
+	out = apiRequest(t, h, "PATCH", "/api/v1/components/7", `{"quantity":"1"}`, nil)
+	expectEqualInt(t, out.Code, http.StatusNotFound)
+
+	out = apiRequest(t, h, "DELETE", "/api/v1/components/42", "", nil)
+	expectEqualInt(t, out.Code, http.StatusMethodNotAllowed)
+	expectEqual(t, out.Header().Get("Allow"), "GET, PUT, PATCH")
+
+	// Listing and filtering.
+	var list JsonApiComponentList
+	apiRequest(t, h, "GET", "/api/v1/components", "", &list)
+	expectEqualInt(t, list.Total, 4)
+	expectEqualInt(t, list.Items[0].Id, 1)
+	apiRequest(t, h, "GET", "/api/v1/components?offset=1&limit=2", "", &list)
+	expectEqualInt(t, list.Total, 4)
+	expectEqualInt(t, len(list.Items), 2)
+	expectEqualInt(t, list.Items[0].Id, 2)
+	apiRequest(t, h, "GET", "/api/v1/components?category=capacitor+(c)", "", &list)
+	expectEqualInt(t, list.Total, 1)
+	apiRequest(t, h, "GET", "/api/v1/components?q=100n", "", &list)
+	expectEqualInt(t, list.Total, 1)
+	expectEqualInt(t, list.Items[0].Id, 42)
+	out = apiRequest(t, h, "GET", "/api/v1/components?limit=-1", "", nil)
+	expectEqualInt(t, out.Code, http.StatusBadRequest)
+}
+
+// Each of the concurrent creations gets its own id; none overwrites another.
+func TestApiV1ConcurrentCreate(t *testing.T) {
+	h, cleanup := newApiV1TestHandler(t, nil)
+	defer cleanup()
+
+	const kCreators = 20
+	ids := make([]int, kCreators)
+	var wg sync.WaitGroup
+	for i := 0; i < kCreators; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var c JsonComponent
+			out := apiRequest(t, h, "POST", "/api/v1/components",
+				fmt.Sprintf(`{"value":"part%d"}`, i), &c)
+			expectEqualInt(t, out.Code, http.StatusCreated)
+			ids[i] = c.Id
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[int]bool)
+	for i, id := range ids {
+		ExpectTrue(t, !seen[id], fmt.Sprintf("id %d given out twice", id))
+		seen[id] = true
+		expectEqual(t, h.store.FindById(id).Value, fmt.Sprintf("part%d", i))
+	}
+}
+
+func TestApiV1Sets(t *testing.T) {
+	h, cleanup := newApiV1TestHandler(t, nil)
+	defer cleanup()
+	for _, body := range []string{`{"id":1, "category":"LED", "value":"red"}`,
+		`{"id":2, "category":"LED", "value":"red"}`, `{"id":3, "category":"LED", "value":"red"}`} {
+		apiRequest(t, h, "POST", "/api/v1/components", body, nil)
+	}
+
+	var set JsonApiSet
+	out := apiRequest(t, h, "PUT", "/api/v1/sets/1/members/2", "", &set)
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqualInt(t, set.Id, 1)
+	expectEqualInt(t, len(set.Members), 2)
+
+	out = apiRequest(t, h, "GET", "/api/v1/sets/1", "", &set)
+	expectEqualInt(t, len(set.Members), 2)
+	out = apiRequest(t, h, "GET", "/api/v1/sets/2", "", nil)
+	expectEqualInt(t, out.Code, http.StatusNotFound)
+	out = apiRequest(t, h, "PUT", "/api/v1/sets/1/members/7", "", nil)
+	expectEqualInt(t, out.Code, http.StatusNotFound)
+
+	var sets JsonApiSetList
+	apiRequest(t, h, "GET", "/api/v1/sets?component=3", "", &sets)
+	expectEqualInt(t, len(sets.Sets), 2)
+	expectEqualInt(t, len(sets.Sets[0].Members), 2)
+	expectEqualInt(t, sets.Sets[1].Id, 3)
+	out = apiRequest(t, h, "GET", "/api/v1/sets", "", nil)
+	expectEqualInt(t, out.Code, http.StatusBadRequest)
+
+	// equiv_set is only modified via the sets API.
+	out = apiRequest(t, h, "PATCH", "/api/v1/components/3", `{"equiv_set":1}`, nil)
+	expectEqualInt(t, out.Code, http.StatusBadRequest)
+
+	out = apiRequest(t, h, "DELETE", "/api/v1/sets/1/members/3", "", nil)
+	expectEqualInt(t, out.Code, http.StatusNotFound)
+	out = apiRequest(t, h, "DELETE", "/api/v1/sets/1/members/2", "", nil)
+	expectEqualInt(t, out.Code, http.StatusNoContent)
+	expectEqualInt(t, h.store.FindById(2).Equiv_set, 2)
+
+	// A lower id joining renumbers the set.
+	apiRequest(t, h, "PUT", "/api/v1/sets/2/members/3", "", nil)
+	expectEqualInt(t, h.store.FindById(3).Equiv_set, 2)
+	out = apiRequest(t, h, "PUT", "/api/v1/sets/2/members/1", "", &set)
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqualInt(t, set.Id, 1)
+	expectEqualInt(t, len(set.Members), 3)
+	expectEqual(t, out.Header().Get("Location"), "/api/v1/sets/1")
+	expectEqualInt(t, h.store.FindById(3).Equiv_set, 1)
+}
+
+func TestApiV1EditPermission(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	h, cleanup := newApiV1TestHandler(t, []*net.IPNet{allowed})
+	defer cleanup()
+
+	// httptest requests come from 192.0.2.1
+	out := apiRequest(t, h, "POST", "/api/v1/components", `{"value":"foo"}`, nil)
+	expectEqualInt(t, out.Code, http.StatusForbidden)
+	out = apiRequest(t, h, "PUT", "/api/v1/sets/1/members/2", "", nil)
+	expectEqualInt(t, out.Code, http.StatusForbidden)
+	out = apiRequest(t, h, "GET", "/api/v1/components", "", nil)
+	expectEqualInt(t, out.Code, http.StatusOK)
+}
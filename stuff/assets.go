@@ -0,0 +1,114 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Templates and static files are compiled into the binary, so it runs
+// without anything else next to it. For development or to give a site its
+// own look, a directory can override them file by file: what is not in
+// the directory comes from the binary.
+
+//go:embed template static
+var embeddedAssets embed.FS
+
+// Files in the embedded directory (template or static), overridden by
+// the files in override_dir if given.
+func NewAssets(embedded_dir string, override_dir string) fs.FS {
+	embedded, err := fs.Sub(embeddedAssets, embedded_dir)
+	if err != nil {
+		panic(err) // Only with a typo in embedded_dir.
+	}
+	if override_dir == "" {
+		return embedded
+	}
+	return &overlayFS{override: containedDir(override_dir), base: embedded}
+}
+
+// Files from override where it has them, otherwise from base.
+type overlayFS struct {
+	override fs.FS
+	base     fs.FS
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	file, err := o.override.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return file, err
+	}
+	return o.base.Open(name)
+}
+
+// Files of both, so that fs.Glob() finds all.
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(o.base, name)
+	override, override_err := fs.ReadDir(o.override, name)
+	if err != nil && override_err != nil {
+		return nil, err
+	}
+	by_name := make(map[string]fs.DirEntry)
+	for _, entry := range append(entries, override...) {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			by_name[entry.Name()] = entry
+		}
+	}
+	result := make([]fs.DirEntry, 0, len(by_name))
+	for _, entry := range by_name {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+// Files on disk below the directory; unlike os.DirFS, symbolic links
+// and hidden files don't give access to anything else (see containedPath).
+type containedDir string
+
+func (d containedDir) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	local_path := containedPath(string(d), name)
+	if local_path == "" {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return os.Open(local_path)
+}
+
+// The file with the given name within root, or "" if it would end up
+// outside: names come from URLs, so must not lead anywhere else via "..",
+// absolute paths or symbolic links. Hidden files (.git, ...) are not
+// served either.
+func containedPath(root string, name string) string {
+	if root == "" || strings.ContainsRune(name, 0) {
+		return ""
+	}
+	cleaned := path.Clean("/" + filepath.ToSlash(name))
+	for _, element := range strings.Split(cleaned, "/") {
+		if strings.HasPrefix(element, ".") {
+			return ""
+		}
+	}
+	result := filepath.Join(root, filepath.FromSlash(cleaned))
+	// Symbolic links inside root are fine, as long as they stay inside.
+	real_root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return ""
+	}
+	real_result, err := filepath.EvalSymlinks(result)
+	if err != nil {
+		return result // Doesn't exist (yet); nothing to escape to.
+	}
+	if rel, err := filepath.Rel(real_root, real_result); err != nil ||
+		rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return result
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestContainedPath(t *testing.T) {
+	_, dir, cleanup := newImageTestDirs(t)
+	defer cleanup()
+	root := dir + "/static"
+	expectEqual(t, containedPath(root, "stuff.css"), filepath.Join(root, "stuff.css"))
+	expectEqual(t, containedPath(root, "/sub/x.txt"), filepath.Join(root, "sub/x.txt"))
+	expectEqual(t, containedPath(root, "sub/../stuff.css"), filepath.Join(root, "stuff.css"))
+	expectEqual(t, containedPath(root, "alias.css"), filepath.Join(root, "alias.css"))
+	// Cleaned to stay within the root.
+	expectEqual(t, containedPath(root, "../secret.txt"), filepath.Join(root, "secret.txt"))
+	expectEqual(t, containedPath(root, dir+"/secret.txt"), filepath.Join(root, dir, "secret.txt"))
+
+	expectEqual(t, containedPath(root, "escape.txt"), "")
+	expectEqual(t, containedPath(root, ".git/config"), "")
+	expectEqual(t, containedPath(root, "sub/.hidden"), "")
+	expectEqual(t, containedPath(root, "stuff.css\x00.png"), "")
+	expectEqual(t, containedPath("", "stuff.css"), "")
+}
+
+func TestEmbeddedAssets(t *testing.T) {
+	static := NewAssets("static", "")
+	on_disk, _ := ioutil.ReadFile("static/stuff.css")
+	embedded, err := fs.ReadFile(static, "stuff.css")
+	ExpectTrue(t, err == nil, "Embedded stuff.css")
+	expectEqual(t, string(embedded), string(on_disk))
+
+	handler := &ImageHandler{static: static}
+	out := rawGet(handler, "/static/stuff.css")
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqual(t, out.Header().Get("Content-Type"), "text/css; charset=utf-8")
+	ExpectTrue(t, out.Header().Get("ETag") != "", "ETag without modification time")
+	expectEqualInt(t, conditionalGet(handler, "/static/stuff.css", out.Header().Get("ETag")).Code,
+		http.StatusNotModified)
+	expectEqualInt(t, rawGet(handler, "/static/../main.go").Code, http.StatusNotFound)
+
+	// All templates are there.
+	ExpectTrue(t, NewTemplateRenderer("", true).cachedTemplates.Lookup("form-template.html") != nil,
+		"Embedded templates")
+}
+
+func TestAssetOverride(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "override")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/stuff.css", []byte("body { color: pink; }"), 0644)
+	ioutil.WriteFile(dir+"/.hidden", []byte("hidden"), 0644)
+
+	handler := &ImageHandler{static: NewAssets("static", dir)}
+	expectEqual(t, rawGet(handler, "/static/stuff.css").Body.String(), "body { color: pink; }")
+	// What is not overridden comes from the binary.
+	out := rawGet(handler, "/static/robots.txt")
+	expectEqualInt(t, out.Code, http.StatusOK)
+	ExpectTrue(t, strings.Contains(out.Body.String(), "User-agent"), "Embedded robots.txt")
+	expectEqualInt(t, rawGet(handler, "/static/.hidden").Code, http.StatusNotFound)
+
+	// Same for templates.
+	os.Mkdir(dir+"/component", 0755)
+	ioutil.WriteFile(dir+"/search-result.html", []byte("<p>Our search</p>"), 0644)
+	ioutil.WriteFile(dir+"/component/package-TO-3.svg", []byte("<svg>ours</svg>"), 0644)
+	templates := NewTemplateRenderer(dir, false)
+	content, _ := templates.ReadFile("search-result.html")
+	expectEqual(t, string(content), "<p>Our search</p>")
+	content, _ = templates.ReadFile("login.html")
+	ExpectTrue(t, strings.Contains(string(content), "<form"), "Embedded login.html")
+	out = httptest.NewRecorder()
+	ExpectTrue(t, templates.Render(out, "package-TO-3.svg", &Component{}), "Render")
+	expectEqual(t, out.Body.String(), "<svg>ours</svg>")
+	out = httptest.NewRecorder()
+	ExpectTrue(t, templates.Render(out, "package-TO-39.svg", &Component{}), "Render embedded")
+	ExpectTrue(t, strings.Contains(out.Body.String(), "<svg"), "Embedded package image")
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Who is making a request and what they are allowed to do.
+//
+// Logged in users have the role of their account. Browsers are identified
+// by a session cookie, API clients send a personal token as
+// "Authorization: Bearer <token>". Everyone else gets the anonymous role;
+// if edit networks are configured, anonymous edits are in addition only
+// allowed from these networks. Logged in editors can edit from anywhere.
+
+const (
+	kLoginPage      = "/login"
+	kLogoutPage     = "/logout"
+	kAccountPage    = "/account"
+	kAdminUsersPage = "/admin/users"
+
+	kSessionCookie   = "stuff-session"
+	kSessionDuration = 30 * 24 * time.Hour
+)
+
+type Auth struct {
+	users         *UserStore   // nil or no users: everyone is anonymous.
+	editNets      []*net.IPNet // IP Networks that are allowed to edit
+	anonymousRole Role
+	clientIP      *ClientIPResolver
+}
+
+func NewAuth(users *UserStore, editNets []*net.IPNet, anonymousRole Role, clientIP *ClientIPResolver) *Auth {
+	return &Auth{
+		users:         users,
+		editNets:      editNets,
+		anonymousRole: anonymousRole,
+		clientIP:      clientIP,
+	}
+}
+
+type currentUserKey struct{}
+
+// The user of a request, looked up once.
+type currentUser struct {
+	once sync.Once
+	user *User
+}
+
+// Several handlers and checks ask who is making the request; with this,
+// the session or API token is only looked up once per request.
+func (a *Auth) RememberUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), currentUserKey{}, &currentUser{})
+		next.ServeHTTP(out, r.WithContext(ctx))
+	})
+}
+
+// If there are accounts people can log in with.
+func (a *Auth) hasAccounts() bool {
+	return a.users != nil && a.users.HasUsers()
+}
+
+// Returns the logged in user or nil.
+func (a *Auth) CurrentUser(r *http.Request) *User {
+	if remembered, ok := r.Context().Value(currentUserKey{}).(*currentUser); ok {
+		remembered.once.Do(func() { remembered.user = a.lookupUser(r) })
+		return remembered.user
+	}
+	return a.lookupUser(r)
+}
+
+func (a *Auth) lookupUser(r *http.Request) *User {
+	if a.users == nil {
+		return nil
+	}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return a.users.ApiTokenUser(strings.TrimSpace(header[len("Bearer "):]))
+	}
+	if cookie, err := r.Cookie(kSessionCookie); err == nil {
+		return a.users.SessionUser(cookie.Value)
+	}
+	return nil
+}
+
+func (a *Auth) Role(r *http.Request) Role {
+	if user := a.CurrentUser(r); user != nil {
+		return user.Role
+	}
+	return a.anonymousRole
+}
+
+func (a *Auth) CanEdit(r *http.Request) bool {
+	if user := a.CurrentUser(r); user != nil {
+		return user.Role >= RoleEditor
+	}
+	return a.anonymousRole >= RoleEditor && editAllowed(a.clientIP.ClientIP(r), a.editNets)
+}
+
+// Admins can manage users and undo edits of others. Without accounts,
+// everyone who can edit is trusted with that.
+func (a *Auth) IsAdmin(r *http.Request) bool {
+	if !a.hasAccounts() {
+		return a.CanEdit(r)
+	}
+	user := a.CurrentUser(r)
+	return user != nil && user.Role >= RoleAdmin
+}
+
+// Whom to attribute changes made with this request to.
+func (a *Auth) Editor(r *http.Request) Editor {
+	editor := Editor{}
+	if ip := a.clientIP.ClientIP(r); ip != nil {
+		editor.Address = ip.String()
+	}
+	if user := a.CurrentUser(r); user != nil {
+		editor.User = user.Name
+	}
+	return editor
+}
+
+type AuthHandler struct {
+	auth     *Auth
+	template *TemplateRenderer
+}
+
+func AddAuthHandler(mux Router, auth *Auth, template *TemplateRenderer) {
+	handler := &AuthHandler{
+		auth:     auth,
+		template: template,
+	}
+	mux.Handle(kLoginPage, handler)
+	mux.Handle(kLogoutPage, handler)
+	mux.Handle(kAccountPage, handler)
+	mux.Handle(kAdminUsersPage, handler)
+}
+
+func (h *AuthHandler) ServeHTTP(out http.ResponseWriter, r *http.Request) {
+	if !h.auth.hasAccounts() {
+		http.Error(out, "No user accounts configured", http.StatusNotFound)
+		return
+	}
+	if r.Method == "POST" && !csrfValid(r) {
+		http.Error(out, "Invalid CSRF token; reload page", http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case kLoginPage:
+		h.login(out, r)
+	case kLogoutPage:
+		h.logout(out, r)
+	case kAccountPage:
+		h.account(out, r)
+	case kAdminUsersPage:
+		h.adminUsers(out, r)
+	default:
+		http.NotFound(out, r)
+	}
+}
+
+type LoginPage struct {
+	Msg       string
+	Next      string
+	CsrfToken string
+}
+
+// Only redirect to local pages after login.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") ||
+		strings.HasPrefix(next, "/\\") {
+		return "/form"
+	}
+	return next
+}
+
+func (h *AuthHandler) login(out http.ResponseWriter, r *http.Request) {
+	page := &LoginPage{
+		Next:      localRedirect(r.FormValue("next")),
+		CsrfToken: csrfToken(out, r),
+	}
+	if r.Method != "POST" {
+		h.template.Render(out, "login.html", page)
+		return
+	}
+	user := h.auth.users.Authenticate(r.FormValue("name"), r.FormValue("password"))
+	if user == nil {
+		log.Printf("Failed login for '%s' from %s", r.FormValue("name"),
+			h.auth.clientIP.ClientAddress(r))
+		page.Msg = "Wrong user name or password."
+		h.template.RenderWithHttpCode(out, nil, http.StatusUnauthorized, "login.html", page)
+		return
+	}
+	token, err := h.auth.users.NewSession(user.Name, kSessionDuration)
+	if err != nil {
+		http.Error(out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(out, &http.Cookie{
+		Name:     kSessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(kSessionDuration),
+		HttpOnly: true,
+		Secure:   h.auth.clientIP.IsHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("Login '%s' from %s", user.Name, h.auth.clientIP.ClientAddress(r))
+	http.Redirect(out, r, page.Next, http.StatusSeeOther)
+}
+
+func (h *AuthHandler) logout(out http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(kSessionCookie); err == nil {
+		h.auth.users.EndSession(cookie.Value)
+	}
+	http.SetCookie(out, &http.Cookie{
+		Name:   kSessionCookie,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+	http.Redirect(out, r, "/search", http.StatusSeeOther)
+}
+
+// Returns the logged in user; if there is none, redirects to the login page.
+func (h *AuthHandler) requireLogin(out http.ResponseWriter, r *http.Request) *User {
+	user := h.auth.CurrentUser(r)
+	if user == nil {
+		http.Redirect(out, r, kLoginPage+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	}
+	return user
+}
+
+type AccountPage struct {
+	User      *User
+	Tokens    []ApiToken
+	NewToken  string // Only shown once after creation.
+	Msg       string
+	CsrfToken string
+}
+
+func (h *AuthHandler) account(out http.ResponseWriter, r *http.Request) {
+	user := h.requireLogin(out, r)
+	if user == nil {
+		return
+	}
+	page := &AccountPage{User: user, CsrfToken: csrfToken(out, r)}
+	if r.Method == "POST" {
+		var err error
+		switch r.FormValue("op") {
+		case "password":
+			if h.auth.users.Authenticate(user.Name, r.FormValue("old_password")) == nil {
+				page.Msg = "Current password is wrong."
+			} else if err = h.auth.users.SetPassword(user.Name, r.FormValue("password")); err == nil {
+				page.Msg = "Password changed; please log in again on your other devices."
+				// Changing the password ended all sessions,
+				// including this one. Start a new one.
+				if token, err := h.auth.users.NewSession(user.Name, kSessionDuration); err == nil {
+					http.SetCookie(out, &http.Cookie{
+						Name: kSessionCookie, Value: token, Path: "/",
+						Expires:  time.Now().Add(kSessionDuration),
+						HttpOnly: true, Secure: h.auth.clientIP.IsHTTPS(r),
+						SameSite: http.SameSiteLaxMode,
+					})
+				}
+			}
+		case "new-token":
+			page.NewToken, err = h.auth.users.NewApiToken(user.Name, r.FormValue("label"))
+		case "revoke-token":
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			err = h.auth.users.RevokeApiToken(user.Name, id)
+		}
+		if err != nil {
+			page.Msg = err.Error()
+		}
+	}
+	page.Tokens = h.auth.users.ApiTokens(user.Name)
+	h.template.Render(out, "account.html", page)
+}
+
+type AdminUsersPage struct {
+	User      *User
+	Users     []User
+	Roles     []string
+	Msg       string
+	CsrfToken string
+}
+
+func (h *AuthHandler) adminUsers(out http.ResponseWriter, r *http.Request) {
+	user := h.requireLogin(out, r)
+	if user == nil {
+		return
+	}
+	if user.Role < RoleAdmin {
+		http.Error(out, "Only for admins", http.StatusForbidden)
+		return
+	}
+	page := &AdminUsersPage{
+		User:      user,
+		Roles:     []string{RoleViewer.String(), RoleEditor.String(), RoleAdmin.String()},
+		CsrfToken: csrfToken(out, r),
+	}
+	if r.Method == "POST" {
+		name := r.FormValue("name")
+		role, err := ParseRole(r.FormValue("role"))
+		op := r.FormValue("op")
+		switch {
+		case op == "create" && err == nil:
+			err = h.auth.users.CreateUser(name, r.FormValue("password"), role)
+		case op == "role" && err == nil:
+			err = h.auth.users.SetRole(name, role)
+		case op == "password":
+			err = h.auth.users.SetPassword(name, r.FormValue("password"))
+		case op == "delete" && name == user.Name:
+			err = fmt.Errorf("Can't delete yourself")
+		case op == "delete":
+			err = h.auth.users.DeleteUser(name)
+		}
+		if err != nil {
+			page.Msg = err.Error()
+		} else {
+			page.Msg = fmt.Sprintf("User '%s': done.", name)
+			log.Printf("ADMIN %s: %s user '%s'", user.Name, op, name)
+		}
+	}
+	page.Users = h.auth.users.Users()
+	h.template.Render(out, "admin-users.html", page)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAuthRoles(t *testing.T) {
+	users, cleanup := newTestUserStore(t)
+	defer cleanup()
+	users.CreateUser("viewer", "secret-password", RoleViewer)
+	users.CreateUser("editor", "secret-password", RoleEditor)
+	viewer_token, _ := users.NewApiToken("viewer", "")
+	editor_token, _ := users.NewApiToken("editor", "")
+
+	_, hackerspace, _ := net.ParseCIDR("10.0.0.0/8")
+	auth := NewAuth(users, []*net.IPNet{hackerspace}, RoleEditor, nil)
+
+	request := func(addr string, token string) *http.Request {
+		r := httptest.NewRequest("GET", "/form", nil)
+		r.RemoteAddr = addr + ":1234"
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return r
+	}
+	ExpectTrue(t, auth.CanEdit(request("10.1.2.3", "")), "anonymous in space")
+	ExpectTrue(t, !auth.CanEdit(request("192.168.1.1", "")), "anonymous from home")
+	ExpectTrue(t, auth.CanEdit(request("192.168.1.1", editor_token)), "editor from home")
+	ExpectTrue(t, !auth.CanEdit(request("10.1.2.3", viewer_token)), "viewer in space")
+	ExpectTrue(t, !auth.CanEdit(request("192.168.1.1", "stuff_bogus")), "bogus token")
+
+	expectEqual(t, auth.Editor(request("192.168.1.1", editor_token)).String(), "editor@192.168.1.1")
+	expectEqual(t, auth.Editor(request("10.1.2.3", "")).String(), "10.1.2.3")
+
+	viewers_only := NewAuth(users, nil, RoleViewer, nil)
+	ExpectTrue(t, !viewers_only.CanEdit(request("10.1.2.3", "")), "anonymous viewer")
+	ExpectTrue(t, viewers_only.CanEdit(request("10.1.2.3", editor_token)), "editor")
+}
+
+func TestAuthLoginSession(t *testing.T) {
+	users, cleanup := newTestUserStore(t)
+	defer cleanup()
+	users.CreateUser("alice", "secret-password", RoleEditor)
+	auth := NewAuth(users, nil, RoleViewer, nil)
+	handler := &AuthHandler{auth: auth, template: NewTemplateRenderer("template", false)}
+
+	forwarded_proto := ""
+	login := func(password string, next string) *httptest.ResponseRecorder {
+		form := url.Values{"name": {"alice"}, "password": {password}, "next": {next}}
+		r := httptest.NewRequest("POST", kLoginPage, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if forwarded_proto != "" {
+			r.Header.Set("X-Forwarded-Proto", forwarded_proto)
+		}
+		addCsrfToken(r)
+		out := httptest.NewRecorder()
+		handler.ServeHTTP(out, r)
+		return out
+	}
+	out := login("wrong-password", "/form")
+	expectEqualInt(t, out.Code, http.StatusUnauthorized)
+	ExpectTrue(t, len(out.Result().Cookies()) == 0, "no session")
+
+	out = login("secret-password", "//evil.example.com/")
+	expectEqualInt(t, out.Code, http.StatusSeeOther)
+	expectEqual(t, out.Header().Get("Location"), "/form") // Only local redirects.
+	cookies := out.Result().Cookies()
+	ExpectTrue(t, len(cookies) == 1 && cookies[0].Name == kSessionCookie, "cookie")
+	ExpectTrue(t, cookies[0].HttpOnly, "HttpOnly")
+	ExpectTrue(t, !cookies[0].Secure, "plain HTTP")
+
+	// Behind a proxy terminating TLS; only believed if it is trusted.
+	forwarded_proto = "https"
+	ExpectTrue(t, !login("secret-password", "/").Result().Cookies()[0].Secure, "untrusted proxy")
+	auth.clientIP = NewClientIPResolver(parseCIDRList("trusted-proxies", "192.0.2.1"), kForwardedFor)
+	ExpectTrue(t, login("secret-password", "/").Result().Cookies()[0].Secure, "HTTPS at proxy")
+
+	r := httptest.NewRequest("GET", "/form", nil)
+	r.AddCookie(cookies[0])
+	ExpectTrue(t, auth.CanEdit(r), "logged in editor")
+
+	logout := httptest.NewRequest("POST", kLogoutPage, nil)
+	logout.AddCookie(cookies[0])
+	out = httptest.NewRecorder()
+	handler.ServeHTTP(out, logout)
+	expectEqualInt(t, out.Code, http.StatusForbidden) // Needs CSRF token.
+	ExpectTrue(t, auth.CanEdit(r), "still logged in")
+	addCsrfToken(logout)
+	handler.ServeHTTP(httptest.NewRecorder(), logout)
+	ExpectTrue(t, !auth.CanEdit(r), "logged out")
+
+	// Admin page is for admins only.
+	session, _ := users.NewSession("alice", kSessionDuration)
+	r = httptest.NewRequest("GET", kAdminUsersPage, nil)
+	r.AddCookie(&http.Cookie{Name: kSessionCookie, Value: session})
+	out = httptest.NewRecorder()
+	handler.ServeHTTP(out, r)
+	expectEqualInt(t, out.Code, http.StatusForbidden)
+
+	// Not logged in: back to the same URL after login.
+	out = httptest.NewRecorder()
+	ExpectTrue(t, handler.requireLogin(out, httptest.NewRequest("GET", "/account/a%3Fb%26c?d=1", nil)) == nil, "no user")
+	location, _ := url.Parse(out.Header().Get("Location"))
+	expectEqual(t, location.Path, kLoginPage)
+	expectEqual(t, localRedirect(location.Query().Get("next")), "/account/a%3Fb%26c?d=1")
+}
+
+func TestAuthAccountsCreatedLater(t *testing.T) {
+	users, cleanup := newTestUserStore(t)
+	defer cleanup()
+	auth := NewAuth(users, nil, RoleEditor, nil)
+	handler := &AuthHandler{auth: auth, template: NewTemplateRenderer("template", false)}
+	loginPage := func() int {
+		out := httptest.NewRecorder()
+		handler.ServeHTTP(out, httptest.NewRequest("GET", kLoginPage, nil))
+		return out.Code
+	}
+	anonymous := httptest.NewRequest("GET", "/form", nil)
+	ExpectTrue(t, auth.IsAdmin(anonymous), "no accounts: editors are admins")
+	expectEqualInt(t, loginPage(), http.StatusNotFound)
+
+	users.CreateUser("alice", "secret-password", RoleAdmin)
+	ExpectTrue(t, !auth.IsAdmin(anonymous), "accounts now")
+	expectEqualInt(t, loginPage(), http.StatusOK)
+}
+
+func TestAuthRememberUser(t *testing.T) {
+	users, cleanup := newTestUserStore(t)
+	defer cleanup()
+	users.CreateUser("alice", "secret-password", RoleEditor)
+	session, _ := users.NewSession("alice", kSessionDuration)
+	auth := NewAuth(users, nil, RoleViewer, nil)
+
+	var before, after *User
+	handler := auth.RememberUser(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		before = auth.CurrentUser(r)
+		users.EndSession(session) // Not looked up again.
+		after = auth.CurrentUser(r)
+	}))
+	r := httptest.NewRequest("GET", "/form", nil)
+	r.AddCookie(&http.Cookie{Name: kSessionCookie, Value: session})
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	ExpectTrue(t, before != nil && before.Name == "alice", "logged in")
+	ExpectTrue(t, after == before, "same user for the whole request")
+	ExpectTrue(t, auth.CurrentUser(r) == nil, "next request looks up again")
+}
+
+func TestApiV1EditWithToken(t *testing.T) {
+	handler, cleanup := newApiV1TestHandler(t, nil)
+	defer cleanup()
+	users, cleanup_users := newTestUserStore(t)
+	defer cleanup_users()
+	users.CreateUser("alice", "secret-password", RoleEditor)
+	token, _ := users.NewApiToken("alice", "")
+	handler.auth = NewAuth(users, nil, RoleViewer, nil)
+
+	body := `{"id":1, "category":"Resistor", "value":"10k"}`
+	out := apiRequest(t, handler, "POST", "/api/v1/components", body, nil)
+	expectEqualInt(t, out.Code, http.StatusForbidden)
+
+	r := httptest.NewRequest("POST", "/api/v1/components", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	out = httptest.NewRecorder()
+	handler.ServeHTTP(out, r)
+	expectEqualInt(t, out.Code, http.StatusCreated)
+}
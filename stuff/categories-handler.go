@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const kAdminCategoriesPage = "/admin/categories"
+
+// Admin page to add, rename, reorder and group categories.
+type CategoriesHandler struct {
+	categories *CategoryStore
+	auth       *Auth
+	template   *TemplateRenderer
+}
+
+func AddCategoriesHandler(mux Router, categories *CategoryStore, auth *Auth, template *TemplateRenderer) {
+	handler := &CategoriesHandler{
+		categories: categories,
+		auth:       auth,
+		template:   template,
+	}
+	mux.Handle(kAdminCategoriesPage, handler)
+}
+
+type CategoriesPage struct {
+	Categories   []Category
+	Groups       []string
+	NextPosition int // Suggested position for a new category.
+	Msg          string
+	CsrfToken    string
+}
+
+func (h *CategoriesHandler) ServeHTTP(out http.ResponseWriter, r *http.Request) {
+	if !h.auth.IsAdmin(r) {
+		http.Error(out, "Only for admins", http.StatusForbidden)
+		return
+	}
+	page := &CategoriesPage{CsrfToken: csrfToken(out, r)}
+	if r.Method == "POST" {
+		if !csrfValid(r) {
+			http.Error(out, "Invalid CSRF token; reload page", http.StatusForbidden)
+			return
+		}
+		page.Msg = h.modify(r)
+	}
+	page.Categories = h.categories.All()
+	page.Groups = h.categories.Groups()
+	if len(page.Categories) > 0 {
+		page.NextPosition = page.Categories[len(page.Categories)-1].Position + 10
+	}
+	h.template.Render(out, "admin-categories.html", page)
+}
+
+// Save or delete category; returns message for the user.
+func (h *CategoriesHandler) modify(r *http.Request) string {
+	old_name := r.FormValue("old_name")
+	position, _ := strconv.Atoi(r.FormValue("position"))
+	c := Category{
+		Name:     strings.TrimSpace(r.FormValue("name")),
+		Position: position,
+		Group:    strings.TrimSpace(r.FormValue("group")),
+		Aliases:  splitAliases(r.FormValue("aliases")),
+		Image:    strings.TrimSpace(r.FormValue("image")),
+	}
+	var err error
+	op := r.FormValue("op")
+	switch op {
+	case "save":
+		err = h.categories.Save(old_name, c)
+	case "delete":
+		c.Name = old_name
+		err = h.categories.Delete(old_name)
+	default:
+		return "Unknown operation"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	log.Printf("CATEGORY %s by %s: '%s' %+v", op, h.auth.Editor(r), old_name, c)
+	return fmt.Sprintf("Category '%s': done.", c.Name)
+}
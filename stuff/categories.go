@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Categories offered in the form. They are kept in the database, so that
+// admins can add or rearrange them on /admin/categories without
+// recompiling.
+var categories_schema string = `
+create table if not exists category (
+       name       text constraint pk_category primary key,
+       position   int not null,   -- Order in which they are shown.
+       grp        text,           -- Shown next to each other in the form.
+       aliases    text,           -- Comma separated other names.
+       image      text            -- How to generate a component image.
+);
+`
+
+// Image value for categories whose image shows the color code of the value;
+// the other generated value images are in value-image.go.
+const kResistorImage = "resistor"
+
+var imageTemplateRegexp = regexp.MustCompile(`^[\w.+-]+\.svg$`)
+
+type Category struct {
+	Name     string
+	Position int
+	Group    string
+	Aliases  []string // Other names people use, e.g. the name before renaming.
+	Image    string   // Template in component/ or one of kValueImages; empty for none.
+}
+
+// Categories we start out with.
+var kDefaultCategories = []Category{
+	{Name: "Resistor", Group: "Resistive", Aliases: []string{"R"}, Image: kResistorImage},
+	{Name: "Potentiometer", Group: "Resistive", Aliases: []string{"Poti"}},
+	{Name: "R-Network", Group: "Resistive"},
+	{Name: "Capacitor (C)", Group: "Reactive", Aliases: []string{"Capacitor", "C"}, Image: kCapacitorImage},
+	{Name: "Aluminum Cap", Group: "Reactive", Aliases: []string{"Electrolytic"}, Image: kElectrolyticImage},
+	{Name: "Inductor (L)", Group: "Reactive", Aliases: []string{"Inductor", "L"}, Image: kInductorImage},
+	{Name: "Diode (D)", Group: "Diodes", Aliases: []string{"Diode", "D"}, Image: "category-Diode.svg"},
+	{Name: "Power Diode", Group: "Diodes"},
+	{Name: "LED", Group: "Diodes", Image: "category-LED.svg"},
+	{Name: "Transistor", Group: "Transistors"},
+	{Name: "Mosfet", Group: "Transistors"},
+	{Name: "IGBT", Group: "Transistors"},
+	{Name: "Integrated Circuit (IC)", Group: "ICs", Aliases: []string{"IC"}},
+	{Name: "IC Analog", Group: "ICs"},
+	{Name: "IC Digital", Group: "ICs"},
+	{Name: "Connector", Group: "Mechanical"},
+	{Name: "Socket", Group: "Mechanical"},
+	{Name: "Switch", Group: "Mechanical"},
+	{Name: "Fuse", Group: "Hardware", Image: kFuseImage},
+	{Name: "Mounting", Group: "Hardware"},
+	{Name: "Heat Sink", Group: "Hardware"},
+	{Name: "Crystal", Group: "Other", Aliases: []string{"Xtal", "Quartz"}, Image: kCrystalImage},
+	{Name: "Microphone", Group: "Other"},
+	{Name: "Transformer", Group: "Other"},
+	{Name: "? MYSTERY", Group: "Other"},
+}
+
+func defaultCategories() []Category {
+	result := make([]Category, len(kDefaultCategories))
+	for i, c := range kDefaultCategories {
+		result[i] = c
+		result[i].Position = 10 * (i + 1)
+	}
+	return result
+}
+
+// All categories are kept in memory, as they are needed for every form
+// and generated image.
+type CategoryStore struct {
+	db    *sql.DB
+	mutex sync.RWMutex
+	all   []Category // Sorted by position.
+}
+
+// Creates the table if needed and fills it with the default categories if
+// it is empty. A nil store has the default categories, read-only.
+func NewCategoryStore(db *sql.DB) (*CategoryStore, error) {
+	if _, err := db.Exec(categories_schema); err != nil {
+		return nil, err
+	}
+	result := &CategoryStore{db: db}
+	var count int
+	if err := db.QueryRow("SELECT count(*) FROM category").Scan(&count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		for _, c := range defaultCategories() {
+			if err := result.insert(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, result.load()
+}
+
+func (s *CategoryStore) insert(c Category) error {
+	_, err := s.db.Exec("INSERT INTO category (name, position, grp, aliases, image) VALUES (?1, ?2, ?3, ?4, ?5)",
+		c.Name, c.Position, c.Group, strings.Join(c.Aliases, ","), c.Image)
+	return err
+}
+
+func (s *CategoryStore) load() error {
+	rows, err := s.db.Query("SELECT name, position, grp, aliases, image FROM category ORDER BY position, name")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	all := make([]Category, 0, 30)
+	for rows.Next() {
+		var c Category
+		var group, aliases, image sql.NullString
+		if err := rows.Scan(&c.Name, &c.Position, &group, &aliases, &image); err != nil {
+			return err
+		}
+		c.Group, c.Image = group.String, image.String
+		c.Aliases = splitAliases(aliases.String)
+		all = append(all, c)
+	}
+	s.mutex.Lock()
+	s.all = all
+	s.mutex.Unlock()
+	return nil
+}
+
+func splitAliases(list string) []string {
+	var result []string
+	for _, alias := range strings.Split(list, ",") {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			result = append(result, alias)
+		}
+	}
+	return result
+}
+
+// All categories in the order they should be shown.
+func (s *CategoryStore) All() []Category {
+	if s == nil {
+		return defaultCategories()
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	result := make([]Category, len(s.all))
+	copy(result, s.all)
+	return result
+}
+
+// Find category by its name or one of its aliases, ignoring case.
+// Returns nil if there is none.
+func (s *CategoryStore) Find(name string) *Category {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil
+	}
+	all := s.All()
+	for i := range all {
+		if strings.EqualFold(all[i].Name, name) {
+			return &all[i]
+		}
+	}
+	for i := range all {
+		for _, alias := range all[i].Aliases {
+			if strings.EqualFold(alias, name) {
+				return &all[i]
+			}
+		}
+	}
+	return nil
+}
+
+// The name we use for the given category name or alias; unknown ones are
+// returned unchanged.
+func (s *CategoryStore) Canonical(name string) string {
+	if c := s.Find(name); c != nil {
+		return c.Name
+	}
+	return name
+}
+
+// Store a new category (old_name empty) or modify an existing one. If it
+// is renamed, the old name becomes an alias, so that components still
+// using it are found.
+func (s *CategoryStore) Save(old_name string, c Category) error {
+	if s == nil {
+		return errors.New("Categories can't be changed")
+	}
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return errors.New("Category needs a name")
+	}
+	if _, generated := kValueImages[c.Image]; c.Image != "" && !generated &&
+		!imageTemplateRegexp.MatchString(c.Image) {
+		return fmt.Errorf("Image needs to be one of '%s' or an SVG template name",
+			strings.Join(valueImageNames(), "', '"))
+	}
+	if old_name != "" && old_name != c.Name {
+		c.Aliases = append(c.Aliases, old_name)
+	}
+	c.Aliases = removeAlias(c.Aliases, c.Name)
+	for _, name := range append([]string{c.Name}, c.Aliases...) {
+		if other := s.Find(name); other != nil && other.Name != old_name {
+			return fmt.Errorf("'%s' is already used by category '%s'", name, other.Name)
+		}
+	}
+
+	var err error
+	if old_name == "" {
+		err = s.insert(c)
+	} else {
+		var result sql.Result
+		result, err = s.db.Exec("UPDATE category SET name = ?2, position = ?3, grp = ?4, aliases = ?5, image = ?6 WHERE name = ?1",
+			old_name, c.Name, c.Position, c.Group, strings.Join(c.Aliases, ","), c.Image)
+		if err == nil {
+			if affected, _ := result.RowsAffected(); affected != 1 {
+				err = fmt.Errorf("No category '%s'", old_name)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.load()
+}
+
+// Remove alias, ignoring case, and duplicates.
+func removeAlias(aliases []string, name string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, alias := range aliases {
+		key := strings.ToLower(alias)
+		if strings.EqualFold(alias, name) || seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, alias)
+	}
+	return result
+}
+
+// Remove category. Components keep their category, it just isn't offered
+// in the form anymore.
+func (s *CategoryStore) Delete(name string) error {
+	if s == nil {
+		return errors.New("Categories can't be changed")
+	}
+	result, err := s.db.Exec("DELETE FROM category WHERE name = ?1", name)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		return fmt.Errorf("No category '%s'", name)
+	}
+	return s.load()
+}
+
+// Groups in the order of their first category.
+func (s *CategoryStore) Groups() []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, c := range s.All() {
+		if !seen[c.Group] {
+			seen[c.Group] = true
+			result = append(result, c.Group)
+		}
+	}
+	return result
+}
+
+// Categories sorted by group, then position.
+func (s *CategoryStore) Grouped() []Category {
+	group_index := make(map[string]int)
+	for i, g := range s.Groups() {
+		group_index[g] = i
+	}
+	result := s.All()
+	sort.SliceStable(result, func(i, j int) bool {
+		return group_index[result[i].Group] < group_index[result[j].Group]
+	})
+	return result
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestCategoryStore(t *testing.T) (*CategoryStore, func()) {
+	dbfile, _ := ioutil.TempFile("", "categories")
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	categories, err := NewCategoryStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return categories, func() { syscall.Unlink(dbfile.Name()) }
+}
+
+func TestCategoryDefaults(t *testing.T) {
+	categories, cleanup := newTestCategoryStore(t)
+	defer cleanup()
+	all := categories.All()
+	expectEqualInt(t, len(all), len(kDefaultCategories))
+	expectEqual(t, all[0].Name, "Resistor")
+	expectEqual(t, categories.Find("capacitor").Name, "Capacitor (C)")
+	expectEqual(t, categories.Canonical("ic"), "Integrated Circuit (IC)")
+	expectEqual(t, categories.Canonical("Flux Capacitor"), "Flux Capacitor")
+	expectEqual(t, categories.Find("xtal").Image, kCrystalImage)
+	ExpectTrue(t, categories.Find("") == nil, "empty")
+
+	// Without database, we still have the defaults.
+	var none *CategoryStore
+	expectEqualInt(t, len(none.All()), len(all))
+	expectEqual(t, none.Find("LED").Image, "category-LED.svg")
+	ExpectTrue(t, none.Save("", Category{Name: "Varistor"}) != nil, "read-only")
+}
+
+func TestCategoryModify(t *testing.T) {
+	categories, cleanup := newTestCategoryStore(t)
+	defer cleanup()
+
+	ExpectTrue(t, categories.Save("", Category{Name: "Varistor", Position: 15, Group: "Resistive", Aliases: []string{"VDR", "MOV"}}) == nil, "new")
+	all := categories.All()
+	expectEqual(t, all[1].Name, "Varistor")
+	expectEqual(t, categories.Canonical("vdr"), "Varistor")
+
+	ExpectTrue(t, categories.Save("", Category{Name: "varistor"}) != nil, "duplicate")
+	ExpectTrue(t, categories.Save("", Category{Name: "Surge Protector", Aliases: []string{"VDR"}}) != nil, "alias taken")
+	ExpectTrue(t, categories.Save("", Category{Name: "Foo", Image: "../passwd"}) != nil, "bad image")
+	ExpectTrue(t, categories.Save("", Category{Name: " "}) != nil, "no name")
+
+	// Rename: old name becomes alias.
+	c := *categories.Find("Varistor")
+	c.Name = "Varistor (RV)"
+	c.Group = "Other"
+	ExpectTrue(t, categories.Save("Varistor", c) == nil, "rename")
+	expectEqual(t, categories.Canonical("Varistor"), "Varistor (RV)")
+	expectEqual(t, categories.Canonical("MOV"), "Varistor (RV)")
+	ExpectTrue(t, categories.Save("Nonexistent", Category{Name: "Bar"}) != nil, "rename unknown")
+
+	// Groups are ordered by their first category: Varistor brings the
+	// 'Other' group up right after the resistive ones.
+	groups := categories.Groups()
+	expectEqual(t, groups[0], "Resistive")
+	expectEqual(t, groups[1], "Other")
+	grouped := categories.Grouped()
+	expectEqual(t, grouped[3].Name, "Varistor (RV)")
+	expectEqual(t, grouped[4].Name, "Crystal")
+
+	ExpectTrue(t, categories.Delete("Varistor (RV)") == nil, "delete")
+	ExpectTrue(t, categories.Find("VDR") == nil, "gone")
+	ExpectTrue(t, categories.Delete("Varistor (RV)") != nil, "already gone")
+}
+
+func TestFormUsesCategories(t *testing.T) {
+	categories, cleanup := newTestCategoryStore(t)
+	defer cleanup()
+	categories.Save("", Category{Name: "Oscillator", Position: 1, Group: "Timing", Aliases: []string{"Osc"}})
+
+	store, cleanup_store := newHistoryTestStore(t)
+	defer cleanup_store()
+	handler := &FormHandler{
+		store:      store,
+		template:   NewTemplateRenderer("template", false),
+		auth:       NewAuth(nil, nil, RoleEditor, nil),
+		categories: categories,
+	}
+	values := url.Values{
+		"edit_id":         {"1"},
+		"category_select": {"-"},
+		"category_txt":    {"osc"},
+		"value":           {"16MHz"},
+	}
+	r := httptest.NewRequest("POST", kFormPage, strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	addCsrfToken(r)
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, r)
+	expectEqual(t, store.FindById(1).Category, "Oscillator")
+
+	out = httptest.NewRecorder()
+	handler.ServeHTTP(out, httptest.NewRequest("GET", kFormPage+"?id=1", nil))
+	expectEqualInt(t, out.Code, http.StatusOK)
+	body := out.Body.String()
+	ExpectTrue(t, strings.Contains(body, `value="Oscillator"`), "offered")
+	ExpectTrue(t, strings.Index(body, `value="Oscillator"`) < strings.Index(body, `value="Resistor"`), "first")
+
+	// After a rename, the item with the old name still has it selected.
+	categories.Save("Oscillator", Category{Name: "Clock", Position: 1, Group: "Timing"})
+	out = httptest.NewRecorder()
+	handler.ServeHTTP(out, httptest.NewRequest("GET", kFormPage+"?id=1", nil))
+	body = out.Body.String()
+	ExpectTrue(t, regexp.MustCompile(`value="Clock"[^>]*checked`).MatchString(body), "renamed selected")
+	ExpectTrue(t, !regexp.MustCompile(`id="catother"[^>]*checked`).MatchString(body), "not other")
+}
+
+func TestCategoriesHandler(t *testing.T) {
+	categories, cleanup := newTestCategoryStore(t)
+	defer cleanup()
+	users, cleanup_users := newTestUserStore(t)
+	defer cleanup_users()
+	users.CreateUser("admin", "secret-password", RoleAdmin)
+	handler := &CategoriesHandler{
+		categories: categories,
+		auth:       NewAuth(users, nil, RoleEditor, nil),
+		template:   NewTemplateRenderer("template", false),
+	}
+
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, httptest.NewRequest("GET", kAdminCategoriesPage, nil))
+	expectEqualInt(t, out.Code, http.StatusForbidden)
+
+	session, _ := users.NewSession("admin", time.Hour)
+	values := url.Values{"op": {"save"}, "name": {"Sensor"}, "position": {"500"},
+		"group": {"Other"}, "aliases": {"Detector, Transducer"}}
+	r := httptest.NewRequest("POST", kAdminCategoriesPage, strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: kSessionCookie, Value: session})
+	addCsrfToken(r)
+	out = httptest.NewRecorder()
+	handler.ServeHTTP(out, r)
+	expectEqualInt(t, out.Code, http.StatusOK)
+	ExpectTrue(t, strings.Contains(out.Body.String(), `value="Sensor"`), "listed")
+	expectEqual(t, categories.Canonical("transducer"), "Sensor")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Find out the address of the client that made a request.
+//
+// Behind a reverse proxy, RemoteAddr is the proxy; the proxy tells us who
+// it talked to in the X-Forwarded-For or Forwarded (RFC 7239) header. Each
+// proxy appends the address it got the request from, but anyone can send
+// these headers to begin with, so we only believe entries added by proxies
+// we trust: walk the list right-to-left starting with RemoteAddr, and stop
+// at the first address that is not a trusted proxy.
+//
+// Only the header the proxy actually sets is looked at: most proxies just
+// append to X-Forwarded-For and pass a Forwarded header from the client
+// through untouched, so everything in it could be made up.
+type ClientIPResolver struct {
+	trustedProxies []*net.IPNet
+	header         string // kForwardedFor or kForwarded.
+}
+
+const (
+	kForwardedFor = "X-Forwarded-For"
+	kForwarded    = "Forwarded"
+)
+
+// A nil resolver, or one without trusted proxies, always uses RemoteAddr.
+// The header is the one the proxies set, kForwardedFor or kForwarded.
+func NewClientIPResolver(trustedProxies []*net.IPNet, header string) *ClientIPResolver {
+	return &ClientIPResolver{trustedProxies: trustedProxies, header: header}
+}
+
+func (c *ClientIPResolver) isTrusted(ip net.IP) bool {
+	if c == nil {
+		return false
+	}
+	for _, n := range c.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the IP address of the client or nil if it can't be determined.
+func (c *ClientIPResolver) ClientIP(r *http.Request) net.IP {
+	ip := parseHostAddress(r.RemoteAddr)
+	if ip == nil || !c.isTrusted(ip) {
+		return ip
+	}
+	hops := forwardedFor(r, c.header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHostAddress(hops[i])
+		if hop == nil {
+			// Garbage or obfuscated ('unknown', '_hidden'): the last
+			// trusted proxy is all we know.
+			return ip
+		}
+		ip = hop
+		if !c.isTrusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// Client address as string for logging; "-" if unknown.
+func (c *ClientIPResolver) ClientAddress(r *http.Request) string {
+	if ip := c.ClientIP(r); ip != nil {
+		return ip.String()
+	}
+	return "-"
+}
+
+// Whether the client used HTTPS. Behind a proxy that terminates TLS we
+// only know from its X-Forwarded-Proto header, or the proto in Forwarded;
+// as with the address, only if the request comes from a trusted proxy.
+// What the nearest proxy added, the last entry, is what counts.
+func (c *ClientIPResolver) IsHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if ip := parseHostAddress(r.RemoteAddr); ip == nil || !c.isTrusted(ip) {
+		return false
+	}
+	proto := ""
+	if c.header == kForwarded {
+		elements := strings.Split(strings.Join(r.Header["Forwarded"], ","), ",")
+		for _, pair := range strings.Split(elements[len(elements)-1], ";") {
+			pair = strings.TrimSpace(pair)
+			if eq := strings.Index(pair, "="); eq > 0 &&
+				strings.EqualFold(pair[:eq], "proto") {
+				proto = strings.Trim(pair[eq+1:], `"`)
+			}
+		}
+	} else {
+		protos := strings.Split(strings.Join(r.Header["X-Forwarded-Proto"], ","), ",")
+		proto = strings.TrimSpace(protos[len(protos)-1])
+	}
+	return strings.EqualFold(proto, "https")
+}
+
+// The chain of forwarded addresses in the given header, client first.
+// Multiple header lines are one list.
+func forwardedFor(r *http.Request, header string) []string {
+	var result []string
+	if header == kForwarded {
+		for _, element := range strings.Split(strings.Join(r.Header["Forwarded"], ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if eq := strings.Index(pair, "="); eq > 0 &&
+					strings.EqualFold(pair[:eq], "for") {
+					result = append(result, strings.Trim(pair[eq+1:], `"`))
+				}
+			}
+		}
+		return result
+	}
+	for _, hop := range strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			result = append(result, hop)
+		}
+	}
+	return result
+}
+
+// Parse an address as found in RemoteAddr or forwarding headers:
+// "192.0.2.1", "192.0.2.1:1234", "2001:db8::1", "[2001:db8::1]:1234",
+// possibly with IPv6 zone. Returns nil if not an IP address.
+func parseHostAddress(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if strings.HasPrefix(addr, "[") {
+		end := strings.Index(addr, "]")
+		if end < 0 {
+			return nil
+		}
+		addr = addr[1:end]
+	} else if strings.Count(addr, ":") == 1 {
+		addr = addr[:strings.Index(addr, ":")] // IPv4 with port.
+	}
+	if zone := strings.Index(addr, "%"); zone >= 0 {
+		addr = addr[:zone]
+	}
+	return net.ParseIP(addr)
+}
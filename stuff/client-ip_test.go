@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseHostAddress(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"192.0.2.1":             "192.0.2.1",
+		"192.0.2.1:1234":        "192.0.2.1",
+		" 192.0.2.1 ":           "192.0.2.1",
+		"2001:db8::1":           "2001:db8::1",
+		"[2001:db8::1]:1234":    "2001:db8::1",
+		"[2001:db8::1]":         "2001:db8::1",
+		"[fe80::1%eth0]:1234":   "fe80::1",
+		"::ffff:192.0.2.1":      "192.0.2.1",
+		"unknown":               "<nil>",
+		"_hidden":               "<nil>",
+		"[2001:db8::1":          "<nil>",
+		"":                      "<nil>",
+		"example.com:80":        "<nil>",
+		"192.0.2.1:1234:5678:9": "<nil>",
+	} {
+		expectEqual(t, parseHostAddress(addr).String(), expected)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies := parseCIDRList("trusted-proxies", "10.0.0.0/8, 127.0.0.1,::1")
+	resolver := NewClientIPResolver(proxies, kForwardedFor)
+	forwarded_resolver := NewClientIPResolver(proxies, kForwarded)
+
+	type testCase struct {
+		remote    string
+		xff       []string
+		forwarded []string
+		expected  string
+	}
+	check := func(resolver *ClientIPResolver, c testCase) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		r.Header["X-Forwarded-For"] = c.xff
+		if c.forwarded != nil {
+			r.Header["Forwarded"] = c.forwarded
+		}
+		expectEqual(t, resolver.ClientIP(r).String(), c.expected)
+	}
+	for _, c := range []testCase{
+		// Not from a proxy: headers are ignored.
+		{"192.0.2.1:1234", []string{"10.1.1.1"}, nil, "192.0.2.1"},
+		{"[2001:db8::1]:1234", nil, []string{"for=10.1.1.1"}, "2001:db8::1"},
+		// From a proxy, without headers.
+		{"127.0.0.1:1234", nil, nil, "127.0.0.1"},
+		// Rightmost untrusted entry is the client; whatever the
+		// client sent itself further left is ignored.
+		{"127.0.0.1:1234", []string{"10.1.1.1, 198.51.100.7"}, nil, "198.51.100.7"},
+		{"127.0.0.1:1234", []string{"10.1.1.1", "198.51.100.7, 10.2.2.2"}, nil, "198.51.100.7"},
+		{"[::1]:1234", []string{"2001:db8::7"}, nil, "2001:db8::7"},
+		// All trusted: leftmost.
+		{"127.0.0.1:1234", []string{"10.1.1.1, 10.2.2.2"}, nil, "10.1.1.1"},
+		// Garbage from a trusted proxy: stop at the proxy.
+		{"127.0.0.1:1234", []string{"10.1.1.1, bogus"}, nil, "127.0.0.1"},
+		// A Forwarded header the client sent is passed through by a
+		// proxy that only appends to X-Forwarded-For: ignored.
+		{"127.0.0.1:1234", []string{"198.51.100.1"}, []string{`for=10.1.1.1`}, "198.51.100.1"},
+		{"127.0.0.1:1234", nil, []string{`for=10.1.1.1`}, "127.0.0.1"},
+		// Nothing useful at all.
+		{"@", nil, nil, "<nil>"},
+	} {
+		check(resolver, c)
+	}
+
+	// Proxies that set the Forwarded header; now X-Forwarded-For is what
+	// the client might have made up.
+	for _, c := range []testCase{
+		{"127.0.0.1:1234", []string{"10.1.1.1"},
+			[]string{`for=198.51.100.7;proto=https, For="[2001:db8::7]:4711"`}, "2001:db8::7"},
+		{"127.0.0.1:1234", nil, []string{`for=198.51.100.7:4711;by=10.0.0.1`}, "198.51.100.7"},
+		{"127.0.0.1:1234", nil, []string{`for=unknown`}, "127.0.0.1"},
+		{"127.0.0.1:1234", []string{"10.1.1.1"}, nil, "127.0.0.1"},
+	} {
+		check(forwarded_resolver, c)
+	}
+
+	// Without trusted proxies, no headers are believed.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "10.1.1.1")
+	expectEqual(t, NewClientIPResolver(nil, kForwardedFor).ClientIP(r).String(), "127.0.0.1")
+	var no_resolver *ClientIPResolver
+	expectEqual(t, no_resolver.ClientAddress(r), "127.0.0.1")
+}
+
+func TestIsHTTPS(t *testing.T) {
+	proxies := parseCIDRList("trusted-proxies", "127.0.0.1")
+	request := func(remote, header, value string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		return r
+	}
+	resolver := NewClientIPResolver(proxies, kForwardedFor)
+	ExpectTrue(t, resolver.IsHTTPS(request("127.0.0.1:1234", "X-Forwarded-Proto", "https")), "proxy https")
+	ExpectTrue(t, !resolver.IsHTTPS(request("127.0.0.1:1234", "X-Forwarded-Proto", "http")), "proxy http")
+	ExpectTrue(t, !resolver.IsHTTPS(request("127.0.0.1:1234", "X-Forwarded-Proto", "https, http")), "nearest counts")
+	ExpectTrue(t, !resolver.IsHTTPS(request("127.0.0.1:1234", "", "")), "no header")
+	ExpectTrue(t, !resolver.IsHTTPS(request("192.0.2.1:1234", "X-Forwarded-Proto", "https")), "untrusted")
+
+	forwarded_resolver := NewClientIPResolver(proxies, kForwarded)
+	ExpectTrue(t, forwarded_resolver.IsHTTPS(request("127.0.0.1:1234", "Forwarded",
+		`for=198.51.100.7;proto=https`)), "Forwarded https")
+	ExpectTrue(t, !forwarded_resolver.IsHTTPS(request("127.0.0.1:1234", "X-Forwarded-Proto", "https")), "other header")
+
+	r := request("192.0.2.1:1234", "", "")
+	r.TLS = &tls.ConnectionState{}
+	var no_resolver *ClientIPResolver
+	ExpectTrue(t, no_resolver.IsHTTPS(r), "direct TLS")
+}
+
+func TestEditAllowedBehindProxy(t *testing.T) {
+	_, hackerspace, _ := net.ParseCIDR("10.0.0.0/8")
+	_, proxy, _ := net.ParseCIDR("127.0.0.1/32")
+	auth := NewAuth(nil, []*net.IPNet{hackerspace}, RoleEditor,
+		NewClientIPResolver([]*net.IPNet{proxy}, kForwardedFor))
+
+	request := func(remote string, xff string) bool {
+		r := httptest.NewRequest("GET", "/form", nil)
+		r.RemoteAddr = remote
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		return auth.CanEdit(r)
+	}
+	spoofed_forwarded := httptest.NewRequest("GET", "/form", nil)
+	spoofed_forwarded.RemoteAddr = "127.0.0.1:1234"
+	spoofed_forwarded.Header.Set("Forwarded", "for=10.1.1.1")
+	spoofed_forwarded.Header.Set("X-Forwarded-For", "192.0.2.1")
+	ExpectTrue(t, !auth.CanEdit(spoofed_forwarded), "spoofed Forwarded next to proxy's X-Forwarded-For")
+	ExpectTrue(t, request("10.1.1.1:1234", ""), "direct from hackerspace")
+	ExpectTrue(t, !request("192.0.2.1:1234", "10.1.1.1"), "spoofed header")
+	ExpectTrue(t, request("127.0.0.1:1234", "10.1.1.1"), "via proxy")
+	ExpectTrue(t, !request("127.0.0.1:1234", "10.1.1.1, 192.0.2.1"), "spoofed via proxy")
+	ExpectTrue(t, !request("127.0.0.1:1234", ""), "proxy itself")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Compress responses with brotli or gzip, whatever the client prefers.
+//
+// Whether to compress is decided when the response starts, as only then
+// the handler has set status and Content-Type: images like JPEG or PNG are
+// already compressed, so only textual content is. Responses that could be
+// compressed have a 'Vary: Accept-Encoding' header, also if this client
+// did not want it, so that caches don't hand it to the wrong client. A 304
+// Not Modified has no content type to go by, so it always has it.
+
+const (
+	kEncodingBrotli = "br"
+	kEncodingGzip   = "gzip"
+)
+
+// Content types worth compressing.
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/manifest+json",
+	"image/svg+xml",
+}
+
+func isCompressible(content_type string) bool {
+	content_type = strings.ToLower(content_type)
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(content_type, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Choose encoding from the Accept-Encoding header: the one with the highest
+// quality value; brotli if equal. Empty string if neither is acceptable.
+func negotiateEncoding(accept_encoding string) string {
+	quality := map[string]float64{}
+	wildcard := -1.0
+	for _, element := range strings.Split(accept_encoding, ",") {
+		parts := strings.Split(element, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		if coding == "*" {
+			wildcard = q
+		} else {
+			quality[coding] = q
+		}
+	}
+	best, best_q := "", 0.0
+	for _, coding := range []string{kEncodingBrotli, kEncodingGzip} {
+		q, found := quality[coding]
+		if !found {
+			q = wildcard
+		}
+		if q > best_q {
+			best, best_q = coding, q
+		}
+	}
+	return best
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+var brotliWriters = sync.Pool{New: func() interface{} {
+	return brotli.NewWriterLevel(nil, 5) // Good ratio, still fast.
+}}
+
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		w := &compressWriter{
+			ResponseWriter: out,
+			encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding")),
+		}
+		next.ServeHTTP(w, r)
+		// Not deferred: after a panic, the header is not sent yet, so
+		// that RecoverPanics can still respond with an error.
+		w.Close()
+	})
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string // Acceptable to the client; "" for none.
+
+	status  int            // Set by WriteHeader(), not sent yet.
+	started bool           // Status and header sent.
+	zipped  io.WriteCloser // If we compress.
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.started || w.status != 0 {
+		return
+	}
+	if code >= 100 && code < 200 {
+		w.ResponseWriter.WriteHeader(code) // Informational; more to come.
+		return
+	}
+	w.status = code
+	// If we know the content type already, no need to wait for content.
+	if w.Header().Get("Content-Type") != "" || !bodyAllowed(code) {
+		w.start(nil)
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.started {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.start(data)
+	}
+	if w.zipped != nil {
+		return w.zipped.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func bodyAllowed(code int) bool {
+	return code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// Decide on compression and send the header. The first data written is
+// used to determine the content type if the handler didn't set it.
+func (w *compressWriter) start(first_data []byte) {
+	w.started = true
+	header := w.Header()
+	if w.status == http.StatusNotModified {
+		// Stands in for the full response, which might be compressed.
+		addVary(header, "Accept-Encoding")
+	}
+	content_type := header.Get("Content-Type")
+	if content_type == "" && first_data != nil {
+		content_type = http.DetectContentType(first_data)
+		header.Set("Content-Type", content_type)
+	}
+	// Ranges are of the uncompressed content, so partial content stays as is.
+	if header.Get("Content-Encoding") == "" && bodyAllowed(w.status) &&
+		w.status != http.StatusPartialContent && isCompressible(content_type) {
+		addVary(header, "Accept-Encoding")
+		if w.encoding != "" {
+			header.Set("Content-Encoding", w.encoding)
+			header.Del("Content-Length") // Of the uncompressed content.
+			// Not the same bytes anymore, but semantically the same.
+			if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+				header.Set("ETag", "W/"+etag)
+			}
+			w.zipped = newCompressor(w.encoding, w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func addVary(header http.Header, field string) {
+	for _, vary := range header["Vary"] {
+		for _, existing := range strings.Split(vary, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), field) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", field)
+}
+
+func newCompressor(encoding string, out io.Writer) io.WriteCloser {
+	if encoding == kEncodingBrotli {
+		writer := brotliWriters.Get().(*brotli.Writer)
+		writer.Reset(out)
+		return &pooledWriter{writer, func() { brotliWriters.Put(writer) }}
+	}
+	writer := gzipWriters.Get().(*gzip.Writer)
+	writer.Reset(out)
+	return &pooledWriter{writer, func() { gzipWriters.Put(writer) }}
+}
+
+// Returns compressor to its pool when closed.
+type pooledWriter struct {
+	io.WriteCloser
+	release func()
+}
+
+func (p *pooledWriter) Flush() error {
+	if flusher, ok := p.WriteCloser.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (p *pooledWriter) Close() error {
+	err := p.WriteCloser.Close()
+	p.release()
+	return err
+}
+
+// Finish the response: send header if the handler didn't write anything
+// and finish compressed stream.
+func (w *compressWriter) Close() error {
+	if !w.started {
+		if w.status == 0 {
+			return nil // Handler did not respond at all; net/http sends 200.
+		}
+		w.start(nil)
+	}
+	if w.zipped != nil {
+		err := w.zipped.Close()
+		w.zipped = nil
+		return err
+	}
+	return nil
+}
+
+// Send what we have so far, e.g. for long running responses.
+func (w *compressWriter) Flush() {
+	if !w.started {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.start(nil)
+	}
+	if w.zipped != nil {
+		w.zipped.(*pooledWriter).Flush()
+	}
+	flushResponse(w.ResponseWriter)
+}
+
+func (w *compressWriter) Push(target string, opts *http.PushOptions) error {
+	return pushResource(w.ResponseWriter, target, opts)
+}
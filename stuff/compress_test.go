@@ -0,0 +1,172 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, test := range []struct{ accept, expected string }{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"GZIP;q=0.8", "gzip"},
+		{"*", "br"},
+		{"br;q=0, *", "gzip"},
+		{"gzip;q=0", ""},
+		{"*;q=0", ""},
+	} {
+		expectEqual(t, negotiateEncoding(test.accept), test.expected)
+	}
+}
+
+// Decompress body according to Content-Encoding.
+func responseBody(t *testing.T, out *httptest.ResponseRecorder) string {
+	var reader io.Reader = out.Body
+	switch out.Header().Get("Content-Encoding") {
+	case "gzip":
+		unzipped, err := gzip.NewReader(out.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = unzipped
+	case "br":
+		reader = brotli.NewReader(out.Body)
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func compressedRequest(handler http.Handler, method string, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/", nil)
+	if accept != "" {
+		r.Header.Set("Accept-Encoding", accept)
+	}
+	out := httptest.NewRecorder()
+	Compress(handler).ServeHTTP(out, r)
+	return out
+}
+
+func TestCompressText(t *testing.T) {
+	content := strings.Repeat(`{"value":"10k","category":"Resistor"},`, 100)
+	handler := http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		out.Header().Set("Content-Type", "application/json")
+		out.Header().Set("Content-Length", "3800")
+		out.Write([]byte(content))
+	})
+	for _, encoding := range []string{"br", "gzip", ""} {
+		out := compressedRequest(handler, "GET", encoding)
+		expectEqual(t, out.Header().Get("Content-Encoding"), encoding)
+		expectEqual(t, out.Header().Get("Vary"), "Accept-Encoding")
+		expectEqual(t, responseBody(t, out), content)
+		if encoding != "" {
+			expectEqual(t, out.Header().Get("Content-Length"), "")
+			ExpectTrue(t, out.Body.Len() < len(content)/10, "compressed "+encoding)
+		}
+	}
+
+	// HEAD: same header as GET.
+	out := compressedRequest(handler, "HEAD", "gzip")
+	expectEqual(t, out.Header().Get("Content-Encoding"), "gzip")
+}
+
+func TestCompressSkipsImages(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 100))
+	for _, content_type := range []string{"image/png", "image/jpg", ""} {
+		out := compressedRequest(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+			if content_type != "" {
+				out.Header().Set("Content-Type", content_type)
+			}
+			out.Write(png)
+		}), "GET", "gzip, br")
+		expectEqual(t, out.Header().Get("Content-Encoding"), "")
+		expectEqual(t, out.Header().Get("Vary"), "")
+		expectEqualInt(t, out.Body.Len(), len(png))
+	}
+}
+
+func TestCompressSniffsContentType(t *testing.T) {
+	out := compressedRequest(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		out.WriteHeader(http.StatusAccepted) // Type not known yet.
+		out.Write([]byte("<!DOCTYPE html><body>Hello</body>"))
+	}), "GET", "gzip")
+	expectEqualInt(t, out.Code, http.StatusAccepted)
+	expectEqual(t, out.Header().Get("Content-Encoding"), "gzip")
+	ExpectTrue(t, strings.HasPrefix(out.Header().Get("Content-Type"), "text/html"), "sniffed")
+	expectEqual(t, responseBody(t, out), "<!DOCTYPE html><body>Hello</body>")
+}
+
+func TestCompressLeavesSpecialResponsesAlone(t *testing.T) {
+	out := compressedRequest(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		out.Header().Set("Content-Type", "text/html")
+		out.WriteHeader(http.StatusNotModified)
+	}), "GET", "gzip")
+	expectEqualInt(t, out.Code, http.StatusNotModified)
+	expectEqual(t, out.Header().Get("Content-Encoding"), "")
+	expectEqual(t, out.Header().Get("Vary"), "Accept-Encoding")
+	expectEqualInt(t, out.Body.Len(), 0)
+
+	// Not modified by ETag: no content type left, but still varies.
+	etag := contentETag("page")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "br")
+	r.Header.Set("If-None-Match", etag)
+	out = httptest.NewRecorder()
+	Compress(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		out.Header().Set("Content-Type", "text/html")
+		sendWithETag(out, r, []byte("page"))
+	})).ServeHTTP(out, r)
+	expectEqualInt(t, out.Code, http.StatusNotModified)
+	expectEqual(t, out.Header().Get("Vary"), "Accept-Encoding")
+
+	// Already encoded by the handler.
+	out = compressedRequest(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		out.Header().Set("Content-Type", "text/plain")
+		out.Header().Set("Content-Encoding", "deflate")
+		out.Write([]byte("opaque"))
+	}), "GET", "gzip")
+	expectEqual(t, out.Header().Get("Content-Encoding"), "deflate")
+	expectEqual(t, out.Body.String(), "opaque")
+
+	// Only a status.
+	out = compressedRequest(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		out.WriteHeader(http.StatusGone)
+	}), "GET", "gzip")
+	expectEqualInt(t, out.Code, http.StatusGone)
+	expectEqualInt(t, out.Body.Len(), 0)
+}
+
+func TestCompressRenderedTemplate(t *testing.T) {
+	templates := NewTemplateRenderer("template", true)
+	out := compressedRequest(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		templates.RenderWithHttpCode(out, nil, http.StatusNotFound, "login.html", &LoginPage{})
+	}), "GET", "br")
+	expectEqualInt(t, out.Code, http.StatusNotFound)
+	expectEqual(t, out.Header().Get("Content-Encoding"), "br")
+	ExpectTrue(t, strings.Contains(responseBody(t, out), "</form>"), "rendered page")
+}
+
+func TestCompressPanicStillReported(t *testing.T) {
+	handler := RecoverPanics(Compress(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		out.WriteHeader(http.StatusOK) // Not sent yet: no content type.
+		panic("oops")
+	})))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, r)
+	expectEqualInt(t, out.Code, http.StatusInternalServerError)
+	expectEqual(t, out.Header().Get("Content-Encoding"), "")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Settings can be given in a JSON config file instead of on the command
+// line. The file has sections, each with some of the flags as keys:
+//
+//	{
+//	  "server":      { "bind-address": ":2000", "site-name": "stuff.example.org" },
+//	  "database":    { "dbfile": "/var/lib/stuff/stuff.db" },
+//	  "permissions": { "edit-permission-nets": ["10.0.0.0/8"], "anonymous-role": "viewer" },
+//	  "ui":          { "imagedir": "/var/lib/stuff/img" }
+//	}
+//
+// Flags given on the command line take precedence over the config file.
+var configSections = map[string][]string{
+	"server": {"bind-address", "site-name", "ssl-key", "ssl-cert",
+		"logfile", "log-requests", "want-timings", "read-timeout",
+		"write-timeout", "idle-timeout", "shutdown-timeout"},
+	"database": {"dbfile", "search-engine", "search-snapshot"},
+	"permissions": {"edit-permission-nets", "trusted-proxies",
+		"forwarded-header", "anonymous-role", "accept-proposals"},
+	"ui": {"imagedir", "templatedir", "staticdir", "cache-templates"},
+}
+
+// Read the config file and set the flags in it that were not given on the
+// command line, so needs to be called after flags.Parse().
+func applyConfigFile(flags *flag.FlagSet, filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var config map[string]map[string]interface{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	on_commandline := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { on_commandline[f.Name] = true })
+
+	for _, section := range sortedKeys(config) {
+		known, found := configSections[section]
+		if !found {
+			return fmt.Errorf("%s: unknown section '%s'", filename, section)
+		}
+		for _, key := range sortedKeys(config[section]) {
+			value := config[section][key]
+			if !containsString(known, key) {
+				return fmt.Errorf("%s: unknown setting '%s' in section '%s'", filename, key, section)
+			}
+			if on_commandline[key] {
+				continue
+			}
+			str, err := configValueString(value)
+			if err == nil {
+				err = flags.Set(key, str)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s.%s: %s", filename, section, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Sorted, so that errors are reported in a predictable order.
+func sortedKeys(m interface{}) []string {
+	var result []string
+	switch m := m.(type) {
+	case map[string]map[string]interface{}:
+		for key := range m {
+			result = append(result, key)
+		}
+	case map[string]interface{}:
+		for key := range m {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func containsString(list []string, s string) bool {
+	for _, element := range list {
+		if element == s {
+			return true
+		}
+	}
+	return false
+}
+
+// The value as it would be given on the command line; lists are comma
+// separated.
+func configValueString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		elements := make([]string, len(v))
+		for i, element := range v {
+			str, ok := element.(string)
+			if !ok {
+				return "", fmt.Errorf("list elements need to be strings")
+			}
+			elements[i] = str
+		}
+		return strings.Join(elements, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"syscall"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestConfigFile(t *testing.T) {
+	filename := writeTestConfig(t, `{
+  "server": { "bind-address": ":8080", "site-name": "stuff.example.org" },
+  "database": { "search-snapshot": false },
+  "permissions": { "edit-permission-nets": ["10.0.0.0/8", "192.0.2.1"] }
+}`)
+	defer syscall.Unlink(filename)
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	bind := flags.String("bind-address", ":2000", "")
+	site := flags.String("site-name", "", "")
+	snapshot := flags.Bool("search-snapshot", true, "")
+	nets := flags.String("edit-permission-nets", "", "")
+	logfile := flags.String("logfile", "default.log", "")
+	flags.Parse([]string{"-site-name", "commandline.example.org"})
+
+	ExpectTrue(t, applyConfigFile(flags, filename) == nil, "Valid config")
+	expectEqual(t, *bind, ":8080")
+	expectEqual(t, *site, "commandline.example.org") // Flag wins.
+	ExpectTrue(t, !*snapshot, "Bool from config")
+	expectEqual(t, *nets, "10.0.0.0/8,192.0.2.1")
+	expectEqual(t, *logfile, "default.log") // Not in config.
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for _, content := range []string{
+		`{ "server": { "bind-adress": ":8080" } }`, // Typo.
+		`{ "servers": { "bind-address": ":8080" } }`,
+		`{ "database": { "dbfile": "foo.db" } }`, // Not in section ...
+		`{ "server": { "want-timings": "maybe" } }`,
+		`{ "server": `,
+	} {
+		filename := writeTestConfig(t, content)
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.String("bind-address", ":2000", "")
+		flags.Bool("want-timings", false, "")
+		// ... but also needs to exist as flag.
+		ExpectTrue(t, applyConfigFile(flags, filename) != nil, content)
+		syscall.Unlink(filename)
+	}
+	ExpectTrue(t, applyConfigFile(flag.NewFlagSet("test", flag.ContinueOnError), "/nonexistent.json") != nil, "Missing file")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+)
+
+// Protection against cross site request forgery: a page on some other site
+// visited by someone who is allowed to edit must not be able to make their
+// browser change things here.
+//
+// Forms and scripts modifying data send a token that is only known to our
+// own pages: it is also stored in a cookie, and other sites can neither read
+// that cookie nor our pages (double submit). In addition, requests coming
+// from a browser must have our own origin.
+
+const (
+	kCsrfCookie = "stuff-csrf"
+	kCsrfField  = "csrf_token"   // Name of the form field ...
+	kCsrfHeader = "X-CSRF-Token" // ... or header for scripts.
+)
+
+// Returns the token to be put in forms, setting the cookie if needed, so
+// needs to be called before the response is written.
+func csrfToken(out http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(kCsrfCookie); err == nil && len(cookie.Value) == 64 {
+		return cookie.Value
+	}
+	token, err := randomToken()
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(out, &http.Cookie{
+		Name:     kCsrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// Also visible to the rest of this request; if the page is rendered
+	// on a POST, the next form needs to have the same token.
+	r.AddCookie(&http.Cookie{Name: kCsrfCookie, Value: token})
+	return token
+}
+
+// If the request has the token matching the cookie and comes from our
+// own origin.
+func csrfValid(r *http.Request) bool {
+	cookie, err := r.Cookie(kCsrfCookie)
+	if err != nil || len(cookie.Value) != 64 {
+		return false
+	}
+	token := r.Header.Get(kCsrfHeader)
+	if token == "" {
+		token = r.PostFormValue(kCsrfField)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+		return false
+	}
+	return sameOrigin(r)
+}
+
+// Browsers tell where a request comes from in the Origin or at least the
+// Referer header; it needs to be us. Requests with neither don't come from
+// a browser form or script (e.g. curl), so there is no browser to abuse.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "null" {
+		return false // Sandboxed or privacy-sensitive context.
+	}
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+	parsed, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	return parsed.Host == r.Host
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Make request look like it comes from one of our own pages.
+func addCsrfToken(r *http.Request) {
+	token := strings.Repeat("c0", 32)
+	r.AddCookie(&http.Cookie{Name: kCsrfCookie, Value: token})
+	r.Header.Set(kCsrfHeader, token)
+}
+
+func TestCsrfToken(t *testing.T) {
+	out := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/form", nil)
+	token := csrfToken(out, r)
+	expectEqualInt(t, len(token), 64)
+	cookies := out.Result().Cookies()
+	ExpectTrue(t, len(cookies) == 1 && cookies[0].Value == token, "cookie set")
+	ExpectTrue(t, cookies[0].HttpOnly, "HttpOnly")
+	expectEqual(t, csrfToken(httptest.NewRecorder(), r), token) // Same request.
+
+	// Existing cookie is reused.
+	r = httptest.NewRequest("GET", "/form", nil)
+	r.AddCookie(cookies[0])
+	out = httptest.NewRecorder()
+	expectEqual(t, csrfToken(out, r), token)
+	expectEqualInt(t, len(out.Result().Cookies()), 0)
+}
+
+func TestCsrfValid(t *testing.T) {
+	token := strings.Repeat("c0", 32)
+	post := func(field string, header map[string]string) bool {
+		form := url.Values{kCsrfField: {field}}
+		r := httptest.NewRequest("POST", "http://stuff.example.com/form",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: kCsrfCookie, Value: token})
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		return csrfValid(r)
+	}
+	ExpectTrue(t, post(token, nil), "form field")
+	ExpectTrue(t, post("", map[string]string{kCsrfHeader: token}), "header")
+	ExpectTrue(t, !post("", nil), "no token")
+	ExpectTrue(t, !post(strings.Repeat("00", 32), nil), "wrong token")
+	ExpectTrue(t, post(token, map[string]string{"Origin": "http://stuff.example.com"}), "same origin")
+	ExpectTrue(t, !post(token, map[string]string{"Origin": "http://evil.example.com"}), "other origin")
+	ExpectTrue(t, !post(token, map[string]string{"Origin": "null"}), "null origin")
+	ExpectTrue(t, post(token, map[string]string{"Referer": "http://stuff.example.com/form?id=3"}), "same referer")
+	ExpectTrue(t, !post(token, map[string]string{"Referer": "http://evil.example.com/"}), "other referer")
+
+	// Without cookie, a token is useless.
+	r := httptest.NewRequest("POST", "/form", nil)
+	r.Header.Set(kCsrfHeader, token)
+	ExpectTrue(t, !csrfValid(r), "no cookie")
+}
+
+func TestFormHandlerRequiresPostWithCsrf(t *testing.T) {
+	api, cleanup := newApiV1TestHandler(t, nil)
+	defer cleanup()
+	handler := &FormHandler{
+		store:    api.store,
+		template: NewTemplateRenderer("template", false),
+		auth:     api.auth,
+	}
+	edit := func(method string, with_token bool, value string) *httptest.ResponseRecorder {
+		form := url.Values{"edit_id": {"1"}, "id": {"1"}, "value": {value}}
+		var r *http.Request
+		if method == "GET" {
+			r = httptest.NewRequest("GET", "/form?"+form.Encode(), nil)
+		} else {
+			r = httptest.NewRequest("POST", "/form", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if with_token {
+			addCsrfToken(r)
+		}
+		out := httptest.NewRecorder()
+		handler.ServeHTTP(out, r)
+		return out
+	}
+	edit("GET", true, "via get")
+	ExpectTrue(t, handler.store.FindById(1) == nil, "GET does not store")
+	out := edit("POST", false, "no token")
+	ExpectTrue(t, handler.store.FindById(1) == nil, "POST without token does not store")
+	ExpectTrue(t, strings.Contains(out.Body.String(), "no token"), "keeps entered value")
+	edit("POST", true, "stored")
+	ExpectTrue(t, handler.store.FindById(1) != nil, "stored")
+	expectEqual(t, handler.store.FindById(1).Value, "stored")
+
+	api.store.EditRecord(Editor{}, 2, func(c *Component) bool { c.Value = "x"; return true })
+	set := func(method string, with_token bool) int {
+		r := httptest.NewRequest(method, "/api/related-set?op=join&id=1&comp=1&set=2", nil)
+		if with_token {
+			addCsrfToken(r)
+		}
+		out := httptest.NewRecorder()
+		handler.ServeHTTP(out, r)
+		return out.Code
+	}
+	expectEqualInt(t, set("GET", true), http.StatusMethodNotAllowed)
+	expectEqualInt(t, set("POST", false), http.StatusForbidden)
+	expectEqualInt(t, handler.store.FindById(2).Equiv_set, 2)
+	expectEqualInt(t, set("POST", true), http.StatusOK)
+	expectEqualInt(t, handler.store.FindById(2).Equiv_set, 1) // Joined.
+}
+
+func TestApiV1RejectsCrossOrigin(t *testing.T) {
+	h, cleanup := newApiV1TestHandler(t, nil)
+	defer cleanup()
+	r := httptest.NewRequest("POST", "http://stuff.example.com/api/v1/components",
+		strings.NewReader(`{"value":"foo"}`))
+	r.Header.Set("Origin", "http://evil.example.com")
+	out := httptest.NewRecorder()
+	h.ServeHTTP(out, r)
+	expectEqualInt(t, out.Code, http.StatusForbidden)
+
+	r = httptest.NewRequest("POST", "http://stuff.example.com/api/v1/components",
+		strings.NewReader(`{"value":"foo"}`))
+	r.Header.Set("Origin", "http://stuff.example.com")
+	out = httptest.NewRecorder()
+	h.ServeHTTP(out, r)
+	expectEqualInt(t, out.Code, http.StatusCreated)
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"time"
 )
@@ -35,6 +37,44 @@ create table component (
 );
 `
 
+// Keeps track of changes in the component table, so that we know if a
+// persisted search index is still current. Triggers make sure we also see
+// changes that did not go through this backend. Applied to existing
+// databases as well.
+var search_generation_schema string = `
+create table if not exists search_generation (
+       database_id   text not null, -- random, identifies this database
+       generation    int not null   -- incremented on each change
+);
+insert into search_generation (database_id, generation)
+       select lower(hex(randomblob(8))), 0
+       where not exists (select 1 from search_generation);
+
+create trigger if not exists component_insert_generation
+       after insert on component
+begin
+       update search_generation set generation = generation + 1;
+end;
+create trigger if not exists component_update_generation
+       after update on component
+begin
+       update search_generation set generation = generation + 1;
+end;
+create trigger if not exists component_delete_generation
+       after delete on component
+begin
+       update search_generation set generation = generation + 1;
+end;
+`
+
+// Sets are looked up by their ID. Applied to existing databases as well.
+var equiv_set_index_schema string = `
+create index if not exists component_equiv_set on component(equiv_set);
+`
+
+// All the fields in a component, in the sequence row2Component() expects.
+const component_fields = "category, value, description, notes, quantity, datasheet_url,drawersize,footprint,equiv_set"
+
 func nullIfEmpty(s string) *string {
 	if s == "" {
 		return nil
@@ -95,26 +135,49 @@ func row2Component(row *sql.Rows) (*Component, error) {
 }
 
 type DBBackend struct {
-	db            *sql.DB
-	findById      *sql.Stmt
-	insertRecord  *sql.Stmt
-	updateRecord  *sql.Stmt
-	joinSet       *sql.Stmt
-	leaveSet      *sql.Stmt
-	findEquivById *sql.Stmt
-	selectAll     *sql.Stmt
-	fts           *FulltextSearch
+	db             *sql.DB
+	findById       *sql.Stmt
+	insertRecord   *sql.Stmt
+	updateRecord   *sql.Stmt
+	joinSet        *sql.Stmt
+	leaveSet       *sql.Stmt
+	findSetMembers *sql.Stmt
+	findEquivById  *sql.Stmt
+	selectAll      *sql.Stmt
+	searcher       Searcher
 }
 
-func NewDBBackend(db *sql.DB, create_tables bool) (*DBBackend, error) {
+// Available search engines.
+const (
+	kSearchEngineMemory = "memory" // In-memory FulltextSearch
+	kSearchEngineFTS5   = "fts5"   // SQLite FTS5 virtual table
+)
+
+// Create a new backend using the given search engine. For the in-memory
+// search, searchSnapshot is the file the search index is persisted in
+// ("" for none).
+func NewDBBackend(db *sql.DB, create_tables bool, searchEngine string, searchSnapshot string) (*DBBackend, error) {
 	if create_tables {
 		_, err := db.Exec(create_schema)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
-	// All the fields in a component.
-	all_fields := "category, value, description, notes, quantity, datasheet_url,drawersize,footprint,equiv_set"
+	// Before anything looks at the component table, which compiles
+	// its triggers.
+	if _, err := db.Exec(fts5_drop_triggers); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(search_generation_schema); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(history_schema); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(equiv_set_index_schema); err != nil {
+		return nil, err
+	}
+	all_fields := component_fields
 	findById, err := db.Prepare("SELECT id, " + all_fields + " FROM component where id=$1")
 	if err != nil {
 		return nil, err
@@ -145,6 +208,11 @@ func NewDBBackend(db *sql.DB, create_tables bool) (*DBBackend, error) {
 		return nil, err
 	}
 
+	findSetMembers, err := db.Prepare("SELECT id, " + all_fields + " FROM component WHERE equiv_set = ?1 ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
 	// We want all articles that match the same (category, name), but also
 	// all that are in the sets that are covered in any set the matching
 	// components are in.
@@ -160,28 +228,47 @@ func NewDBBackend(db *sql.DB, create_tables bool) (*DBBackend, error) {
 	}
 
 	selectAll, err := db.Prepare("SELECT id, " + all_fields + " FROM component ORDER BY id")
-	// Populate fts with existing components.
-	fts := NewFulltextSearch()
-	rows, _ := selectAll.Query()
-	count := 0
-	for rows != nil && rows.Next() {
-		c, _ := row2Component(rows)
-		fts.Update(c)
-		count++
+	if err != nil {
+		return nil, err
 	}
-	rows.Close()
 
-	log.Printf("Prepopulated full text search with %d items", count)
-	return &DBBackend{
-		db:            db,
-		findById:      findById,
-		insertRecord:  insertRecord,
-		updateRecord:  updateRecord,
-		joinSet:       joinSet,
-		leaveSet:      leaveSet,
-		findEquivById: findEquivById,
-		selectAll:     selectAll,
-		fts:           fts}, nil
+	result := &DBBackend{
+		db:             db,
+		findById:       findById,
+		insertRecord:   insertRecord,
+		updateRecord:   updateRecord,
+		joinSet:        joinSet,
+		leaveSet:       leaveSet,
+		findSetMembers: findSetMembers,
+		findEquivById:  findEquivById,
+		selectAll:      selectAll,
+	}
+	switch searchEngine {
+	case kSearchEngineMemory:
+		result.searcher = NewMemorySearcher(db, result.IterateAll, searchSnapshot)
+	case kSearchEngineFTS5:
+		result.searcher, err = NewFTS5Searcher(db, result.FindById)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown search engine '%s'", searchEngine)
+	}
+	return result, nil
+}
+
+// Finish up: persist the search index and release the prepared
+// statements. The database itself is closed by the owner.
+func (d *DBBackend) Close() error {
+	var err error
+	if closer, ok := d.searcher.(io.Closer); ok {
+		err = closer.Close()
+	}
+	for _, stmt := range []*sql.Stmt{d.findById, d.insertRecord, d.updateRecord,
+		d.joinSet, d.leaveSet, d.findSetMembers, d.findEquivById, d.selectAll} {
+		stmt.Close()
+	}
+	return err
 }
 
 func (d *DBBackend) FindById(id int) *Component {
@@ -207,12 +294,12 @@ func (d *DBBackend) IterateAll(callback func(comp *Component) bool) {
 	rows.Close()
 }
 
-func (d *DBBackend) EditRecord(id int, update ModifyFun) (bool, string) {
+func (d *DBBackend) EditRecord(editor Editor, id int, update ModifyFun) (bool, string) {
 	needsInsert := false
 	rec := d.FindById(id)
 	if rec == nil {
 		needsInsert = true
-		rec = &Component{Id: id}
+		rec = &Component{Id: id, Equiv_set: id} // New ones are a set by themselves.
 	}
 	before := *rec
 	if update(rec) {
@@ -248,29 +335,77 @@ func (d *DBBackend) EditRecord(id int, update ModifyFun) (bool, string) {
 			log.Printf("Oops, expected 1 row to update but was %d", affected)
 			return false, "ERR: not updated"
 		}
-		d.fts.Update(rec)
+		d.searcher.Update(rec)
+
+		var previous *Component
+		if !needsInsert {
+			previous = &before
+		}
+		if err := recordHistory(d.db, editor, id, previous, rec); err != nil {
+			log.Printf("Can't record history: %s", err)
+		}
 
 		json, _ := json.Marshal(rec)
-		log.Printf("STORE %s", json)
+		log.Printf("STORE by %s %s", editor, json)
 
 		return true, ""
 	}
 	return false, ""
 }
 
-func (d *DBBackend) JoinSet(id int, set int) {
-	d.LeaveSet(id) // precondition.
+func (d *DBBackend) SetMembers(equiv_set int) []*Component {
+	result := make([]*Component, 0, 10)
+	rows, _ := d.findSetMembers.Query(equiv_set)
+	for rows != nil && rows.Next() {
+		c, _ := row2Component(rows)
+		result = append(result, c)
+	}
+	if rows != nil {
+		rows.Close()
+	}
+	return result
+}
+
+func (d *DBBackend) JoinSet(editor Editor, id int, set int) {
+	d.LeaveSet(editor, id) // precondition.
+	moved := d.SetMembers(set)
+	if c := d.FindById(id); c != nil {
+		moved = append(moved, c)
+	}
 	d.joinSet.Exec(id, set)
+	d.recordSetMoves(editor, moved)
+	log.Printf("JOIN-SET by %s %d -> %d", editor, id, set)
 }
 
-func (d *DBBackend) LeaveSet(id int) {
+func (d *DBBackend) LeaveSet(editor Editor, id int) {
 	// The limited way SQLite works, we have to find the equivalence
 	// set first before we can update. Not really efficient, and we
 	// would need a transaction here, but, yeah, good enough for a
 	// 0.001 qps service :)
 	c := d.FindById(id)
 	if c != nil {
+		moved := d.SetMembers(c.Equiv_set)
 		d.leaveSet.Exec(id, c.Equiv_set)
+		d.recordSetMoves(editor, moved)
+		if len(moved) > 1 {
+			log.Printf("LEAVE-SET by %s %d <- %d", editor, c.Equiv_set, id)
+		}
+	}
+}
+
+// Set operations can move several components to another set; each one
+// that moved gets a history entry, so that it can be rolled back. The
+// search index needs to know about the new sets as well.
+func (d *DBBackend) recordSetMoves(editor Editor, before []*Component) {
+	for _, b := range before {
+		after := d.FindById(b.Id)
+		if after == nil || after.Equiv_set == b.Equiv_set {
+			continue
+		}
+		d.searcher.Update(after)
+		if err := recordHistory(d.db, editor, b.Id, b, after); err != nil {
+			log.Printf("Can't record history: %s", err)
+		}
 	}
 }
 
@@ -285,6 +420,6 @@ func (d *DBBackend) MatchingEquivSetForComponent(id int) []*Component {
 	return result
 }
 
-func (d *DBBackend) Search(search_term string) *SearchResult {
-	return d.fts.Search(search_term)
+func (d *DBBackend) Search(search_term string, limit int) *SearchResult {
+	return d.searcher.Search(search_term, limit)
 }
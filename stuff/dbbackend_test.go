@@ -23,12 +23,12 @@ func TestBasicStore(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	store, _ := NewDBBackend(db, true)
+	store, _ := NewDBBackend(db, true, kSearchEngineMemory, "")
 
 	ExpectTrue(t, store.FindById(1) == nil, "Expected id:1 not to exist.")
 
 	// Create record 1, set description
-	store.EditRecord(1, func(c *Component) bool {
+	store.EditRecord(Editor{}, 1, func(c *Component) bool {
 		c.Description = "foo"
 		return true
 	})
@@ -36,7 +36,7 @@ func TestBasicStore(t *testing.T) {
 	ExpectTrue(t, store.FindById(1) != nil, "Expected id:1 to exist now.")
 
 	// Edit it, but decide not to proceed
-	store.EditRecord(1, func(c *Component) bool {
+	store.EditRecord(Editor{}, 1, func(c *Component) bool {
 		ExpectTrue(t, c.Description == "foo", "Initial value set")
 		c.Description = "bar"
 		return false // don't commit
@@ -44,7 +44,7 @@ func TestBasicStore(t *testing.T) {
 	ExpectTrue(t, store.FindById(1).Description == "foo", "Unchanged in second tx")
 
 	// Now change it
-	store.EditRecord(1, func(c *Component) bool {
+	store.EditRecord(Editor{}, 1, func(c *Component) bool {
 		c.Description = "bar"
 		return true
 	})
@@ -58,12 +58,12 @@ func TestJoinSets(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	store, _ := NewDBBackend(db, true)
+	store, _ := NewDBBackend(db, true, kSearchEngineMemory, "")
 
 	// Three components, each in their own equiv-class
-	store.EditRecord(1, func(c *Component) bool { c.Value = "one"; return true })
-	store.EditRecord(2, func(c *Component) bool { c.Value = "two"; return true })
-	store.EditRecord(3, func(c *Component) bool { c.Value = "three"; return true })
+	store.EditRecord(Editor{}, 1, func(c *Component) bool { c.Value = "one"; return true })
+	store.EditRecord(Editor{}, 2, func(c *Component) bool { c.Value = "two"; return true })
+	store.EditRecord(Editor{}, 3, func(c *Component) bool { c.Value = "three"; return true })
 
 	// Expecting baseline.
 	ExpectTrue(t, store.FindById(1).Equiv_set == 1, "#1")
@@ -72,41 +72,41 @@ func TestJoinSets(t *testing.T) {
 
 	// Component 2 join set 3. Final equivalence-set is lowest
 	// id of the result set.
-	store.JoinSet(2, 3)
+	store.JoinSet(Editor{}, 2, 3)
 	ExpectTrue(t, store.FindById(1).Equiv_set == 1, "#4")
 	ExpectTrue(t, store.FindById(2).Equiv_set == 2, "#5")
 	ExpectTrue(t, store.FindById(3).Equiv_set == 2, "#6")
 
 	// Break out article three out of this set.
-	store.LeaveSet(3)
+	store.LeaveSet(Editor{}, 3)
 	ExpectTrue(t, store.FindById(1).Equiv_set == 1, "#7")
 	ExpectTrue(t, store.FindById(2).Equiv_set == 2, "#8")
 	ExpectTrue(t, store.FindById(3).Equiv_set == 3, "#9")
 
 	// Join everything together.
-	store.JoinSet(3, 1)
+	store.JoinSet(Editor{}, 3, 1)
 	ExpectTrue(t, store.FindById(1).Equiv_set == 1, "#10")
 	ExpectTrue(t, store.FindById(2).Equiv_set == 2, "#11")
 	ExpectTrue(t, store.FindById(3).Equiv_set == 1, "#12")
-	store.JoinSet(2, 1)
+	store.JoinSet(Editor{}, 2, 1)
 	ExpectTrue(t, store.FindById(1).Equiv_set == 1, "#12")
 	ExpectTrue(t, store.FindById(2).Equiv_set == 1, "#13")
 	ExpectTrue(t, store.FindById(3).Equiv_set == 1, "#14")
 
 	// Lowest component leaving the set leaves the equivalence set
 	// at the lowest of the remaining.
-	store.LeaveSet(1)
+	store.LeaveSet(Editor{}, 1)
 	ExpectTrue(t, store.FindById(1).Equiv_set == 1, "#15")
 	ExpectTrue(t, store.FindById(2).Equiv_set == 2, "#16")
 	ExpectTrue(t, store.FindById(3).Equiv_set == 2, "#17")
 
 	// If we add lowest again, then the new equiv-set is back to 1.
-	store.JoinSet(1, 2)
+	store.JoinSet(Editor{}, 1, 2)
 	ExpectTrue(t, store.FindById(1).Equiv_set == 1, "#18")
 	ExpectTrue(t, store.FindById(2).Equiv_set == 1, "#19")
 	ExpectTrue(t, store.FindById(3).Equiv_set == 1, "#20")
 
-	store.LeaveSet(2)
+	store.LeaveSet(Editor{}, 2)
 	ExpectTrue(t, store.FindById(1).Equiv_set == 1, "#18")
 	ExpectTrue(t, store.FindById(2).Equiv_set == 2, "#19")
 	ExpectTrue(t, store.FindById(3).Equiv_set == 1, "#20")
@@ -119,16 +119,16 @@ func TestLeaveSetRegression(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	store, _ := NewDBBackend(db, true)
+	store, _ := NewDBBackend(db, true, kSearchEngineMemory, "")
 
 	// We store components in a slightly different
 	// sequence.
-	store.EditRecord(2, func(c *Component) bool { c.Value = "two"; return true })
-	store.EditRecord(1, func(c *Component) bool { c.Value = "one"; return true })
-	store.EditRecord(3, func(c *Component) bool { c.Value = "three"; return true })
+	store.EditRecord(Editor{}, 2, func(c *Component) bool { c.Value = "two"; return true })
+	store.EditRecord(Editor{}, 1, func(c *Component) bool { c.Value = "one"; return true })
+	store.EditRecord(Editor{}, 3, func(c *Component) bool { c.Value = "three"; return true })
 
-	store.JoinSet(2, 1)
-	store.JoinSet(3, 1)
+	store.JoinSet(Editor{}, 2, 1)
+	store.JoinSet(Editor{}, 3, 1)
 
 	ExpectTrue(t, store.FindById(1).Equiv_set == 1, "#1")
 	ExpectTrue(t, store.FindById(2).Equiv_set == 1, "#2")
@@ -136,12 +136,42 @@ func TestLeaveSetRegression(t *testing.T) {
 
 	// The way LeaveSet() was implemented, it used an SQL in a way that
 	// SQLite didn't process correctly wrt. sequence of operations.
-	store.LeaveSet(2)
+	store.LeaveSet(Editor{}, 2)
 	ExpectTrue(t, store.FindById(1).Equiv_set == 1, "#4")
 	ExpectTrue(t, store.FindById(2).Equiv_set == 2, "#5")
 	ExpectTrue(t, store.FindById(3).Equiv_set == 1, "#6")
 }
 
+func TestSetOperationsUpdateSearchIndex(t *testing.T) {
+	dbfile, _ := ioutil.TempFile("", "join-sets")
+	defer syscall.Unlink(dbfile.Name())
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, _ := NewDBBackend(db, true, kSearchEngineMemory, "")
+	store.EditRecord(Editor{}, 1, func(c *Component) bool { c.Value = "foo"; return true })
+	store.EditRecord(Editor{}, 2, func(c *Component) bool { c.Value = "foo"; return true })
+	store.EditRecord(Editor{}, 3, func(c *Component) bool { c.Value = "foo"; return true })
+
+	searchSets := func() map[int]int {
+		result := make(map[int]int)
+		for _, c := range store.Search("foo", 0).Results {
+			result[c.Id] = c.Equiv_set
+		}
+		return result
+	}
+	store.JoinSet(Editor{}, 2, 1)
+	store.JoinSet(Editor{}, 3, 1)
+	sets := searchSets()
+	ExpectTrue(t, sets[1] == 1 && sets[2] == 1 && sets[3] == 1, "#1")
+
+	// Leaving the set as its lowest id re-assigns the other members.
+	store.LeaveSet(Editor{}, 1)
+	sets = searchSets()
+	ExpectTrue(t, sets[1] == 1 && sets[2] == 2 && sets[3] == 2, "#2")
+}
+
 func TestQueryEquiv(t *testing.T) {
 	dbfile, _ := ioutil.TempFile("", "equiv-query")
 	defer syscall.Unlink(dbfile.Name())
@@ -149,25 +179,25 @@ func TestQueryEquiv(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	store, _ := NewDBBackend(db, true)
+	store, _ := NewDBBackend(db, true, kSearchEngineMemory, "")
 
 	// Three components, each in their own equiv-class
-	store.EditRecord(1, func(c *Component) bool {
+	store.EditRecord(Editor{}, 1, func(c *Component) bool {
 		c.Value = "10k"
 		c.Category = "Resist"
 		return true
 	})
-	store.EditRecord(2, func(c *Component) bool {
+	store.EditRecord(Editor{}, 2, func(c *Component) bool {
 		c.Value = "foo"
 		c.Category = "Resist"
 		return true
 	})
-	store.EditRecord(3, func(c *Component) bool {
+	store.EditRecord(Editor{}, 3, func(c *Component) bool {
 		c.Value = "three"
 		c.Category = "Resist"
 		return true
 	})
-	store.EditRecord(4, func(c *Component) bool {
+	store.EditRecord(Editor{}, 4, func(c *Component) bool {
 		c.Value = "10K" // different case, but should work
 		c.Category = "Resist"
 		return true
@@ -180,7 +210,7 @@ func TestQueryEquiv(t *testing.T) {
 
 	// Add one component to the set one is in. Even though it does not
 	// match the value name, it should show up in the result
-	store.JoinSet(2, 1)
+	store.JoinSet(Editor{}, 2, 1)
 	matching = store.MatchingEquivSetForComponent(1)
 	ExpectTrue(t, len(matching) == 3, fmt.Sprintf("Expected 3 got %d", len(matching)))
 	ExpectTrue(t, matching[0].Id == 1, "#10")
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entity tags let clients ask "has this changed?" instead of downloading
+// everything again; if not, we answer 304 Not Modified without a body.
+// Our tags are strong, i.e. the same tag means the same bytes; the
+// Compress middleware makes them weak if it changes the bytes.
+
+// Strong ETag from the content or from what the content is made of.
+func contentETag(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		io.WriteString(hash, part)
+		hash.Write([]byte{0}) // ("ab","c") differs from ("a","bc")
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:12]) + `"`
+}
+
+// Compare ignoring weakness, as RFC 7232 asks for If-None-Match.
+func etagMatches(if_none_match string, etag string) bool {
+	if if_none_match == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(if_none_match, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the ETag header. If the client already has this version, responds
+// with 304 Not Modified and returns true; nothing else needs to be sent.
+func notModified(out http.ResponseWriter, r *http.Request, etag string) bool {
+	out.Header().Set("ETag", etag)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	// Content headers don't apply to an empty response.
+	out.Header().Del("Content-Type")
+	out.Header().Del("Content-Length")
+	out.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Send generated content, unless the client has it already.
+func sendWithETag(out http.ResponseWriter, r *http.Request, content []byte) {
+	if notModified(out, r, contentETag(string(content))) {
+		return
+	}
+	out.Write(content)
+}
+
+// Hashing a file is only done again if it changed.
+type fileETag struct {
+	size     int64
+	modified time.Time
+	etag     string
+}
+
+var fileETags sync.Map // path -> fileETag
+
+// ETag of the content of an open file; info is its current Stat().
+func fileContentETag(path string, file io.ReadSeeker, info os.FileInfo) string {
+	if cached, found := fileETags.Load(path); found {
+		c := cached.(fileETag)
+		if c.size == info.Size() && c.modified.Equal(info.ModTime()) {
+			return c.etag
+		}
+	}
+	hash := sha256.New()
+	io.Copy(hash, file)
+	file.Seek(0, io.SeekStart)
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:12]) + `"`
+	fileETags.Store(path, fileETag{size: info.Size(), modified: info.ModTime(), etag: etag})
+	return etag
+}
+
+// Generated content also depends on the templates; built-in ones only
+// change with a new binary, so their version includes the start time.
+var kServerStart = time.Now().String()
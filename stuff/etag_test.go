@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestETagMatching(t *testing.T) {
+	etag := contentETag("hello")
+	expectEqual(t, etag, contentETag("hello"))
+	ExpectTrue(t, etag != contentETag("hello!"), "Different content")
+	ExpectTrue(t, contentETag("ab", "c") != contentETag("a", "bc"), "Parts separated")
+
+	ExpectTrue(t, etagMatches(etag, etag), "Same")
+	ExpectTrue(t, etagMatches(`"other", `+etag, etag), "In list")
+	ExpectTrue(t, etagMatches("W/"+etag, etag), "Weak comparison")
+	ExpectTrue(t, etagMatches("*", etag), "Any")
+	ExpectTrue(t, !etagMatches("", etag), "None")
+	ExpectTrue(t, !etagMatches(`"other"`, etag), "Other")
+}
+
+// Request with If-None-Match header if etag is given.
+func conditionalGet(handler http.Handler, url string, etag string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", url, nil)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, r)
+	return out
+}
+
+func TestSendWithETag(t *testing.T) {
+	content := "some json"
+	handler := http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		out.Header().Set("Content-Type", "application/json")
+		sendWithETag(out, r, []byte(content))
+	})
+	out := conditionalGet(handler, "/", "")
+	expectEqualInt(t, out.Code, http.StatusOK)
+	etag := out.Header().Get("ETag")
+	ExpectTrue(t, strings.HasPrefix(etag, `"`), "Strong ETag")
+
+	out = conditionalGet(handler, "/", etag)
+	expectEqualInt(t, out.Code, http.StatusNotModified)
+	expectEqualInt(t, out.Body.Len(), 0)
+	expectEqual(t, out.Header().Get("ETag"), etag)
+
+	content = "changed"
+	expectEqualInt(t, conditionalGet(handler, "/", etag).Code, http.StatusOK)
+
+	// What the browser sees when compressed.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	out = httptest.NewRecorder()
+	Compress(handler).ServeHTTP(out, r)
+	weak := out.Header().Get("ETag")
+	ExpectTrue(t, strings.HasPrefix(weak, `W/"`), "Weak if compressed")
+	expectEqualInt(t, conditionalGet(Compress(handler), "/", weak).Code, http.StatusNotModified)
+}
+
+func TestSendResourceConditional(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "static")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/stuff.css", []byte("body { color: black; }"), 0644)
+	modified := time.Date(2020, 11, 13, 13, 8, 40, 0, time.UTC)
+	os.Chtimes(dir+"/stuff.css", modified, modified)
+
+	handler := &ImageHandler{static: containedDir(dir)}
+	out := conditionalGet(handler, "/static/stuff.css", "")
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqual(t, out.Body.String(), "body { color: black; }")
+	expectEqual(t, out.Header().Get("Last-Modified"), "Fri, 13 Nov 2020 13:08:40 GMT")
+	etag := out.Header().Get("ETag")
+	ExpectTrue(t, etag != "", "Has ETag")
+
+	expectEqualInt(t, conditionalGet(handler, "/static/stuff.css", etag).Code, http.StatusNotModified)
+
+	r := httptest.NewRequest("GET", "/static/stuff.css", nil)
+	r.Header.Set("If-Modified-Since", "Fri, 13 Nov 2020 13:08:40 GMT")
+	out = httptest.NewRecorder()
+	handler.ServeHTTP(out, r)
+	expectEqualInt(t, out.Code, http.StatusNotModified)
+
+	// Changed file: new tag.
+	ioutil.WriteFile(dir+"/stuff.css", []byte("body { color: red; }"), 0644)
+	out = conditionalGet(handler, "/static/stuff.css", etag)
+	expectEqualInt(t, out.Code, http.StatusOK)
+	ExpectTrue(t, out.Header().Get("ETag") != etag, "New ETag")
+}
+
+func TestGeneratedImageConditional(t *testing.T) {
+	store, cleanup := newHistoryTestStore(t)
+	defer cleanup()
+	setValue(store, Editor{}, 1, "10k")
+	handler := &ImageHandler{store: store, template: NewTemplateRenderer("template", true)}
+
+	out := conditionalGet(handler, "/img/1", "")
+	expectEqualInt(t, out.Code, http.StatusOK)
+	ExpectTrue(t, strings.Contains(out.Body.String(), "<svg"), "Resistor image")
+	etag := out.Header().Get("ETag")
+	ExpectTrue(t, etag != "", "Has ETag")
+	expectEqualInt(t, conditionalGet(handler, "/img/1", etag).Code, http.StatusNotModified)
+
+	// Different value, different image.
+	setValue(store, Editor{}, 1, "22k")
+	expectEqualInt(t, conditionalGet(handler, "/img/1", etag).Code, http.StatusOK)
+	ExpectTrue(t, conditionalGet(handler, "/img/1?v=47k", "").Header().Get("ETag") !=
+		conditionalGet(handler, "/img/1?v=10k", "").Header().Get("ETag"), "Value parameter")
+
+	// Nothing to generate: no ETag on the fallback.
+	store.EditRecord(Editor{}, 2, func(c *Component) bool { c.Value = "mystery"; return true })
+	out = conditionalGet(handler, "/img/2", "")
+	expectEqualInt(t, out.Code, http.StatusNotFound)
+	expectEqual(t, out.Header().Get("ETag"), "")
+}
+
+func TestApiInfoConditional(t *testing.T) {
+	store, cleanup := newHistoryTestStore(t)
+	defer cleanup()
+	setValue(store, Editor{}, 1, "10k")
+	handler := &FormHandler{store: store}
+	out := conditionalGet(handler, kInfoApi+"?id=1", "")
+	expectEqualInt(t, out.Code, http.StatusOK)
+	etag := out.Header().Get("ETag")
+	expectEqualInt(t, conditionalGet(handler, kInfoApi+"?id=1", etag).Code, http.StatusNotModified)
+	setValue(store, Editor{}, 1, "22k")
+	expectEqualInt(t, conditionalGet(handler, kInfoApi+"?id=1", etag).Code, http.StatusOK)
+}
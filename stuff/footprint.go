@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The same footprint is written in many ways: "DIP-8", "DIP8", "dip 8",
+// "8-DIP", "PDIP-8" and "DIL8" are all the same package. Package images
+// are named with the canonical spelling, e.g. package-DIP-8.svg.
+
+// Other names of a package family, in upper case.
+var kFootprintFamilyAliases = map[string]string{
+	"DIL":  "DIP",
+	"PDIP": "DIP",
+	"PDIL": "DIP",
+	"CDIP": "DIP",
+	"SIL":  "SIP",
+	"SO":   "SOIC",
+	"SOP":  "SOIC",
+	"PSOP": "SOIC",
+	"LQFP": "QFP",
+}
+
+// Packages that are known by several names, after canonicalizing the
+// spelling.
+var kFootprintAliases = map[string]string{
+	"TO-220AB": "TO-220",
+	"TO-220-3": "TO-220",
+	"TO-204":   "TO-3",
+	"TO-204AA": "TO-3",
+	"TO-5":     "TO-39",
+	"TO-205AD": "TO-39",
+	"TO-236":   "SOT-23",
+	"SOT-23-3": "SOT-23",
+}
+
+var (
+	footprintRegexp         = regexp.MustCompile(`^([A-Z]+)-?(\d+)(-?[A-Z0-9]*)$`)
+	footprintReversedRegexp = regexp.MustCompile(`^(\d+)-?([A-Z]+)$`) // 8-DIP
+)
+
+// Canonical spelling of footprint: upper case, family and number of pins
+// separated with a dash and aliases resolved. Footprints that don't look
+// like family and number, such as "0805", stay as they are.
+func canonicalFootprint(footprint string) string {
+	result := strings.ToUpper(strings.TrimSpace(footprint))
+	result = strings.NewReplacer(" ", "-", "_", "-").Replace(result)
+	if match := footprintReversedRegexp.FindStringSubmatch(result); match != nil {
+		result = match[2] + "-" + match[1]
+	}
+	if match := footprintRegexp.FindStringSubmatch(result); match != nil {
+		family := match[1]
+		if alias, found := kFootprintFamilyAliases[family]; found {
+			family = alias
+		}
+		result = family + "-" + match[2] + match[3]
+	}
+	if alias, found := kFootprintAliases[result]; found {
+		return alias
+	}
+	return result
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCanonicalFootprint(t *testing.T) {
+	for _, tc := range []struct{ footprint, expected string }{
+		{"DIP-8", "DIP-8"},
+		{"dip8", "DIP-8"},
+		{"dip 8", "DIP-8"},
+		{"8-DIP", "DIP-8"},
+		{"8dip", "DIP-8"},
+		{"PDIP-28", "DIP-28"},
+		{"DIL14", "DIP-14"},
+		{"SIL-9", "SIP-9"},
+		{"SO-8", "SOIC-8"},
+		{"soic8", "SOIC-8"},
+		{"tssop_20", "TSSOP-20"},
+		{"TO220", "TO-220"},
+		{"TO-220AB", "TO-220"},
+		{"to-3", "TO-3"},
+		{"TO-204AA", "TO-3"},
+		{"TO-5", "TO-39"},
+		{"SOT23", "SOT-23"},
+		{"SOT-23-5", "SOT-23-5"},
+		{"0805", "0805"},
+		{" axial ", "AXIAL"},
+	} {
+		expectEqual(t, canonicalFootprint(tc.footprint), tc.expected)
+	}
+}
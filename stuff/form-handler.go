@@ -1,10 +1,8 @@
 package main
 
 import (
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
-	"io"
 	"math"
 	"net"
 	"net/http"
@@ -20,35 +18,27 @@ const (
 	kInfoApi  = "/api/info"
 )
 
-// Some useful pre-defined set of categories
-var available_category []string = []string{
-	"Resistor", "Potentiometer", "R-Network",
-	"Capacitor (C)", "Aluminum Cap", "Inductor (L)",
-	"Diode (D)", "Power Diode", "LED",
-	"Transistor", "Mosfet", "IGBT",
-	"Integrated Circuit (IC)", "IC Analog", "IC Digital",
-	"Connector", "Socket", "Switch",
-	"Fuse", "Mounting", "Heat Sink",
-	"Microphone", "Transformer", "? MYSTERY",
-}
-
 type FormHandler struct {
-	store    StuffStore
-	template *TemplateRenderer
-	imgPath  string
-	editNets []*net.IPNet // IP Networks that are allowed to edit
+	store      StuffStore
+	template   *TemplateRenderer
+	imgPath    string
+	auth       *Auth
+	moderation *ModerationQueue // nil: no proposals from people who can't edit.
+	categories *CategoryStore
 }
 
-func AddFormHandler(store StuffStore, template *TemplateRenderer, imgPath string, editNets []*net.IPNet) {
+func AddFormHandler(mux Router, store StuffStore, template *TemplateRenderer, imgPath string, auth *Auth, moderation *ModerationQueue, categories *CategoryStore) {
 	handler := &FormHandler{
-		store:    store,
-		template: template,
-		imgPath:  imgPath,
-		editNets: editNets,
-	}
-	http.Handle(kFormPage, handler)
-	http.Handle(kSetApi, handler)
-	http.Handle(kInfoApi, handler)
+		store:      store,
+		template:   template,
+		imgPath:    imgPath,
+		auth:       auth,
+		moderation: moderation,
+		categories: categories,
+	}
+	mux.Handle(kFormPage, handler)
+	mux.Handle(kSetApi, handler)
+	mux.Handle(kInfoApi, handler)
 }
 
 func (h *FormHandler) ServeHTTP(out http.ResponseWriter, req *http.Request) {
@@ -93,6 +83,14 @@ type FormPage struct {
 
 	FormEditable   bool
 	ShowEditToggle bool
+
+	User      string // Logged in user, if any.
+	ShowLogin bool   // If there are accounts to log in to.
+	CsrfToken string // To be sent with modifications.
+
+	IsProposal   bool // Changes are proposed, not stored right away.
+	ProposalId   int  // Proposal being reviewed; approved when stored.
+	PendingCount int  // Number of proposals waiting for review.
 }
 
 // We need another type to indicate availability of an item
@@ -282,27 +280,33 @@ func cleanupComponent(component *Component) {
 	}
 }
 
-// If this particular request is allowed to edit. Can depend on IP address,
-// cookies etc.
+// If this particular request is allowed to edit. Depends on the role of
+// the logged in user and the IP address.
 func (h *FormHandler) EditAllowed(r *http.Request) bool {
-	if h.editNets == nil || len(h.editNets) == 0 {
-		return true // No restrictions.
+	return h.auth.CanEdit(r)
+}
+
+// Approving a proposal while storing is only fine if it is a pending
+// change of the item stored.
+func (h *FormHandler) isPendingProposalFor(proposal int, id int) bool {
+	if h.moderation == nil {
+		return false
 	}
-	addr := ""
-	if h := r.Header["X-Forwarded-For"]; h != nil {
-		addr = h[0]
-	} else {
-		addr := r.RemoteAddr
-		if pos := strings.LastIndex(addr, ":"); pos >= 0 {
-			addr = addr[0:pos]
-		}
+	p := h.moderation.Find(proposal)
+	return p != nil && p.ComponentId == id && p.Status == kChangePending
+}
+
+// Shared by all handlers that modify data: the client is allowed to edit
+// if it is in one of the editNets, or editNets is empty.
+func editAllowed(client net.IP, editNets []*net.IPNet) bool {
+	if len(editNets) == 0 {
+		return true // No restrictions.
 	}
-	var ip net.IP
-	if ip = net.ParseIP(addr); ip == nil {
+	if client == nil {
 		return false
 	}
-	for i := 0; i < len(h.editNets); i++ {
-		if h.editNets[i].Contains(ip) {
+	for i := 0; i < len(editNets); i++ {
+		if editNets[i].Contains(client) {
 			return true
 		}
 	}
@@ -340,13 +344,15 @@ func (h *FormHandler) entryFormHandler(w http.ResponseWriter, r *http.Request) {
 		next_id, _ = strconv.Atoi(cookie.Value)
 	}
 
-	requestStore := r.FormValue("edit_id") != ""
+	// Only a POST of our own form can modify things.
+	requestStore := r.Method == "POST" && r.FormValue("edit_id") != ""
 	msg := ""
 	edit_allowed := h.EditAllowed(r)
+	can_propose := !edit_allowed && h.moderation != nil
+	csrf_valid := csrfValid(r)
 
-	defer ElapsedPrint("Form action", time.Now())
-
-	if requestStore && edit_allowed {
+	var unsaved *Component // Submitted, but not stored.
+	if requestStore && (edit_allowed || can_propose) {
 		drawersize, _ := strconv.Atoi(r.FormValue("drawersize"))
 		fromForm := Component{
 			Id:            edit_id,
@@ -364,17 +370,44 @@ func (h *FormHandler) entryFormHandler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			fromForm.Category = r.FormValue("category_select")
 		}
+		fromForm.Category = h.categories.Canonical(fromForm.Category)
 
 		cleanupComponent(&fromForm)
 
-		was_stored, store_msg := h.store.EditRecord(edit_id, func(comp *Component) bool {
-			*comp = fromForm
-			return true
-		})
-		if was_stored {
-			msg = fmt.Sprintf("Stored item %d; Proceed to %d", edit_id, next_id)
+		if !csrf_valid {
+			// Stay on the item with what was entered, so that
+			// the user can just submit again.
+			next_id = edit_id
+			unsaved = &fromForm
+			msg = fmt.Sprintf("Item %d not stored: form expired, please submit again", edit_id)
+		} else if can_propose {
+			next_id = edit_id
+			_, err := h.moderation.Propose(h.auth.Editor(r), h.store.FindById(edit_id), fromForm)
+			if err != nil {
+				unsaved = &fromForm
+				msg = fmt.Sprintf("Could not propose change: %s", err)
+			} else {
+				msg = fmt.Sprintf("Thank you! Your change to item %d will be reviewed.", edit_id)
+			}
+		} else if proposal, _ := strconv.Atoi(r.FormValue("proposal")); proposal > 0 &&
+			!h.isPendingProposalFor(proposal, edit_id) {
+			next_id = edit_id
+			unsaved = &fromForm
+			msg = fmt.Sprintf("Item %d not stored: change %d is not pending for it", edit_id, proposal)
 		} else {
-			msg = fmt.Sprintf("Item %d (%s); Proceed to %d", edit_id, store_msg, next_id)
+			was_stored, store_msg := h.store.EditRecord(h.auth.Editor(r), edit_id, func(comp *Component) bool {
+				*comp = fromForm
+				return true
+			})
+			if was_stored {
+				msg = fmt.Sprintf("Stored item %d; Proceed to %d", edit_id, next_id)
+			} else {
+				msg = fmt.Sprintf("Item %d (%s); Proceed to %d", edit_id, store_msg, next_id)
+			}
+			// Edited proposal: what is stored now is what we approve.
+			if proposal > 0 && was_stored {
+				h.moderation.Resolve(proposal, kChangeApproved, h.auth.Editor(r))
+			}
 		}
 	} else {
 		msg = "Browse item " + fmt.Sprintf("%d", next_id)
@@ -391,7 +424,16 @@ func (h *FormHandler) entryFormHandler(w http.ResponseWriter, r *http.Request) {
 	page.NextId = id + 1
 	page.HundredGroup = (id / 100) * 100
 
-	page.ShowEditToggle = edit_allowed
+	page.ShowEditToggle = edit_allowed || can_propose
+	page.IsProposal = can_propose
+	if edit_allowed && h.moderation != nil {
+		page.PendingCount = h.moderation.PendingCount()
+	}
+	if user := h.auth.CurrentUser(r); user != nil {
+		page.User = user.Name
+	}
+	page.ShowLogin = h.auth.hasAccounts()
+	page.CsrfToken = csrfToken(w, r)
 
 	// If the last request was an edit (requestStore), then we are on
 	// a roll and have the next page form editable as well.
@@ -419,19 +461,45 @@ func (h *FormHandler) entryFormHandler(w http.ResponseWriter, r *http.Request) {
 		msg = msg + fmt.Sprintf(" (%d: New item)", id)
 		page.PageTitle = "New Item: Noisebridge stuff organization"
 	}
+	if unsaved != nil {
+		page.Component = *unsaved
+		page.FormEditable = true
+	}
+	// Editor wants to edit a proposal before approving it.
+	if proposal, _ := strconv.Atoi(r.FormValue("proposal")); proposal > 0 &&
+		!requestStore && edit_allowed && h.moderation != nil {
+		if p := h.moderation.Find(proposal); p != nil && p.ComponentId == id && p.Status == kChangePending {
+			p.Apply(&page.Component)
+			page.ProposalId = proposal
+			page.FormEditable = true
+			msg = fmt.Sprintf("Review change proposed by %s", p.ProposedBy)
+		}
+	}
 
 	page.DescriptionRows = max(3, strings.Count(page.Component.Description, "\n")+1)
 	page.NotesRows = max(3, strings.Count(page.Component.Notes, "\n")+1)
 
-	page.CatChoice = make([]Selection, len(available_category))
+	// Categories of a group next to each other, three per row.
+	// Items can still carry an old name or an alias of their category.
+	current := page.Component.Category
+	if found := h.categories.Find(current); found != nil {
+		current = found.Name
+	}
+	categories := h.categories.Grouped()
+	page.CatChoice = make([]Selection, len(categories))
 	anySelected := false
-	for i, val := range available_category {
-		thisSelected := page.Component.Category == val
+	in_row := 0
+	for i, c := range categories {
+		thisSelected := current == c.Name
 		anySelected = anySelected || thisSelected
+		if i == 0 || c.Group != categories[i-1].Group || in_row == 3 {
+			in_row = 0
+		}
 		page.CatChoice[i] = Selection{
-			Value:        val,
+			Value:        c.Name,
 			IsSelected:   thisSelected,
-			AddSeparator: i%3 == 0}
+			AddSeparator: in_row == 0}
+		in_row++
 	}
 	page.CatFallback = Selection{
 		Value:      "-",
@@ -457,30 +525,30 @@ func (h *FormHandler) entryFormHandler(w http.ResponseWriter, r *http.Request) {
 	// -- Output
 	// We are not using any web-framework or want to keep track of session
 	// cookies. Simply a barebone, state-less web app: use plain cookies.
-	w.Header().Set("Set-Cookie", fmt.Sprintf("last-edit=%d", id))
-	var zipped io.WriteCloser = nil
-	for _, val := range r.Header["Accept-Encoding"] {
-		if strings.Contains(strings.ToLower(val), "gzip") {
-			w.Header().Set("Content-Encoding", "gzip")
-			zipped = gzip.NewWriter(w)
-			break
-		}
-	}
-
-	if edit_allowed {
-		h.template.RenderWithHttpCode(w, zipped, http_code,
+	http.SetCookie(w, &http.Cookie{Name: "last-edit", Value: strconv.Itoa(id)})
+	if edit_allowed || can_propose {
+		h.template.RenderWithHttpCode(w, nil, http_code,
 			"form-template.html", page)
 	} else {
-		h.template.RenderWithHttpCode(w, zipped, http_code,
+		h.template.RenderWithHttpCode(w, nil, http_code,
 			"display-template.html", page)
 	}
-	if zipped != nil {
-		zipped.Close()
-	}
 }
 
 func (h *FormHandler) relatedComponentSetOperations(out http.ResponseWriter, r *http.Request) {
-	switch r.FormValue("op") {
+	op := r.FormValue("op")
+	if op == "join" || op == "remove" {
+		if r.Method != "POST" {
+			out.Header().Set("Allow", "POST")
+			http.Error(out, "Set operations need POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if !csrfValid(r) {
+			http.Error(out, "Invalid CSRF token; reload page", http.StatusForbidden)
+			return
+		}
+	}
+	switch op {
 	case "html":
 		h.relatedComponentSetHtml(out, r)
 	case "join":
@@ -500,7 +568,7 @@ func (h *FormHandler) relatedComponentSetJoin(out http.ResponseWriter, r *http.R
 		return
 	}
 	if h.EditAllowed(r) {
-		h.store.JoinSet(comp, set)
+		h.store.JoinSet(h.auth.Editor(r), comp, set)
 	}
 	h.relatedComponentSetHtml(out, r)
 }
@@ -511,7 +579,7 @@ func (h *FormHandler) relatedComponentSetRemove(out http.ResponseWriter, r *http
 		return
 	}
 	if h.EditAllowed(r) {
-		h.store.LeaveSet(comp)
+		h.store.LeaveSet(h.auth.Editor(r), comp)
 	}
 	h.relatedComponentSetHtml(out, r)
 }
@@ -565,6 +633,9 @@ func (h *FormHandler) relatedComponentSetHtml(out http.ResponseWriter, r *http.R
 
 // Search for an item with a given ID, and present the information in an JSON endpoint.
 func (h *FormHandler) apiInfo(out http.ResponseWriter, r *http.Request) {
+	if !readOnlyRequest(out, r) {
+		return
+	}
 	out.Header().Set("Cache-Control", "max-age=10")
 	out.Header().Set("Content-Type", "application/json")
 
@@ -592,5 +663,5 @@ func (h *FormHandler) apiInfo(out http.ResponseWriter, r *http.Request) {
 	}
 
 	json, _ := json.Marshal(jsonResult)
-	out.Write(json)
+	sendWithETag(out, r, json)
 }
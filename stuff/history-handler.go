@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const kAdminHistoryPage = "/admin/history"
+
+// Admin page to look at recent edits and roll back edits of a given user
+// or address.
+type HistoryHandler struct {
+	store    StuffStore
+	auth     *Auth
+	template *TemplateRenderer
+}
+
+func AddHistoryHandler(mux Router, store StuffStore, auth *Auth, template *TemplateRenderer) {
+	handler := &HistoryHandler{
+		store:    store,
+		auth:     auth,
+		template: template,
+	}
+	mux.Handle(kAdminHistoryPage, handler)
+}
+
+type HistoryPage struct {
+	Source     string
+	Since      string
+	Until      string
+	Edits      []*EditHistoryEntry
+	Plan       []*RollbackItem // Preview or result of rollback.
+	RolledBack bool
+	Msg        string
+	CsrfToken  string
+}
+
+func (h *HistoryHandler) ServeHTTP(out http.ResponseWriter, r *http.Request) {
+	if !h.auth.IsAdmin(r) {
+		http.Error(out, "Only for admins", http.StatusForbidden)
+		return
+	}
+	page := &HistoryPage{
+		Source:    r.FormValue("source"),
+		Since:     r.FormValue("since"),
+		Until:     r.FormValue("until"),
+		CsrfToken: csrfToken(out, r),
+	}
+	if page.Since == "" {
+		page.Since = "24h"
+	}
+	now := time.Now()
+	filter := EditFilter{Source: page.Source}
+	var err error
+	if filter.Since, err = ParseFilterTime(page.Since, now); err == nil {
+		filter.Until, err = ParseFilterTime(page.Until, now)
+	}
+	if err != nil {
+		page.Msg = err.Error()
+		h.template.RenderWithHttpCode(out, nil, http.StatusBadRequest, "admin-history.html", page)
+		return
+	}
+
+	if r.Method == "POST" && r.FormValue("op") == "rollback" {
+		if !csrfValid(r) {
+			http.Error(out, "Invalid CSRF token; reload page", http.StatusForbidden)
+			return
+		}
+		page.Plan, err = h.store.Rollback(h.auth.Editor(r), filter, false)
+		page.RolledBack = err == nil
+	} else if filter.Source != "" {
+		page.Plan, err = h.store.Rollback(h.auth.Editor(r), filter, true)
+	}
+	if err != nil {
+		page.Msg = fmt.Sprintf("Rollback: %s", err)
+	}
+	page.Edits = h.store.EditHistory(filter)
+	h.template.Render(out, "admin-history.html", page)
+}
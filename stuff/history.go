@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every change to a component is recorded with who made it and when, so
+// that a burst of vandalism can be found and rolled back.
+var history_schema string = `
+create table if not exists edit_history (
+       id             integer constraint pk_edit_history primary key,
+       component_id   int not null,
+       edited         int not null,  -- unix time
+       editor_user    text,
+       editor_address text,
+       before         text,          -- JSON; null if component was created
+       after          text           -- JSON; null if component was removed
+);
+create index if not exists edit_history_edited on edit_history(edited);
+create index if not exists edit_history_component on edit_history(component_id);
+`
+
+type EditHistoryEntry struct {
+	Id          int
+	ComponentId int
+	Edited      time.Time
+	Editor      Editor
+	Before      *Component // nil if component was created.
+	After       *Component // nil if component was removed.
+}
+
+// Fields changed by this edit.
+func (e *EditHistoryEntry) Changes() []FieldChange {
+	before, after := e.Before, e.After
+	if before == nil {
+		before = &Component{Id: e.ComponentId}
+	}
+	if after == nil {
+		after = &Component{Id: e.ComponentId}
+	}
+	var result []FieldChange
+	for _, f := range componentFields {
+		if f.get(before) != f.get(after) {
+			result = append(result, FieldChange{
+				Field: f.Name,
+				Old:   f.get(before),
+				New:   f.get(after),
+			})
+		}
+	}
+	// Moved to another set of equivalent components.
+	if e.Before != nil && e.After != nil && before.Equiv_set != after.Equiv_set {
+		result = append(result, FieldChange{
+			Field: "Set",
+			Old:   strconv.Itoa(before.Equiv_set),
+			New:   strconv.Itoa(after.Equiv_set),
+		})
+	}
+	return result
+}
+
+// Which edits to look at.
+type EditFilter struct {
+	Source string    // User name, IP address or network (CIDR); empty: all.
+	Since  time.Time // Zero: from the beginning.
+	Until  time.Time // Zero: up to now.
+}
+
+// What a rollback does to one component.
+type RollbackItem struct {
+	ComponentId int
+	Edits       int        // Number of edits undone.
+	Current     *Component // nil if it does not exist.
+	Restore     *Component // nil if it will be removed.
+	Conflict    string     // If not empty, the reason it is not rolled back.
+}
+
+func (f EditFilter) String() string {
+	result := f.Source
+	if result == "" {
+		result = "anyone"
+	}
+	if !f.Since.IsZero() {
+		result += " since " + f.Since.Format("2006-01-02 15:04:05")
+	}
+	if !f.Until.IsZero() {
+		result += " until " + f.Until.Format("2006-01-02 15:04:05")
+	}
+	return result
+}
+
+func (f EditFilter) matchesSource(editor Editor) bool {
+	if f.Source == "" {
+		return true
+	}
+	if _, network, err := net.ParseCIDR(f.Source); err == nil {
+		ip := net.ParseIP(editor.Address)
+		return ip != nil && network.Contains(ip)
+	}
+	if ip := net.ParseIP(f.Source); ip != nil {
+		return ip.Equal(net.ParseIP(editor.Address))
+	}
+	return f.Source == editor.User
+}
+
+func (f EditFilter) Matches(e *EditHistoryEntry) bool {
+	if !f.Since.IsZero() && e.Edited.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Edited.Before(f.Until) {
+		return false
+	}
+	return f.matchesSource(e.Editor)
+}
+
+// Parse a point in time for the filter: absolute as "2006-01-02 15:04",
+// "2006-01-02" or RFC3339, or relative to now as a duration like "90m".
+func ParseFilterTime(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	for _, format := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Can't parse time '%s'", value)
+}
+
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func componentJson(c *Component) sql.NullString {
+	if c == nil {
+		return sql.NullString{}
+	}
+	content, _ := json.Marshal(c)
+	return sql.NullString{String: string(content), Valid: true}
+}
+
+func recordHistory(db sqlExecer, editor Editor, id int, before *Component, after *Component) error {
+	_, err := db.Exec("INSERT INTO edit_history (component_id, edited, editor_user, editor_address, before, after) VALUES (?1, ?2, ?3, ?4, ?5, ?6)",
+		id, time.Now().Unix(), editor.User, editor.Address,
+		componentJson(before), componentJson(after))
+	return err
+}
+
+type sqlQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Read history entries matching the where clause, oldest first.
+func queryHistory(db sqlQueryer, where string, args ...interface{}) []*EditHistoryEntry {
+	result := make([]*EditHistoryEntry, 0, 10)
+	rows, err := db.Query("SELECT id, component_id, edited, editor_user, editor_address, before, after FROM edit_history WHERE "+where+" ORDER BY id", args...)
+	if err != nil {
+		log.Printf("History: %s", err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &EditHistoryEntry{}
+		var edited int64
+		var user, address, before, after sql.NullString
+		if rows.Scan(&e.Id, &e.ComponentId, &edited, &user, &address, &before, &after) != nil {
+			continue
+		}
+		e.Edited = time.Unix(edited, 0)
+		e.Editor = Editor{User: user.String, Address: address.String}
+		if before.Valid {
+			e.Before = &Component{}
+			json.Unmarshal([]byte(before.String), e.Before)
+		}
+		if after.Valid {
+			e.After = &Component{}
+			json.Unmarshal([]byte(after.String), e.After)
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// Entries in the time window of the filter; the source is matched here.
+func filteredHistory(db sqlQueryer, filter EditFilter) []*EditHistoryEntry {
+	until := time.Now().Add(time.Hour) // Some slack for clock changes.
+	if !filter.Until.IsZero() {
+		until = filter.Until
+	}
+	result := make([]*EditHistoryEntry, 0, 10)
+	for _, e := range queryHistory(db, "edited >= ?1 AND edited < ?2", filter.Since.Unix(), until.Unix()) {
+		if filter.Matches(e) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (d *DBBackend) EditHistory(filter EditFilter) []*EditHistoryEntry {
+	return filteredHistory(d.db, filter)
+}
+
+// Restores all components to what they were before the first edit that
+// matches the filter. Components edited later by anyone else are left
+// alone and reported as conflict. All or nothing is done. With dry_run,
+// only returns what would happen.
+func (d *DBBackend) Rollback(editor Editor, filter EditFilter, dry_run bool) ([]*RollbackItem, error) {
+	if filter.Source == "" {
+		return nil, errors.New("Rollback needs a user, IP address or network")
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // No-op after commit.
+
+	var plan []*RollbackItem
+	first_edit := make(map[int]*RollbackItem)
+	for _, e := range filteredHistory(tx, filter) {
+		if item, found := first_edit[e.ComponentId]; found {
+			item.Edits++
+			continue
+		}
+		item := &RollbackItem{
+			ComponentId: e.ComponentId,
+			Edits:       1,
+			Current:     d.findByIdTx(tx, e.ComponentId),
+			Restore:     e.Before,
+		}
+		for _, later := range queryHistory(tx, "component_id = ?1 AND id > ?2", e.ComponentId, e.Id) {
+			if !filter.Matches(later) {
+				item.Conflict = fmt.Sprintf("Edited later by %s at %s",
+					later.Editor, later.Edited.Format("2006-01-02 15:04:05"))
+				break
+			}
+		}
+		first_edit[e.ComponentId] = item
+		plan = append(plan, item)
+	}
+	if dry_run {
+		return plan, nil
+	}
+
+	for _, item := range plan {
+		if item.Conflict != "" {
+			continue
+		}
+		if err := d.restoreTx(tx, editor, item); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, item := range plan {
+		if item.Conflict != "" {
+			continue
+		}
+		if c := d.FindById(item.ComponentId); c != nil {
+			d.searcher.Update(c)
+		} else {
+			d.searcher.Remove(item.ComponentId)
+		}
+	}
+	log.Printf("ROLLBACK by %s of edits by %s: %d components", editor, filter, len(plan))
+	return plan, nil
+}
+
+func (d *DBBackend) findByIdTx(tx *sql.Tx, id int) *Component {
+	rows, err := tx.Stmt(d.findById).Query(id)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	if rows.Next() {
+		c, _ := row2Component(rows)
+		return c
+	}
+	return nil
+}
+
+func (d *DBBackend) restoreTx(tx *sql.Tx, editor Editor, item *RollbackItem) error {
+	id := item.ComponentId
+	var err error
+	switch {
+	case item.Restore == nil:
+		_, err = tx.Exec("DELETE FROM component WHERE id = ?1", id)
+	default:
+		toExec := d.updateRecord
+		if item.Current == nil {
+			toExec = d.insertRecord
+		}
+		rec := item.Restore
+		_, err = tx.Stmt(toExec).Exec(id, time.Now(),
+			nullIfEmpty(rec.Category), nullIfEmpty(rec.Value),
+			nullIfEmpty(rec.Description), nullIfEmpty(rec.Notes),
+			nullIfEmpty(rec.Quantity), nullIfEmpty(rec.Datasheet_url),
+			rec.Drawersize, rec.Footprint)
+		// Back to the set it was in; the record statements leave that alone.
+		if err == nil && rec.Equiv_set != 0 {
+			_, err = tx.Exec("UPDATE component SET equiv_set = ?2 WHERE id = ?1", id, rec.Equiv_set)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return recordHistory(tx, editor, id, item.Current, item.Restore)
+}
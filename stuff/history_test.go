@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newHistoryTestStore(t *testing.T) (*DBBackend, func()) {
+	dbfile, _ := ioutil.TempFile("", "history")
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := NewDBBackend(db, true, kSearchEngineMemory, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() { syscall.Unlink(dbfile.Name()) }
+}
+
+func setValue(store StuffStore, editor Editor, id int, value string) {
+	store.EditRecord(editor, id, func(c *Component) bool {
+		c.Category = "Resistor"
+		c.Value = value
+		return true
+	})
+}
+
+func TestEditHistoryRecorded(t *testing.T) {
+	store, cleanup := newHistoryTestStore(t)
+	defer cleanup()
+	alice := Editor{User: "alice", Address: "10.1.1.1"}
+	setValue(store, alice, 1, "10k")
+	setValue(store, Editor{Address: "192.0.2.7"}, 1, "22k")
+	setValue(store, alice, 1, "22k") // No change, not recorded.
+
+	all := store.EditHistory(EditFilter{})
+	expectEqualInt(t, len(all), 2)
+	ExpectTrue(t, all[0].Before == nil, "created")
+	expectEqual(t, all[0].After.Value, "10k")
+	expectEqual(t, all[0].Editor.String(), "alice@10.1.1.1")
+	expectEqual(t, all[1].Before.Value, "10k")
+	expectEqual(t, all[1].After.Value, "22k")
+	changes := all[1].Changes()
+	ExpectTrue(t, len(changes) == 1 && changes[0].Field == "Value", "changes")
+
+	expectEqualInt(t, len(store.EditHistory(EditFilter{Source: "alice"})), 1)
+	expectEqualInt(t, len(store.EditHistory(EditFilter{Source: "192.0.2.7"})), 1)
+	expectEqualInt(t, len(store.EditHistory(EditFilter{Source: "10.0.0.0/8"})), 1)
+	expectEqualInt(t, len(store.EditHistory(EditFilter{Source: "bob"})), 0)
+	expectEqualInt(t, len(store.EditHistory(EditFilter{Since: time.Now().Add(time.Hour)})), 0)
+}
+
+func TestEditFilterTimeWindow(t *testing.T) {
+	noon := time.Date(2020, 6, 1, 12, 0, 0, 0, time.Local)
+	filter := EditFilter{Source: "alice", Since: noon, Until: noon.Add(time.Hour)}
+	entry := func(when time.Time, user string) *EditHistoryEntry {
+		return &EditHistoryEntry{Edited: when, Editor: Editor{User: user}}
+	}
+	ExpectTrue(t, filter.Matches(entry(noon, "alice")), "start inclusive")
+	ExpectTrue(t, filter.Matches(entry(noon.Add(59*time.Minute), "alice")), "within")
+	ExpectTrue(t, !filter.Matches(entry(noon.Add(time.Hour), "alice")), "end exclusive")
+	ExpectTrue(t, !filter.Matches(entry(noon.Add(-time.Second), "alice")), "before")
+	ExpectTrue(t, !filter.Matches(entry(noon, "bob")), "other user")
+
+	parsed, err := ParseFilterTime("2020-06-01 12:00", noon)
+	ExpectTrue(t, err == nil && parsed.Equal(noon), "absolute")
+	parsed, err = ParseFilterTime("90m", noon)
+	ExpectTrue(t, err == nil && parsed.Equal(noon.Add(-90*time.Minute)), "relative")
+	parsed, err = ParseFilterTime("", noon)
+	ExpectTrue(t, err == nil && parsed.IsZero(), "empty")
+	_, err = ParseFilterTime("yesterday-ish", noon)
+	ExpectTrue(t, err != nil, "garbage")
+}
+
+func TestRollback(t *testing.T) {
+	store, cleanup := newHistoryTestStore(t)
+	defer cleanup()
+	alice := Editor{User: "alice", Address: "10.1.1.1"}
+	vandal := Editor{Address: "192.0.2.66"}
+	setValue(store, alice, 1, "10k")
+	setValue(store, alice, 2, "22k")
+	setValue(store, alice, 3, "47k")
+
+	setValue(store, vandal, 1, "vandalized")
+	setValue(store, vandal, 1, "vandalized again")
+	setValue(store, vandal, 2, "vandalized")
+	setValue(store, vandal, 4, "vandalized") // New one.
+	setValue(store, vandal, 3, "vandalized")
+	setValue(store, alice, 3, "47k 1%") // Fixed by hand already.
+
+	filter := EditFilter{Source: "192.0.2.0/24", Since: time.Now().Add(-time.Hour)}
+	plan, err := store.Rollback(alice, filter, true)
+	ExpectTrue(t, err == nil, "dry run")
+	expectEqualInt(t, len(plan), 4)
+	expectEqualInt(t, plan[0].ComponentId, 1)
+	expectEqualInt(t, plan[0].Edits, 2)
+	expectEqual(t, plan[0].Restore.Value, "10k")
+	ExpectTrue(t, plan[2].ComponentId == 4 && plan[2].Restore == nil, "remove created")
+	ExpectTrue(t, plan[3].ComponentId == 3 && plan[3].Conflict != "", "conflict")
+	expectEqual(t, store.FindById(1).Value, "vandalized again") // Dry run.
+
+	_, err = store.Rollback(alice, EditFilter{}, false)
+	ExpectTrue(t, err != nil, "Needs source")
+
+	plan, err = store.Rollback(alice, filter, false)
+	ExpectTrue(t, err == nil, "rollback")
+	expectEqual(t, store.FindById(1).Value, "10k")
+	expectEqual(t, store.FindById(2).Value, "22k")
+	ExpectTrue(t, store.FindById(4) == nil, "removed")
+	expectEqual(t, store.FindById(3).Value, "47k 1%") // Untouched.
+
+	// Search index knows.
+	expectEqualInt(t, store.Search("vandalized", 10).TotalCount, 0)
+	ExpectTrue(t, store.searcher.(*MemorySearcher).index().findById(4) == nil, "not indexed")
+	expectEqualInt(t, store.Search("22k", 10).TotalCount, 1)
+
+	// The rollback is in the history as well.
+	by_alice := store.EditHistory(EditFilter{Source: "alice", Since: time.Now().Add(-time.Minute)})
+	last := by_alice[len(by_alice)-1]
+	ExpectTrue(t, last.ComponentId == 4 && last.Before != nil && last.After == nil, "removal recorded")
+}
+
+func TestRollbackSetMoves(t *testing.T) {
+	store, cleanup := newHistoryTestStore(t)
+	defer cleanup()
+	alice := Editor{User: "alice"}
+	vandal := Editor{Address: "192.0.2.66"}
+	setValue(store, alice, 1, "10k")
+	setValue(store, alice, 2, "10k")
+	setValue(store, alice, 3, "1M")
+	store.JoinSet(alice, 2, 1)
+
+	store.JoinSet(vandal, 3, 1)
+	store.LeaveSet(vandal, 2)
+	moves := store.EditHistory(EditFilter{Source: "192.0.2.66"})
+	expectEqualInt(t, len(moves), 2)
+	expectEqualInt(t, moves[0].ComponentId, 3)
+	changes := moves[0].Changes()
+	ExpectTrue(t, len(changes) == 1 && changes[0].Field == "Set", "set change")
+	expectEqual(t, changes[0].Old, "3")
+	expectEqual(t, changes[0].New, "1")
+
+	_, err := store.Rollback(alice, EditFilter{Source: "192.0.2.66"}, false)
+	ExpectTrue(t, err == nil, "rollback")
+	expectEqualInt(t, store.FindById(2).Equiv_set, 1)
+	expectEqualInt(t, store.FindById(3).Equiv_set, 3)
+	expectEqualInt(t, len(store.SetMembers(1)), 2)
+}
+
+func TestHistoryHandler(t *testing.T) {
+	store, cleanup := newHistoryTestStore(t)
+	defer cleanup()
+	setValue(store, Editor{User: "alice"}, 1, "10k")
+	setValue(store, Editor{Address: "192.0.2.66"}, 1, "vandalized")
+
+	users, cleanup_users := newTestUserStore(t)
+	defer cleanup_users()
+	users.CreateUser("admin", "secret-password", RoleAdmin)
+	users.CreateUser("editor", "secret-password", RoleEditor)
+	handler := &HistoryHandler{
+		store:    store,
+		auth:     NewAuth(users, nil, RoleEditor, nil),
+		template: NewTemplateRenderer("template", false),
+	}
+	request := func(method string, user string, values url.Values) *httptest.ResponseRecorder {
+		var r *http.Request
+		if method == "GET" {
+			r = httptest.NewRequest("GET", kAdminHistoryPage+"?"+values.Encode(), nil)
+		} else {
+			r = httptest.NewRequest("POST", kAdminHistoryPage, strings.NewReader(values.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			addCsrfToken(r)
+		}
+		session, _ := users.NewSession(user, time.Hour)
+		r.AddCookie(&http.Cookie{Name: kSessionCookie, Value: session})
+		out := httptest.NewRecorder()
+		handler.ServeHTTP(out, r)
+		return out
+	}
+	source := url.Values{"source": {"192.0.2.66"}, "since": {"1h"}}
+	expectEqualInt(t, request("GET", "editor", source).Code, http.StatusForbidden)
+
+	out := request("GET", "admin", source)
+	expectEqualInt(t, out.Code, http.StatusOK)
+	ExpectTrue(t, strings.Contains(out.Body.String(), "Rollback preview"), "preview")
+	expectEqual(t, store.FindById(1).Value, "vandalized")
+
+	source.Set("op", "rollback")
+	out = request("POST", "admin", source)
+	ExpectTrue(t, strings.Contains(out.Body.String(), "Rolled back"), "rolled back")
+	expectEqual(t, store.FindById(1).Value, "10k")
+
+	source.Set("since", "last tuesday")
+	expectEqualInt(t, request("GET", "admin", source).Code, http.StatusBadRequest)
+}
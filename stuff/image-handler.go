@@ -8,40 +8,61 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
 	kStaticResource = "/static/"
 	kComponentImage = "/img/"
+	kApiOpenApi     = "/api/openapi.json"
 )
 
+// What we served for a component image.
+var componentImageRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "stuff_component_image_requests_total",
+	Help: "Component images served by kind: 'photo', 'generated' SVG, 'package' SVG or 'fallback'.",
+}, []string{"kind"})
+
 type ImageHandler struct {
 	store      StuffStore
 	template   *TemplateRenderer
 	imgPath    string
-	staticPath string
+	static     fs.FS
+	categories *CategoryStore
 }
 
-func AddImageHandler(store StuffStore, template *TemplateRenderer, imgPath string, staticPath string) *ImageHandler {
+func AddImageHandler(mux Router, store StuffStore, template *TemplateRenderer, imgPath string, static fs.FS, categories *CategoryStore) *ImageHandler {
 	handler := &ImageHandler{
 		store:      store,
 		template:   template,
 		imgPath:    imgPath,
-		staticPath: staticPath,
+		static:     static,
+		categories: categories,
 	}
-	http.Handle(kComponentImage, handler) // Serve an component image or fallback.
-	http.Handle(kStaticResource, handler) // serve a static resource
+	mux.Handle(kComponentImage, handler) // Serve an component image or fallback.
+	mux.Handle(kStaticResource, handler) // serve a static resource
 
 	// With serving robots.txt, image-handler should probably be named
 	// static handler.
-	http.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
-		sendResource(staticPath+"/robots.txt", "", w)
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		sendResource(static, "robots.txt", w, r)
+	})
+	// Description of all the JSON APIs.
+	mux.HandleFunc(kApiOpenApi, func(w http.ResponseWriter, r *http.Request) {
+		sendResource(static, "openapi.json", w, r)
 	})
 	return handler
 }
@@ -57,37 +78,162 @@ func (h *ImageHandler) ServeHTTP(out http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Generated images only depend on what they are made from, so we know
+// the ETag before rendering; a client that has it gets a 304 right away.
+func (h *ImageHandler) generatedImageETag(component *Component, parts ...string) string {
+	component_json, _ := json.Marshal(component)
+	return contentETag(append([]string{h.template.Version(), string(component_json)}, parts...)...)
+}
+
+// Template showing the category: the one configured for it, otherwise
+// category-<name>.svg for its name or one of its aliases, if it exists.
+func (h *ImageHandler) categoryImage(c *Category) string {
+	if c == nil {
+		return ""
+	}
+	if c.Image != "" {
+		return c.Image
+	}
+	return h.categoryTemplate(c)
+}
+
+// category-<name>.svg for the name or one of the aliases; "" if none exists.
+func (h *ImageHandler) categoryTemplate(c *Category) string {
+	if c == nil {
+		return ""
+	}
+	for _, name := range append([]string{c.Name}, c.Aliases...) {
+		if template_name := "category-" + name + ".svg"; h.template.Has(template_name) {
+			return template_name
+		}
+	}
+	return ""
+}
+
+// Template showing footprint; "" if there is none.
+func (h *ImageHandler) packageTemplate(footprint string) string {
+	if footprint == "" {
+		return ""
+	}
+	for _, name := range []string{canonicalFootprint(footprint), footprint} {
+		if template_name := "package-" + name + ".svg"; h.template.Has(template_name) {
+			return template_name
+		}
+	}
+	return ""
+}
+
 // Create a synthetic representation of component from information given
 // in the component.
 func (h *ImageHandler) serveGeneratedComponentImage(component *Component, category string, value string,
-	out http.ResponseWriter) bool {
+	out http.ResponseWriter, r *http.Request) bool {
 	// If we got a category string, it takes precedence
 	if len(category) == 0 && component != nil {
 		category = component.Category
 	}
-	switch category {
-	case "Resistor":
-		out.Header().Set("Cache-Control", "max-age=60")
-		return serveResistorImage(component, value, h.template, out)
-	case "Diode (D)":
-		out.Header().Set("Cache-Control", "max-age=60")
-		return h.template.Render(out, "category-Diode.svg", component)
-	case "LED":
-		out.Header().Set("Cache-Control", "max-age=60")
-		return h.template.Render(out, "category-LED.svg", component)
-	case "Capacitor (C)":
-		out.Header().Set("Cache-Control", "max-age=60")
-		return h.template.Render(out, "category-Capacitor.svg", component)
-	}
-	return false
-}
-
-func (h *ImageHandler) servePackageImage(component *Component, out http.ResponseWriter) bool {
-	if component == nil || component.Footprint == "" {
+	image := h.categoryImage(h.categories.Find(category))
+	if image == "" {
+		return false
+	}
+	out.Header().Set("Cache-Control", "max-age=60")
+	if notModified(out, r, h.generatedImageETag(component, category, value, image)) {
+		return true
+	}
+	rendered := renderBuffered(out, func(w http.ResponseWriter) bool {
+		if value_image, ok := kValueImages[image]; ok {
+			return value_image(component, value, h.template, w)
+		}
+		return h.template.Render(w, image, component)
+	})
+	if !rendered {
+		out.Header().Del("ETag") // Not for whatever is sent instead.
+		// Value we can't show; the picture of the category is better than nothing.
+		if template_name := h.categoryTemplate(h.categories.Find(category)); template_name != "" &&
+			template_name != image {
+			if notModified(out, r, h.generatedImageETag(component, template_name)) {
+				return true
+			}
+			rendered = renderBuffered(out, func(w http.ResponseWriter) bool {
+				return h.template.Render(w, template_name, component)
+			})
+			if !rendered {
+				out.Header().Del("ETag")
+			}
+		}
+	}
+	return rendered
+}
+
+// Hand-drawn package image if there is one, otherwise a generated drawing.
+func (h *ImageHandler) servePackageImage(component *Component, out http.ResponseWriter, r *http.Request) bool {
+	if component == nil {
+		return false
+	}
+	if template_name := h.packageTemplate(component.Footprint); template_name != "" {
+		if notModified(out, r, h.generatedImageETag(component, template_name)) {
+			return true
+		}
+		if renderBuffered(out, func(w http.ResponseWriter) bool {
+			return h.template.Render(w, template_name, component)
+		}) {
+			return true
+		}
+		out.Header().Del("ETag")
+	}
+	drawing := NewPackageDrawing(component.Footprint, component.Value)
+	if drawing == nil {
+		return false
+	}
+	if notModified(out, r, h.generatedImageETag(component, kPackageDrawingTemplate)) {
+		return true
+	}
+	if !renderBuffered(out, func(w http.ResponseWriter) bool {
+		return h.template.Render(w, kPackageDrawingTemplate, drawing)
+	}) {
+		out.Header().Del("ETag")
 		return false
 	}
-	return h.template.Render(out,
-		"package-"+component.Footprint+".svg", component)
+	return true
+}
+
+// Collects a response, so that it can still be dropped if rendering fails
+// halfway.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(data)
+}
+
+// Only sends what render() wrote if it succeeded; otherwise, out is
+// untouched and something else can be sent.
+func renderBuffered(out http.ResponseWriter, render func(w http.ResponseWriter) bool) bool {
+	buffer := &bufferedResponse{header: out.Header().Clone()}
+	if !render(buffer) {
+		return false
+	}
+	for key, values := range buffer.header {
+		out.Header()[key] = values
+	}
+	if buffer.status != 0 {
+		out.WriteHeader(buffer.status)
+	}
+	out.Write(buffer.body.Bytes())
+	return true
 }
 
 // Returns true if this component likely has an image. False, if we know
@@ -96,8 +242,9 @@ func (h *ImageHandler) hasComponentImage(component *Component) bool {
 	if component == nil {
 		return false
 	}
-	switch component.Category {
-	case "Resistor", "Diode (D)", "LED", "Capacitor (C)":
+	if h.categoryImage(h.categories.Find(component.Category)) != "" ||
+		h.packageTemplate(component.Footprint) != "" ||
+		parsePackageShape(component.Footprint) != nil {
 		return true
 	}
 	_, err := os.Stat(fmt.Sprintf("%s/%d.jpg", h.imgPath, component.Id))
@@ -105,61 +252,117 @@ func (h *ImageHandler) hasComponentImage(component *Component) bool {
 }
 
 func (h *ImageHandler) serveComponentImage(requested string, out http.ResponseWriter, r *http.Request) {
-	path := h.imgPath + "/" + requested + ".jpg"
-	if _, err := os.Stat(path); err == nil { // we have an image.
-		sendResource(path, h.staticPath+"/fallback.png", out)
+	comp_id, err := strconv.Atoi(requested)
+	if err != nil || comp_id < 0 {
+		componentImageRequests.WithLabelValues("fallback").Inc()
+		h.sendFallback(out)
+		return
+	}
+	// Photos are only looked up by number, so nothing from the request
+	// ends up in the path.
+	if sendFile(containedDir(h.imgPath), strconv.Itoa(comp_id)+".jpg", out, r) {
+		componentImageRequests.WithLabelValues("photo").Inc()
 		return
 	}
 	// No image, but let's see if we can do something from the
 	// component
-	if comp_id, err := strconv.Atoi(requested); err == nil {
-		component := h.store.FindById(comp_id)
-		category := r.FormValue("c") // We also allow these if available
-		value := r.FormValue("v")
-		if (component != nil || len(category) > 0 || len(value) > 0) &&
-			h.serveGeneratedComponentImage(component, category, value, out) {
-			return
-		}
-		if h.servePackageImage(component, out) {
-			return
-		}
+	component := h.store.FindById(comp_id)
+	category := r.FormValue("c") // We also allow these if available
+	value := r.FormValue("v")
+	if (component != nil || len(category) > 0 || len(value) > 0) &&
+		h.serveGeneratedComponentImage(component, category, value, out, r) {
+		componentImageRequests.WithLabelValues("generated").Inc()
+		return
+	}
+	if h.servePackageImage(component, out, r) {
+		componentImageRequests.WithLabelValues("package").Inc()
+		return
 	}
+	componentImageRequests.WithLabelValues("fallback").Inc()
 	// Use fallback-resource straight away to get short cache times.
-	sendResource("", h.staticPath+"/fallback.png", out)
+	h.sendFallback(out)
 }
 
 func (h *ImageHandler) serveStatic(out http.ResponseWriter, r *http.Request) {
-	prefix_len := len("/static/")
-	resource := r.URL.Path[prefix_len:]
-	sendResource(h.staticPath+"/"+resource, "", out)
-}
-
-func sendResource(local_path string, fallback_resource string, out http.ResponseWriter) {
-	cache_time := 900
-	header_addon := ""
-	content, _ := ioutil.ReadFile(local_path)
-	if content == nil && fallback_resource != "" {
-		local_path = fallback_resource
-		content, _ = ioutil.ReadFile(local_path)
-		cache_time = 10 // fallbacks might change more often.
-		out.WriteHeader(http.StatusNotFound)
-		header_addon = ",must-revalidate"
-	}
-	out.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d%s", cache_time, header_addon))
-	switch {
-	case strings.HasSuffix(local_path, ".png"):
-		out.Header().Set("Content-Type", "image/png")
-	case strings.HasSuffix(local_path, ".css"):
-		out.Header().Set("Content-Type", "text/css")
-	case strings.HasSuffix(local_path, ".svg"):
-		out.Header().Set("Content-Type", "image/svg+xml;charset=utf-8")
-	case strings.HasSuffix(local_path, ".txt"):
-		out.Header().Set("Content-Type", "text/plain")
-	case strings.HasSuffix(local_path, ".json"):
-		out.Header().Set("Content-Type", "application/json")
-	default:
-		out.Header().Set("Content-Type", "image/jpg")
+	resource := strings.TrimPrefix(r.URL.Path, kStaticResource)
+	sendResource(h.static, resource, out, r)
+}
+
+// Send file with caching headers; clients that have the current version
+// get a 304, and parts of it can be requested with Range.
+func sendResource(files fs.FS, name string, out http.ResponseWriter, r *http.Request) {
+	if !sendFile(files, name, out, r) {
+		out.Header().Set("X-Content-Type-Options", "nosniff")
+		http.Error(out, "Not found", http.StatusNotFound)
 	}
+}
 
+// Image for components we have nothing for, with 404.
+func (h *ImageHandler) sendFallback(out http.ResponseWriter) {
+	// All headers need to be set before WriteHeader().
+	out.Header().Set("Cache-Control", "max-age=10,must-revalidate") // fallbacks might change more often.
+	out.Header().Set("X-Content-Type-Options", "nosniff")
+	if h.static == nil {
+		http.Error(out, "Not found", http.StatusNotFound)
+		return
+	}
+	content, err := fs.ReadFile(h.static, "fallback.png")
+	if err != nil {
+		http.Error(out, "Not found", http.StatusNotFound)
+		return
+	}
+	out.Header().Set("Content-Type", detectContentType("fallback.png", content))
+	out.WriteHeader(http.StatusNotFound)
 	out.Write(content)
 }
+
+// Send file if it exists; returns false if it doesn't.
+func sendFile(files fs.FS, name string, out http.ResponseWriter, r *http.Request) bool {
+	if files == nil || !fs.ValidPath(name) {
+		return false
+	}
+	file, err := files.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	content, ok := file.(io.ReadSeeker) // Files on disk and embedded ones are.
+	if !ok {
+		return false
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(content, head)
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	// Embedded files have no time, but the same name for the same content.
+	cache_key := "embedded:" + name
+	if disk_file, ok := file.(*os.File); ok {
+		cache_key = disk_file.Name()
+	}
+	out.Header().Set("Cache-Control", "max-age=900")
+	out.Header().Set("Content-Type", detectContentType(name, head[:n]))
+	out.Header().Set("X-Content-Type-Options", "nosniff")
+	out.Header().Set("ETag", fileContentETag(cache_key, content, info))
+	http.ServeContent(out, r, name, info.ModTime(), content)
+	return true
+}
+
+// Content type from the file name; for images, what the content actually
+// is (a PNG saved as 123.jpg is still a PNG). Unknown extensions are
+// sniffed from the content.
+func detectContentType(local_path string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	by_name := mime.TypeByExtension(strings.ToLower(filepath.Ext(local_path)))
+	switch {
+	case by_name == "":
+		return sniffed
+	case strings.HasPrefix(by_name, "image/") && strings.HasPrefix(sniffed, "image/"):
+		return sniffed
+	}
+	return by_name
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Directory with static files, component photos and a secret next to them.
+func newImageTestDirs(t *testing.T) (*ImageHandler, string, func()) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(dir+"/static", 0755)
+	os.Mkdir(dir+"/static/sub", 0755)
+	os.Mkdir(dir+"/static/.git", 0755)
+	os.Mkdir(dir+"/img", 0755)
+	ioutil.WriteFile(dir+"/secret.txt", []byte("secret"), 0644)
+	ioutil.WriteFile(dir+"/static/stuff.css", []byte("body { color: black; }"), 0644)
+	ioutil.WriteFile(dir+"/static/sub/x.txt", []byte("sub"), 0644)
+	ioutil.WriteFile(dir+"/static/.git/config", []byte("hidden"), 0644)
+	ioutil.WriteFile(dir+"/static/fallback.png", kPngHeader, 0644)
+	os.Symlink(dir+"/secret.txt", dir+"/static/escape.txt")
+	os.Symlink(dir+"/static/stuff.css", dir+"/static/alias.css")
+	return &ImageHandler{static: containedDir(dir + "/static"), imgPath: dir + "/img"}, dir,
+		func() { os.RemoveAll(dir) }
+}
+
+// Smallest thing http.DetectContentType recognizes as PNG.
+var kPngHeader = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+
+// Request with the path as given, no cleaning or unescaping by the client.
+func rawGet(handler http.Handler, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.URL.Path = path
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, r)
+	return out
+}
+
+func TestStaticTraversal(t *testing.T) {
+	handler, _, cleanup := newImageTestDirs(t)
+	defer cleanup()
+	out := rawGet(handler, "/static/stuff.css")
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqual(t, out.Body.String(), "body { color: black; }")
+	expectEqual(t, out.Header().Get("Content-Type"), "text/css; charset=utf-8")
+	expectEqual(t, out.Header().Get("X-Content-Type-Options"), "nosniff")
+
+	for _, path := range []string{
+		"/static/../secret.txt",
+		"/static/../../secret.txt",
+		"/static/sub/../../secret.txt",
+		"/static/..\\secret.txt",
+		"/static/escape.txt",
+		"/static/.git/config",
+		"/static/sub",
+		"/static/",
+		"/static/nonexistent.css",
+	} {
+		out := rawGet(handler, path)
+		expectEqualInt(t, out.Code, http.StatusNotFound)
+		ExpectTrue(t, out.Body.String() != "secret" && out.Body.String() != "hidden", path)
+	}
+}
+
+func TestComponentImageTraversal(t *testing.T) {
+	handler, dir, cleanup := newImageTestDirs(t)
+	defer cleanup()
+	store, store_cleanup := newHistoryTestStore(t)
+	defer store_cleanup()
+	handler.store = store
+	ioutil.WriteFile(dir+"/img/42.jpg", []byte("\xFF\xD8\xFF\xE0 jpeg"), 0644)
+	ioutil.WriteFile(dir+"/secret.jpg", []byte("secret"), 0644)
+
+	out := rawGet(handler, "/img/42")
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqual(t, out.Header().Get("Content-Type"), "image/jpeg")
+
+	for _, path := range []string{
+		"/img/../secret",
+		"/img/../../secret",
+		"/img/42/../../secret",
+		"/img/-1",
+		"/img/.42",
+	} {
+		out := rawGet(handler, path)
+		expectEqualInt(t, out.Code, http.StatusNotFound)
+		// Fallback image, sent with the headers set before the status.
+		expectEqual(t, out.Header().Get("Content-Type"), "image/png")
+		expectEqual(t, out.Header().Get("Cache-Control"), "max-age=10,must-revalidate")
+		expectEqual(t, out.Body.String(), string(kPngHeader))
+	}
+}
+
+func TestImageContentSniffing(t *testing.T) {
+	handler, dir, cleanup := newImageTestDirs(t)
+	defer cleanup()
+	ioutil.WriteFile(dir+"/img/42.jpg", kPngHeader, 0644) // Actually a PNG.
+	ioutil.WriteFile(dir+"/static/notes", []byte("just some text"), 0644)
+
+	expectEqual(t, rawGet(handler, "/img/42").Header().Get("Content-Type"), "image/png")
+	expectEqual(t, rawGet(handler, "/static/notes").Header().Get("Content-Type"),
+		"text/plain; charset=utf-8")
+	// Not an image, so we go by the name.
+	ioutil.WriteFile(dir+"/static/page.svg", []byte("<svg></svg>"), 0644)
+	expectEqual(t, rawGet(handler, "/static/page.svg").Header().Get("Content-Type"), "image/svg+xml")
+}
+
+func TestStaticRange(t *testing.T) {
+	handler, _, cleanup := newImageTestDirs(t)
+	defer cleanup()
+	r := httptest.NewRequest("GET", "/static/stuff.css", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, r)
+	expectEqualInt(t, out.Code, http.StatusPartialContent)
+	expectEqual(t, out.Body.String(), "body")
+	expectEqual(t, out.Header().Get("Content-Range"), "bytes 0-3/22")
+}
+
+func TestPackageAndCategoryImagesByName(t *testing.T) {
+	store, cleanup := newHistoryTestStore(t)
+	defer cleanup()
+	categories, categories_cleanup := newTestCategoryStore(t)
+	defer categories_cleanup()
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/component", 0755)
+	ioutil.WriteFile(dir+"/component/category-Osc.svg", []byte("<svg>oscillator</svg>"), 0644)
+	handler := &ImageHandler{store: store, categories: categories,
+		template: NewTemplateRenderer(dir, true)}
+
+	for id, footprint := range map[int]string{1: "DIP-40", 2: "8-dip", 3: "DIL14", 4: "TO-5"} {
+		store.EditRecord(Editor{}, id, func(c *Component) bool { c.Footprint = footprint; return true })
+		out := rawGet(handler, "/img/"+strconv.Itoa(id))
+		expectEqualInt(t, out.Code, http.StatusOK)
+		ExpectTrue(t, strings.Contains(out.Body.String(), "<svg"), footprint)
+		ExpectTrue(t, handler.hasComponentImage(store.FindById(id)), footprint)
+	}
+
+	// A category without configured image gets category-<name>.svg.
+	categories.Save("", Category{Name: "Oscillator", Group: "Timing", Aliases: []string{"Osc"}})
+	store.EditRecord(Editor{}, 5, func(c *Component) bool { c.Category = "Oscillator"; return true })
+	out := rawGet(handler, "/img/5")
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqual(t, out.Body.String(), "<svg>oscillator</svg>")
+	expectEqual(t, handler.categoryImage(categories.Find("Resistor")), kResistorImage)
+	expectEqual(t, handler.categoryImage(categories.Find("Potentiometer")), "")
+}
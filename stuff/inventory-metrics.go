@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Gauges describing the inventory itself. Computed when scraped, so they
+// always reflect the current state of the database.
+
+var (
+	inventoryByCategoryDesc = prometheus.NewDesc(
+		"stuff_inventory_components",
+		"Number of components by category.",
+		[]string{"category"}, nil)
+	inventoryByStatusDesc = prometheus.NewDesc(
+		"stuff_inventory_components_by_status",
+		"Number of components by completeness of their data, as shown on the status page.",
+		[]string{"status"}, nil)
+	inventoryByImageDesc = prometheus.NewDesc(
+		"stuff_inventory_components_by_image",
+		"Number of components with and without a photo.",
+		[]string{"has_image"}, nil)
+)
+
+type InventoryCollector struct {
+	store    StuffStore
+	imageDir string
+}
+
+func NewInventoryCollector(store StuffStore, imageDir string) *InventoryCollector {
+	return &InventoryCollector{
+		store:    store,
+		imageDir: imageDir,
+	}
+}
+
+func (c *InventoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- inventoryByCategoryDesc
+	ch <- inventoryByStatusDesc
+	ch <- inventoryByImageDesc
+}
+
+func (c *InventoryCollector) Collect(ch chan<- prometheus.Metric) {
+	byCategory := make(map[string]int)
+	byStatus := make(map[string]int)
+	withImage, withoutImage := 0, 0
+	c.store.IterateAll(func(comp *Component) bool {
+		byCategory[comp.Category]++
+		var item StatusItem
+		fillComponentStatusItem(comp, comp.Id, c.imageDir, &item)
+		byStatus[item.Status]++
+		if item.HasPicture {
+			withImage++
+		} else {
+			withoutImage++
+		}
+		return true
+	})
+	for category, count := range byCategory {
+		ch <- prometheus.MustNewConstMetric(inventoryByCategoryDesc,
+			prometheus.GaugeValue, float64(count), category)
+	}
+	for status, count := range byStatus {
+		ch <- prometheus.MustNewConstMetric(inventoryByStatusDesc,
+			prometheus.GaugeValue, float64(count), status)
+	}
+	ch <- prometheus.MustNewConstMetric(inventoryByImageDesc,
+		prometheus.GaugeValue, float64(withImage), "true")
+	ch <- prometheus.MustNewConstMetric(inventoryByImageDesc,
+		prometheus.GaugeValue, float64(withoutImage), "false")
+}
@@ -2,9 +2,11 @@
 package main
 
 import (
+	"bufio"
 	"database/sql"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -12,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -33,11 +36,30 @@ type Component struct {
 // Modify a user pointer. Returns 'true' if the changes should be commited.
 type ModifyFun func(comp *Component) bool
 
+// Who makes a change. Recorded with every modification.
+type Editor struct {
+	User    string // Logged in user; empty if anonymous.
+	Address string // Client IP address; empty for local tools.
+}
+
+func (e Editor) String() string {
+	switch {
+	case e.User != "" && e.Address != "":
+		return e.User + "@" + e.Address
+	case e.User != "":
+		return e.User
+	case e.Address != "":
+		return e.Address
+	}
+	return "-"
+}
+
 // SearchResult holds metadata about the search.
 type SearchResult struct {
 	OrignialQuery  string
 	RewrittenQuery string
 	Results        []*Component
+	TotalCount     int // All matches; Results might be limited.
 }
 
 // Interface to our storage backend.
@@ -51,14 +73,15 @@ type StuffStore interface {
 	// Returns if record has been saved, possibly with message.
 	// This does _not_ influence the equivalence set settings, use
 	// the JoinSet()/LeaveSet() functions for that.
-	EditRecord(id int, updater ModifyFun) (bool, string)
+	// The editor is recorded with the change.
+	EditRecord(editor Editor, id int, updater ModifyFun) (bool, string)
 
 	// Have component with id join set with given ID.
-	JoinSet(id int, equiv_set int)
+	JoinSet(editor Editor, id int, equiv_set int)
 
 	// Leave any set we are in and go back to the default set
 	// (which is equiv_set == id)
-	LeaveSet(id int)
+	LeaveSet(editor Editor, id int)
 
 	// Get possible matching components of given component,
 	// including all the components that are in the sets the matches
@@ -66,62 +89,167 @@ type StuffStore interface {
 	// Ordered by equivalence set, id.
 	MatchingEquivSetForComponent(component int) []*Component
 
-	// Given a search term, returns all the components that match, ordered
-	// by some internal scoring system. Don't modify the returned objects!
-	Search(search_term string) *SearchResult
+	// Components in the given equivalence set, ordered by id.
+	SetMembers(equiv_set int) []*Component
+
+	// Given a search term, returns the components that match, ordered
+	// by some internal scoring system. If limit > 0, at most limit
+	// components are returned. Don't modify the returned objects!
+	// Delegated to the configured Searcher.
+	Search(search_term string, limit int) *SearchResult
 
 	// Iterate through all elements.
 	IterateAll(func(comp *Component) bool)
-}
 
-var wantTimings = flag.Bool("want-timings", false, "Print processing timings.")
+	// Edits matching the filter, oldest first.
+	EditHistory(filter EditFilter) []*EditHistoryEntry
 
-func ElapsedPrint(msg string, start time.Time) {
-	if *wantTimings {
-		log.Printf("%s took %s", msg, time.Since(start))
-	}
+	// Undo all edits matching the filter in one transaction. Returns
+	// what is done for each component; with dry_run, nothing is changed.
+	Rollback(editor Editor, filter EditFilter, dry_run bool) ([]*RollbackItem, error)
+
+	// Finish pending work before the program exits. No other calls are
+	// allowed afterwards.
+	Close() error
 }
 
 func stuffStoreRoot(out http.ResponseWriter, r *http.Request) {
 	http.Redirect(out, r, "/search", 302)
 }
 
-func parseAllowedEditorCIDR(allowed string) []*net.IPNet {
-	all_allowed := strings.Split(allowed, ",")
-	allowed_nets := make([]*net.IPNet, 0, len(all_allowed))
-	for i := 0; i < len(all_allowed); i++ {
-		if all_allowed[i] == "" {
+// Parse comma separated list of networks in CIDR format. A plain IP
+// address is a network with just that address.
+func parseCIDRList(flag_name string, list string) []*net.IPNet {
+	all_nets := strings.Split(list, ",")
+	result := make([]*net.IPNet, 0, len(all_nets))
+	for i := 0; i < len(all_nets); i++ {
+		cidr := strings.TrimSpace(all_nets[i])
+		if cidr == "" {
 			continue
 		}
-		_, net, err := net.ParseCIDR(all_allowed[i])
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+		_, net, err := net.ParseCIDR(cidr)
 		if err != nil {
-			log.Fatal("--edit-permission-nets: Need IP/Network format: ", err)
+			log.Fatalf("--%s: Need IP/Network format: %s", flag_name, err)
 		} else {
-			allowed_nets = append(allowed_nets, net)
+			result = append(result, net)
+		}
+	}
+	return result
+}
+
+// Create user given as name:role with the password read from the first
+// line of stdin.
+func addUserFromCommandline(users *UserStore, spec string) {
+	colon := strings.LastIndex(spec, ":")
+	if colon < 0 {
+		log.Fatal("--add-user: expected name:role")
+	}
+	role, err := ParseRole(spec[colon+1:])
+	if err != nil {
+		log.Fatal("--add-user: ", err)
+	}
+	fmt.Fprintf(os.Stderr, "Password for %s: ", spec[:colon])
+	password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	password = strings.TrimRight(password, "\r\n")
+	if err := users.CreateUser(spec[:colon], password, role); err != nil {
+		log.Fatal("--add-user: ", err)
+	}
+	log.Printf("Created %s user '%s'", role, spec[:colon])
+}
+
+// List edits matching the filter and what rolling them back would do.
+// Only rolls back if do_rollback is set.
+func rollbackFromCommandline(store StuffStore, source, since, until string, do_rollback bool) {
+	now := time.Now()
+	filter := EditFilter{Source: source}
+	var err error
+	if filter.Since, err = ParseFilterTime(since, now); err != nil {
+		log.Fatal("--history-since: ", err)
+	}
+	if filter.Until, err = ParseFilterTime(until, now); err != nil {
+		log.Fatal("--history-until: ", err)
+	}
+	for _, e := range store.EditHistory(filter) {
+		json, _ := json.Marshal(e.After)
+		fmt.Printf("%s %-20s %5d %s\n", e.Edited.Format("2006-01-02 15:04:05"),
+			e.Editor, e.ComponentId, json)
+	}
+	plan, err := store.Rollback(Editor{User: "rollback"}, filter, !do_rollback)
+	if err != nil {
+		log.Fatal("Rollback: ", err)
+	}
+	for _, item := range plan {
+		switch {
+		case item.Conflict != "":
+			fmt.Printf("%5d: skipped; %s\n", item.ComponentId, item.Conflict)
+		case item.Restore == nil:
+			fmt.Printf("%5d: remove\n", item.ComponentId)
+		default:
+			json, _ := json.Marshal(item.Restore)
+			fmt.Printf("%5d: restore %s\n", item.ComponentId, json)
 		}
 	}
-	return allowed_nets
+	if !do_rollback && len(plan) > 0 {
+		fmt.Println("Dry run; use -rollback to apply.")
+	}
 }
 
 func main() {
+	configFile := flag.String("config", "", "JSON config file with settings; flags given on the command line take precedence")
 	imageDir := flag.String("imagedir", "img-srv", "Directory with component images")
-	templateDir := flag.String("templatedir", "./template", "Base-Directory with templates")
+	templateDir := flag.String("templatedir", "", "Directory with templates used instead of the built-in ones, file by file")
 	cacheTemplates := flag.Bool("cache-templates", true,
 		"Cache templates. False for online editing while development.")
-	staticResource := flag.String("staticdir", "static",
-		"Directory with static resources")
+	staticResource := flag.String("staticdir", "",
+		"Directory with static resources used instead of the built-in ones, file by file")
 	bindAddress := flag.String("bind-address", ":2000", "Port to serve from")
 	dbFile := flag.String("dbfile", "stuff-database.db", "SQLite database file")
 	logfile := flag.String("logfile", "", "Logfile to write interesting events")
+	log_requests := flag.Bool("log-requests", false, "Log every request with its request ID")
+	read_timeout := flag.Duration("read-timeout", 30*time.Second, "Maximum time to read a request")
+	write_timeout := flag.Duration("write-timeout", 60*time.Second, "Maximum time to write a response")
+	idle_timeout := flag.Duration("idle-timeout", 120*time.Second, "How long to keep idle keep-alive connections open")
+	shutdown_timeout := flag.Duration("shutdown-timeout", 30*time.Second, "On SIGTERM, how long to wait for running requests to finish")
+	searchEngine := flag.String("search-engine", kSearchEngineMemory, "Search engine to use: '"+kSearchEngineMemory+"' or '"+kSearchEngineFTS5+"' (SQLite full text search; needs binary built with -tags sqlite_fts5)")
+	searchSnapshot := flag.Bool("search-snapshot", true, "Persist search index next to the database file for fast startup")
 	do_cleanup := flag.Bool("cleanup-db", false, "Cleanup run of database")
-	permitted_nets := flag.String("edit-permission-nets", "", "Comma separated list of networks (CIDR format IP-Addr/network) that are allowed to edit content")
+	history_source := flag.String("history-source", "", "List edits by this user, IP address or network (CIDR) and what a rollback would do, then exit")
+	history_since := flag.String("history-since", "24h", "With -history-source: edits since this time ('2006-01-02 15:04') or duration ago")
+	history_until := flag.String("history-until", "", "With -history-source: edits before this time or duration ago")
+	do_rollback := flag.Bool("rollback", false, "With -history-source: roll back the listed edits")
+	permitted_nets := flag.String("edit-permission-nets", "", "Comma separated list of networks (CIDR format IP-Addr/network) that are allowed to edit content anonymously")
+	trusted_proxies := flag.String("trusted-proxies", "", "Comma separated list of networks (CIDR format IP-Addr/network) of reverse proxies whose -forwarded-header is believed")
+	forwarded_header := flag.String("forwarded-header", kForwardedFor, "Header in which the trusted proxies pass on the client address: '"+kForwardedFor+"' or '"+kForwarded+"'")
+	anonymous_role := flag.String("anonymous-role", "editor", "Role of users that are not logged in: 'viewer' or 'editor'")
+	accept_proposals := flag.Bool("accept-proposals", false, "Let people who are not allowed to edit propose changes, to be reviewed by editors on /moderation")
+	add_user := flag.String("add-user", "", "Create user account given as name:role (viewer, editor or admin), read password from stdin, then exit")
 	site_name := flag.String("site-name", "", "Site-name, in particular needed for SSL")
 	ssl_key := flag.String("ssl-key", "", "Key file")
 	ssl_cert := flag.String("ssl-cert", "", "Cert file")
 
 	flag.Parse()
+	if *configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, *configFile); err != nil {
+			log.Fatal("--config: ", err)
+		}
+	}
 
-	edit_nets := parseAllowedEditorCIDR(*permitted_nets)
+	edit_nets := parseCIDRList("edit-permission-nets", *permitted_nets)
+	if *forwarded_header != kForwardedFor && *forwarded_header != kForwarded {
+		log.Fatalf("--forwarded-header: needs to be '%s' or '%s'", kForwardedFor, kForwarded)
+	}
+	client_ip := NewClientIPResolver(parseCIDRList("trusted-proxies", *trusted_proxies), *forwarded_header)
+	anonymous, err := ParseRole(*anonymous_role)
+	if err != nil || anonymous > RoleEditor {
+		log.Fatalf("--anonymous-role: needs to be 'viewer' or 'editor'")
+	}
 
 	if *logfile != "" {
 		f, err := os.OpenFile(*logfile,
@@ -145,19 +273,44 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer db.Close()
+
+	users, err := NewUserStore(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *add_user != "" {
+		addUserFromCommandline(users, *add_user)
+		return
+	}
+	categories, err := NewCategoryStore(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	searchSnapshotFile := ""
+	if *searchSnapshot {
+		searchSnapshotFile = *dbFile + ".search-index"
+	}
 
 	var store StuffStore
-	store, err = NewDBBackend(db, is_dbfilenew)
+	store, err = NewDBBackend(db, is_dbfilenew, *searchEngine, searchSnapshotFile)
 	if err != nil {
 		log.Fatal(err)
 	}
+	store = NewInstrumentedStore(store)
+	defer func() {
+		if err := store.Close(); err != nil {
+			log.Printf("Closing store: %s", err)
+		}
+	}()
 
 	// Very crude way to run all the cleanup routines if
 	// requested. This is the only thing we do.
 	if *do_cleanup {
 		for i := 0; i < 3000; i++ {
 			if c := store.FindById(i); c != nil {
-				store.EditRecord(i, func(c *Component) bool {
+				store.EditRecord(Editor{User: "cleanup-db"}, i, func(c *Component) bool {
 					before := *c
 					cleanupComponent(c)
 					if *c == before {
@@ -172,23 +325,37 @@ func main() {
 		return
 	}
 
+	if *history_source != "" {
+		rollbackFromCommandline(store, *history_source, *history_since, *history_until, *do_rollback)
+		return
+	}
+
+	mux := http.NewServeMux()
 	templates := NewTemplateRenderer(*templateDir, *cacheTemplates)
-	imagehandler := AddImageHandler(store, templates, *imageDir, *staticResource)
-	AddFormHandler(store, templates, *imageDir, edit_nets)
-	AddSearchHandler(store, templates, imagehandler)
-	AddStatusHandler(store, templates, *imageDir)
-	AddSitemapHandler(store, *site_name)
-	http.Handle("/metrics", promhttp.Handler())
-
-	log.Printf("Listening on %q", *bindAddress)
-	if *ssl_cert != "" && *ssl_key != "" {
-		log.Fatal(http.ListenAndServeTLS(*bindAddress,
-			*ssl_cert, *ssl_key,
-			nil))
-	} else {
-		log.Fatal(http.ListenAndServe(*bindAddress, nil))
+	auth := NewAuth(users, edit_nets, anonymous, client_ip)
+	var moderation *ModerationQueue
+	if *accept_proposals {
+		if moderation, err = NewModerationQueue(db); err != nil {
+			log.Fatal(err)
+		}
+	}
+	AddHandlers(mux, store, templates, *imageDir, NewAssets("static", *staticResource),
+		auth, moderation, categories, *site_name)
+	prometheus.MustRegister(NewInventoryCollector(store, *imageDir))
+	mux.Handle("/metrics", promhttp.Handler())
+
+	middlewares := []Middleware{WithRequestId, auth.RememberUser}
+	if *log_requests {
+		middlewares = append(middlewares, LogRequests(client_ip))
 	}
+	middlewares = append(middlewares, RecoverPanics, TimeRequests, Compress)
+	handler := Chain(InstrumentMux(mux), middlewares...)
 
-	var block_forever chan bool
-	<-block_forever
+	server := NewServer(*bindAddress, handler, ServerTimeouts{
+		Read:  *read_timeout,
+		Write: *write_timeout,
+		Idle:  *idle_timeout,
+	})
+	RunServer(server, *ssl_cert, *ssl_key, *shutdown_timeout)
+	// Deferred: store and database are closed cleanly.
 }
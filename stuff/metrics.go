@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Application level metrics, exported on /metrics next to the Go runtime
+// metrics: HTTP requests per route and the time spent in the StuffStore.
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stuff_http_requests_total",
+		Help: "Number of HTTP requests by route and status code.",
+	}, []string{"route", "code", "method"})
+	httpLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stuff_http_request_duration_seconds",
+		Help:    "Time to answer HTTP requests by route.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 4, 8), // 500µs..8s
+	}, []string{"route", "code", "method"})
+
+	storeLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stuff_store_operation_duration_seconds",
+		Help:    "Time spent in StuffStore operations.",
+		Buckets: prometheus.ExponentialBuckets(0.00005, 4, 8), // 50µs..0.8s
+	}, []string{"operation"})
+	storeEdits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stuff_store_edits_total",
+		Help: "Number of record edits; result is 'saved' or 'unchanged'.",
+	}, []string{"result"})
+	storeSetOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stuff_store_set_operations_total",
+		Help: "Number of equivalence set changes.",
+	}, []string{"operation"})
+)
+
+// Wraps a ServeMux and records requests by the pattern the mux
+// dispatches them to. Using the pattern instead of the URL keeps the
+// number of label values bounded.
+type instrumentedMux struct {
+	mux      *http.ServeMux
+	lock     sync.Mutex
+	handlers map[string]http.Handler // Instrumented handler per route and method.
+}
+
+// Label value for the request method. Anything that is not a standard
+// method is counted as "other", clients can send whatever they like.
+func methodLabel(method string) string {
+	switch method = strings.ToLower(method); method {
+	case "get", "head", "post", "put", "patch", "delete", "connect", "options", "trace":
+		return method
+	}
+	return "other"
+}
+
+func InstrumentMux(mux *http.ServeMux) http.Handler {
+	return &instrumentedMux{
+		mux:      mux,
+		handlers: make(map[string]http.Handler),
+	}
+}
+
+func (m *instrumentedMux) ServeHTTP(out http.ResponseWriter, r *http.Request) {
+	_, route := m.mux.Handler(r)
+	if route == "" {
+		route = "unknown"
+	}
+	method := methodLabel(r.Method)
+	m.lock.Lock()
+	handler, found := m.handlers[route+" "+method]
+	if !found {
+		// With the method curried, promhttp only fills in the code.
+		labels := prometheus.Labels{"route": route, "method": method}
+		handler = promhttp.InstrumentHandlerDuration(
+			httpLatency.MustCurryWith(labels),
+			promhttp.InstrumentHandlerCounter(
+				httpRequests.MustCurryWith(labels), m.mux))
+		m.handlers[route+" "+method] = handler
+	}
+	m.lock.Unlock()
+	handler.ServeHTTP(out, r)
+}
+
+// StuffStore decorator recording latency and counts of operations.
+type InstrumentedStore struct {
+	store StuffStore
+}
+
+func NewInstrumentedStore(store StuffStore) *InstrumentedStore {
+	return &InstrumentedStore{store: store}
+}
+
+func observeStoreOperation(operation string, start time.Time) {
+	storeLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func (s *InstrumentedStore) FindById(id int) *Component {
+	defer observeStoreOperation("find_by_id", time.Now())
+	return s.store.FindById(id)
+}
+
+func (s *InstrumentedStore) EditRecord(editor Editor, id int, updater ModifyFun) (bool, string) {
+	defer observeStoreOperation("edit_record", time.Now())
+	saved, msg := s.store.EditRecord(editor, id, updater)
+	if saved {
+		storeEdits.WithLabelValues("saved").Inc()
+	} else {
+		storeEdits.WithLabelValues("unchanged").Inc()
+	}
+	return saved, msg
+}
+
+func (s *InstrumentedStore) JoinSet(editor Editor, id int, equiv_set int) {
+	defer observeStoreOperation("join_set", time.Now())
+	storeSetOperations.WithLabelValues("join").Inc()
+	s.store.JoinSet(editor, id, equiv_set)
+}
+
+func (s *InstrumentedStore) LeaveSet(editor Editor, id int) {
+	defer observeStoreOperation("leave_set", time.Now())
+	storeSetOperations.WithLabelValues("leave").Inc()
+	s.store.LeaveSet(editor, id)
+}
+
+func (s *InstrumentedStore) MatchingEquivSetForComponent(component int) []*Component {
+	defer observeStoreOperation("matching_equiv_set", time.Now())
+	return s.store.MatchingEquivSetForComponent(component)
+}
+
+func (s *InstrumentedStore) SetMembers(equiv_set int) []*Component {
+	defer observeStoreOperation("set_members", time.Now())
+	return s.store.SetMembers(equiv_set)
+}
+
+func (s *InstrumentedStore) Search(search_term string, limit int) *SearchResult {
+	defer observeStoreOperation("search", time.Now())
+	return s.store.Search(search_term, limit)
+}
+
+func (s *InstrumentedStore) IterateAll(callback func(comp *Component) bool) {
+	defer observeStoreOperation("iterate_all", time.Now())
+	s.store.IterateAll(callback)
+}
+
+func (s *InstrumentedStore) EditHistory(filter EditFilter) []*EditHistoryEntry {
+	defer observeStoreOperation("edit_history", time.Now())
+	return s.store.EditHistory(filter)
+}
+
+func (s *InstrumentedStore) Rollback(editor Editor, filter EditFilter, dry_run bool) ([]*RollbackItem, error) {
+	defer observeStoreOperation("rollback", time.Now())
+	return s.store.Rollback(editor, filter, dry_run)
+}
+
+func (s *InstrumentedStore) Close() error {
+	return s.store.Close()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newInstrumentedTestStore(t *testing.T) (*InstrumentedStore, func()) {
+	dbfile, _ := ioutil.TempFile("", "metrics")
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	backend, _ := NewDBBackend(db, true, kSearchEngineMemory, "")
+	return NewInstrumentedStore(backend), func() { syscall.Unlink(dbfile.Name()) }
+}
+
+func TestInstrumentedStore(t *testing.T) {
+	store, cleanup := newInstrumentedTestStore(t)
+	defer cleanup()
+
+	saved := testutil.ToFloat64(storeEdits.WithLabelValues("saved"))
+	unchanged := testutil.ToFloat64(storeEdits.WithLabelValues("unchanged"))
+	joins := testutil.ToFloat64(storeSetOperations.WithLabelValues("join"))
+
+	store.EditRecord(Editor{}, 1, func(c *Component) bool { c.Value = "foo"; return true })
+	store.EditRecord(Editor{}, 2, func(c *Component) bool { c.Value = "bar"; return true })
+	store.EditRecord(Editor{}, 1, func(c *Component) bool { return false })
+	store.JoinSet(Editor{}, 2, 1)
+
+	ExpectTrue(t, testutil.ToFloat64(storeEdits.WithLabelValues("saved")) == saved+2, "saved")
+	ExpectTrue(t, testutil.ToFloat64(storeEdits.WithLabelValues("unchanged")) == unchanged+1, "unchanged")
+	ExpectTrue(t, testutil.ToFloat64(storeSetOperations.WithLabelValues("join")) == joins+1, "join")
+	ExpectTrue(t, store.FindById(2).Equiv_set == 1, "Delegated to backend")
+}
+
+func TestInstrumentMux(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "missing") {
+			http.NotFound(w, r)
+		}
+	})
+	handler := InstrumentMux(mux)
+	ok := httpRequests.WithLabelValues("/api/", "200", "get")
+	notFound := httpRequests.WithLabelValues("/api/", "404", "get")
+	okBefore, notFoundBefore := testutil.ToFloat64(ok), testutil.ToFloat64(notFound)
+
+	for _, path := range []string{"/api/foo", "/api/bar", "/api/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	// Request to the URL, but counted by route pattern.
+	ExpectTrue(t, testutil.ToFloat64(ok) == okBefore+2, "Counted by route")
+	ExpectTrue(t, testutil.ToFloat64(notFound) == notFoundBefore+1, "Counted by status")
+
+	// Made up methods don't create new label values.
+	other := httpRequests.WithLabelValues("/api/", "200", "other")
+	otherBefore := testutil.ToFloat64(other)
+	for _, method := range []string{"FOO", "Bar", "xyzzy"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/api/foo", nil))
+	}
+	ExpectTrue(t, testutil.ToFloat64(other) == otherBefore+3, "Counted as other")
+	families, _ := prometheus.DefaultGatherer.Gather()
+	for _, family := range families {
+		if family.GetName() != "stuff_http_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "method" {
+					ExpectTrue(t, label.GetValue() != "foo" && label.GetValue() != "xyzzy", label.GetValue())
+				}
+			}
+		}
+	}
+}
+
+func TestInventoryCollector(t *testing.T) {
+	store, cleanup := newInstrumentedTestStore(t)
+	defer cleanup()
+	imgdir, _ := ioutil.TempDir("", "metrics-img")
+	defer os.RemoveAll(imgdir)
+	ioutil.WriteFile(imgdir+"/2.jpg", []byte("jpeg"), 0644)
+
+	store.EditRecord(Editor{}, 1, func(c *Component) bool {
+		c.Category = "Resistor"
+		c.Value = "10k"
+		return true
+	})
+	store.EditRecord(Editor{}, 2, func(c *Component) bool {
+		c.Category = "Resistor"
+		return true
+	})
+	store.EditRecord(Editor{}, 3, func(c *Component) bool {
+		c.Category = "Mystery"
+		return true
+	})
+
+	expected := `
+# HELP stuff_inventory_components Number of components by category.
+# TYPE stuff_inventory_components gauge
+stuff_inventory_components{category="Mystery"} 1
+stuff_inventory_components{category="Resistor"} 2
+# HELP stuff_inventory_components_by_image Number of components with and without a photo.
+# TYPE stuff_inventory_components_by_image gauge
+stuff_inventory_components_by_image{has_image="false"} 2
+stuff_inventory_components_by_image{has_image="true"} 1
+# HELP stuff_inventory_components_by_status Number of components by completeness of their data, as shown on the status page.
+# TYPE stuff_inventory_components_by_status gauge
+stuff_inventory_components_by_status{status="good"} 1
+stuff_inventory_components_by_status{status="mystery"} 1
+stuff_inventory_components_by_status{status="poor"} 1
+`
+	err := testutil.CollectAndCompare(NewInventoryCollector(store, imgdir),
+		strings.NewReader(expected))
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// Things done for every request, independent of the handler serving it.
+type Middleware func(http.Handler) http.Handler
+
+var wantTimings = flag.Bool("want-timings", false, "Print processing timings.")
+
+// Wraps handler in the middlewares; the first one sees the request first.
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Remembers what the handler sent, for logging.
+type statusWriter struct {
+	http.ResponseWriter
+	status int // 0 while nothing is written.
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	flushResponse(w.ResponseWriter)
+}
+
+func (w *statusWriter) Push(target string, opts *http.PushOptions) error {
+	return pushResource(w.ResponseWriter, target, opts)
+}
+
+// Wrapped writers pass on streaming and HTTP/2 push if the writer they
+// wrap can do it.
+func flushResponse(out http.ResponseWriter) {
+	if flusher, ok := out.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func pushResource(out http.ResponseWriter, target string, opts *http.PushOptions) error {
+	if pusher, ok := out.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+type requestIdKey struct{}
+
+var requestCounter uint64
+var requestIdPrefix = func() string {
+	token, _ := randomToken()
+	return token[:6]
+}()
+
+// Every request gets an ID, sent back in the X-Request-Id header, so that
+// a problem a user reports can be found in the log.
+func WithRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		id := fmt.Sprintf("%s-%d", requestIdPrefix, atomic.AddUint64(&requestCounter, 1))
+		out.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(out, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+// ID of the request; "-" if it has none.
+func RequestId(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIdKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// Log each request with the client it came from and what we answered.
+func LogRequests(clientIP *ClientIPResolver) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusWriter{ResponseWriter: out}
+			next.ServeHTTP(recorder, r)
+			log.Printf("REQUEST %s %s %s %s %d %d %s", RequestId(r),
+				clientIP.ClientAddress(r), r.Method, r.URL.RequestURI(),
+				recorder.status, recorder.bytes, time.Since(start))
+		})
+	}
+}
+
+// A bug in one handler should not take down the whole server; log it and
+// answer with an internal server error if nothing has been sent yet.
+func RecoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		recorder := &statusWriter{ResponseWriter: out}
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err) // Deliberately aborted.
+				}
+				log.Printf("PANIC in request %s %s: %v\n%s",
+					RequestId(r), r.URL.RequestURI(), err, debug.Stack())
+				if recorder.status == 0 {
+					http.Error(recorder, "Internal error; request "+RequestId(r),
+						http.StatusInternalServerError)
+				}
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// With -want-timings, log how long each request took. Browsers get it in
+// the Server-Timing header in any case.
+func TimeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(&timingWriter{ResponseWriter: out, start: start}, r)
+		if *wantTimings {
+			log.Printf("%s %s took %s", r.Method, r.URL.Path, time.Since(start))
+		}
+	})
+}
+
+// Adds the Server-Timing header just before the response starts.
+type timingWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	wroteHeader bool
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Server-Timing",
+			fmt.Sprintf("app;dur=%.1f", float64(time.Since(w.start))/float64(time.Millisecond)))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *timingWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	flushResponse(w.ResponseWriter)
+}
+
+func (w *timingWriter) Push(target string, opts *http.PushOptions) error {
+	return pushResource(w.ResponseWriter, target, opts)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(out, r)
+			})
+		}
+	}
+	handler := Chain(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), tag("first"), tag("second"))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expectEqual(t, strings.Join(order, ","), "first,second,handler")
+}
+
+func TestRequestIdAndLogging(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var seen_id string
+	handler := Chain(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		seen_id = RequestId(r)
+		http.Error(out, "nope", http.StatusTeapot)
+	}), WithRequestId, LogRequests(nil))
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, httptest.NewRequest("GET", "/search?q=foo", nil))
+	ExpectTrue(t, seen_id != "-" && seen_id != "", "Has request id")
+	expectEqual(t, out.Header().Get("X-Request-Id"), seen_id)
+	ExpectTrue(t, strings.Contains(logged.String(), "REQUEST "+seen_id+" 192.0.2.1 GET /search?q=foo 418 5 "), logged.String())
+
+	first_id := seen_id
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	ExpectTrue(t, seen_id != first_id, "Unique id")
+	expectEqual(t, RequestId(httptest.NewRequest("GET", "/", nil)), "-")
+}
+
+func TestRecoverPanics(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	handler := Chain(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		var c *Component
+		out.Header().Set("X-Some", "thing")
+		_ = c.Value // Oops.
+	}), WithRequestId, RecoverPanics)
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, httptest.NewRequest("GET", "/form", nil))
+	expectEqualInt(t, out.Code, http.StatusInternalServerError)
+	ExpectTrue(t, strings.Contains(out.Body.String(), out.Header().Get("X-Request-Id")), "Tells request id")
+	ExpectTrue(t, strings.Contains(logged.String(), "PANIC in request"), "Logged")
+	ExpectTrue(t, strings.Contains(logged.String(), "middleware_test.go"), "With stack")
+
+	// Once the response started, all we can do is log.
+	handler = RecoverPanics(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		out.Write([]byte("half a page"))
+		panic("too late")
+	}))
+	out = httptest.NewRecorder()
+	handler.ServeHTTP(out, httptest.NewRequest("GET", "/form", nil))
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqual(t, out.Body.String(), "half a page")
+}
+
+func TestTimeRequests(t *testing.T) {
+	handler := TimeRequests(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		out.Write([]byte("hello"))
+	}))
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, httptest.NewRequest("GET", "/", nil))
+	ExpectTrue(t, strings.HasPrefix(out.Header().Get("Server-Timing"), "app;dur="), out.Header().Get("Server-Timing"))
+}
+
+// Recorder that can push and remembers what and if it flushed.
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (p *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	p.pushed = append(p.pushed, target)
+	return nil
+}
+
+func TestWrappersForwardPushAndFlush(t *testing.T) {
+	handler := Chain(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		pusher, ok := out.(http.Pusher)
+		ExpectTrue(t, ok, "Pusher lost in the middlewares")
+		ExpectTrue(t, pusher.Push("/img/1", nil) == nil, "push failed")
+		out.Header().Set("Content-Type", "text/plain")
+		out.Write([]byte("hello"))
+		out.(http.Flusher).Flush()
+	}), RecoverPanics, TimeRequests, Compress)
+
+	out := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(out, r)
+	expectEqual(t, strings.Join(out.pushed, ","), "/img/1")
+	ExpectTrue(t, out.Flushed, "flush did not reach the connection")
+
+	// Without a pusher underneath, it is just not supported.
+	handler = Chain(http.HandlerFunc(func(out http.ResponseWriter, r *http.Request) {
+		err := out.(http.Pusher).Push("/img/1", nil)
+		ExpectTrue(t, err == http.ErrNotSupported, "expected ErrNotSupported")
+	}), RecoverPanics, TimeRequests, Compress)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const kModerationPage = "/moderation"
+
+type ModerationHandler struct {
+	store      StuffStore
+	moderation *ModerationQueue
+	auth       *Auth
+	template   *TemplateRenderer
+}
+
+func AddModerationHandler(mux Router, store StuffStore, moderation *ModerationQueue, auth *Auth, template *TemplateRenderer) {
+	handler := &ModerationHandler{
+		store:      store,
+		moderation: moderation,
+		auth:       auth,
+		template:   template,
+	}
+	mux.Handle(kModerationPage, handler)
+}
+
+type ModerationItem struct {
+	*PendingChange
+	Current *Component // nil if proposal for new component.
+	Changes []FieldChange
+}
+
+type ModerationPage struct {
+	Items     []ModerationItem
+	Msg       string
+	CsrfToken string
+}
+
+func (h *ModerationHandler) ServeHTTP(out http.ResponseWriter, r *http.Request) {
+	if !h.auth.CanEdit(r) {
+		http.Error(out, "Only editors can review changes", http.StatusForbidden)
+		return
+	}
+	page := &ModerationPage{CsrfToken: csrfToken(out, r)}
+	if r.Method == "POST" {
+		if !csrfValid(r) {
+			http.Error(out, "Invalid CSRF token; reload page", http.StatusForbidden)
+			return
+		}
+		page.Msg = h.resolve(r)
+	}
+	for _, p := range h.moderation.Pending() {
+		current := h.store.FindById(p.ComponentId)
+		page.Items = append(page.Items, ModerationItem{
+			PendingChange: p,
+			Current:       current,
+			Changes:       p.Changes(current),
+		})
+	}
+	h.template.Render(out, "moderation.html", page)
+}
+
+// Approve or reject; returns message for the user.
+func (h *ModerationHandler) resolve(r *http.Request) string {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	p := h.moderation.Find(id)
+	if p == nil {
+		return fmt.Sprintf("No change %d", id)
+	}
+	editor := h.auth.Editor(r)
+	var err error
+	var status string
+	switch r.FormValue("op") {
+	case "approve":
+		status = kChangeApproved
+		err = h.moderation.Approve(h.store, id, editor)
+	case "reject":
+		status = kChangeRejected
+		err = h.moderation.Resolve(id, kChangeRejected, editor)
+	default:
+		return "Unknown operation"
+	}
+	if err != nil {
+		return fmt.Sprintf("Change %d: %s", id, err)
+	}
+	log.Printf("MODERATION %s by %s: change %d to item %d proposed by %s",
+		status, editor, id, p.ComponentId, p.ProposedBy)
+	return fmt.Sprintf("Change %d to item %d: %s", id, p.ComponentId, status)
+}
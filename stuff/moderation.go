@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Changes proposed by people who are not allowed to edit. They wait in
+// the queue until an editor approves or rejects them.
+//
+// With each proposal, we keep the record as it was when the change was
+// made. So we know which fields the proposer actually changed, and only
+// these are applied on approval, even if the record was edited in the
+// meantime.
+var moderation_schema string = `
+create table if not exists pending_change (
+       id            integer constraint pk_pending_change primary key,
+       component_id  int not null,
+       base          text,           -- JSON of record when proposed; null if new
+       proposed      text not null,  -- JSON of proposed record
+       proposed_by   text,
+       created       timestamp,
+       status        text not null,  -- pending, approved or rejected
+       resolved_by   text,
+       resolved      timestamp
+);
+create index if not exists pending_change_status on pending_change(status);
+`
+
+const (
+	kChangePending  = "pending"
+	kChangeApproved = "approved"
+	kChangeRejected = "rejected"
+)
+
+type PendingChange struct {
+	Id          int
+	ComponentId int
+	Base        Component // Empty component if it did not exist.
+	Proposed    Component
+	ProposedBy  string
+	Created     time.Time
+	Status      string
+}
+
+// A field of a component that differs between two versions.
+type FieldChange struct {
+	Field    string
+	Old      string
+	New      string
+	Conflict bool // Changed by someone else since proposal.
+}
+
+// The fields people can edit, in the order shown in the form.
+var componentFields = []struct {
+	Name string
+	get  func(c *Component) string
+	set  func(c *Component, v string)
+}{
+	{"Category",
+		func(c *Component) string { return c.Category },
+		func(c *Component, v string) { c.Category = v }},
+	{"Value",
+		func(c *Component) string { return c.Value },
+		func(c *Component, v string) { c.Value = v }},
+	{"Footprint",
+		func(c *Component) string { return c.Footprint },
+		func(c *Component, v string) { c.Footprint = v }},
+	{"Quantity",
+		func(c *Component) string { return c.Quantity },
+		func(c *Component, v string) { c.Quantity = v }},
+	{"Description",
+		func(c *Component) string { return c.Description },
+		func(c *Component, v string) { c.Description = v }},
+	{"Notes",
+		func(c *Component) string { return c.Notes },
+		func(c *Component, v string) { c.Notes = v }},
+	{"Datasheet",
+		func(c *Component) string { return c.Datasheet_url },
+		func(c *Component, v string) { c.Datasheet_url = v }},
+	{"Drawersize",
+		func(c *Component) string { return strconv.Itoa(c.Drawersize) },
+		func(c *Component, v string) { c.Drawersize, _ = strconv.Atoi(v) }},
+}
+
+// What the proposal changes, compared to the current record (nil if it
+// does not exist).
+func (p *PendingChange) Changes(current *Component) []FieldChange {
+	if current == nil {
+		current = &Component{Id: p.ComponentId}
+	}
+	var result []FieldChange
+	for _, f := range componentFields {
+		base, proposed := f.get(&p.Base), f.get(&p.Proposed)
+		if base == proposed {
+			continue // Not touched by proposer.
+		}
+		result = append(result, FieldChange{
+			Field:    f.Name,
+			Old:      f.get(current),
+			New:      proposed,
+			Conflict: f.get(current) != base,
+		})
+	}
+	return result
+}
+
+// Apply the proposed change to the component. Returns false if there is
+// nothing to change.
+func (p *PendingChange) Apply(c *Component) bool {
+	changed := false
+	for _, f := range componentFields {
+		if proposed := f.get(&p.Proposed); f.get(&p.Base) != proposed && f.get(c) != proposed {
+			f.set(c, proposed)
+			changed = true
+		}
+	}
+	return changed
+}
+
+type ModerationQueue struct {
+	db *sql.DB
+}
+
+func NewModerationQueue(db *sql.DB) (*ModerationQueue, error) {
+	if _, err := db.Exec(moderation_schema); err != nil {
+		return nil, err
+	}
+	return &ModerationQueue{db: db}, nil
+}
+
+// Queue proposed change to a component; base is the record the proposal
+// was made on, nil if it is a new one.
+func (q *ModerationQueue) Propose(editor Editor, base *Component, proposed Component) (int, error) {
+	var base_json sql.NullString
+	if base != nil {
+		b, _ := json.Marshal(base)
+		base_json = sql.NullString{String: string(b), Valid: true}
+	}
+	proposed_json, _ := json.Marshal(proposed)
+	result, err := q.db.Exec("INSERT INTO pending_change (component_id, base, proposed, proposed_by, created, status) VALUES (?1, ?2, ?3, ?4, ?5, ?6)",
+		proposed.Id, base_json, string(proposed_json), editor.String(), time.Now(), kChangePending)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+const pendingChangeColumns = "id, component_id, base, proposed, proposed_by, created, status"
+
+func scanPendingChange(scanner interface{ Scan(...interface{}) error }) (*PendingChange, error) {
+	p := &PendingChange{}
+	var base sql.NullString
+	var proposed string
+	var proposed_by sql.NullString
+	err := scanner.Scan(&p.Id, &p.ComponentId, &base, &proposed, &proposed_by, &p.Created, &p.Status)
+	if err != nil {
+		return nil, err
+	}
+	p.Base = Component{Id: p.ComponentId}
+	if base.Valid {
+		json.Unmarshal([]byte(base.String), &p.Base)
+	}
+	json.Unmarshal([]byte(proposed), &p.Proposed)
+	p.ProposedBy = proposed_by.String
+	return p, nil
+}
+
+// Returns the change with the given id or nil.
+func (q *ModerationQueue) Find(id int) *PendingChange {
+	row := q.db.QueryRow("SELECT "+pendingChangeColumns+" FROM pending_change WHERE id = ?1", id)
+	p, err := scanPendingChange(row)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+// All changes waiting for review, oldest first.
+func (q *ModerationQueue) Pending() []*PendingChange {
+	result := make([]*PendingChange, 0, 10)
+	rows, err := q.db.Query("SELECT "+pendingChangeColumns+" FROM pending_change WHERE status = ?1 ORDER BY id", kChangePending)
+	if err != nil {
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if p, err := scanPendingChange(rows); err == nil {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func (q *ModerationQueue) PendingCount() int {
+	var count int
+	q.db.QueryRow("SELECT count(*) FROM pending_change WHERE status = ?1", kChangePending).Scan(&count)
+	return count
+}
+
+// Mark a pending change as approved or rejected.
+func (q *ModerationQueue) Resolve(id int, status string, editor Editor) error {
+	result, err := q.db.Exec("UPDATE pending_change SET status = ?2, resolved_by = ?3, resolved = ?4 WHERE id = ?1 AND status = ?5",
+		id, status, editor.String(), time.Now(), kChangePending)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		return errors.New("No such pending change")
+	}
+	return nil
+}
+
+// Apply the change to the store and mark it approved. If the edit fails,
+// the change stays pending.
+func (q *ModerationQueue) Approve(store StuffStore, id int, editor Editor) error {
+	p := q.Find(id)
+	if p == nil || p.Status != kChangePending {
+		return errors.New("No such pending change")
+	}
+	nothing_to_apply := false
+	stored, msg := store.EditRecord(editor, p.ComponentId, func(c *Component) bool {
+		nothing_to_apply = !p.Apply(c)
+		return !nothing_to_apply
+	})
+	if !stored && !nothing_to_apply {
+		return errors.New(msg)
+	}
+	return q.Resolve(id, kChangeApproved, editor)
+}
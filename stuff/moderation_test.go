@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func newModerationTestStore(t *testing.T) (StuffStore, *ModerationQueue, func()) {
+	dbfile, _ := ioutil.TempFile("", "moderation")
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, _ := NewDBBackend(db, true, kSearchEngineMemory, "")
+	queue, err := NewModerationQueue(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, queue, func() { syscall.Unlink(dbfile.Name()) }
+}
+
+func TestModerationChangesAgainstCurrent(t *testing.T) {
+	store, queue, cleanup := newModerationTestStore(t)
+	defer cleanup()
+	store.EditRecord(Editor{}, 1, func(c *Component) bool {
+		c.Category = "Resistor"
+		c.Value = "10k"
+		c.Description = "1/4W"
+		return true
+	})
+	proposed := *store.FindById(1)
+	proposed.Value = "100k"
+	proposed.Footprint = "0805"
+	id, err := queue.Propose(Editor{Address: "192.0.2.7"}, store.FindById(1), proposed)
+	ExpectTrue(t, err == nil, "propose")
+
+	// Meanwhile, an editor changes the description and the footprint.
+	store.EditRecord(Editor{}, 1, func(c *Component) bool {
+		c.Description = "1/8W"
+		c.Footprint = "1206"
+		return true
+	})
+
+	p := queue.Find(id)
+	ExpectTrue(t, p != nil && p.Status == kChangePending, "pending")
+	expectEqual(t, p.ProposedBy, "192.0.2.7")
+	changes := p.Changes(store.FindById(1))
+	expectEqualInt(t, len(changes), 2) // Only what the proposer changed.
+	expectEqual(t, changes[0].Field, "Value")
+	expectEqual(t, changes[0].Old, "10k")
+	expectEqual(t, changes[0].New, "100k")
+	ExpectTrue(t, !changes[0].Conflict, "value not edited since")
+	expectEqual(t, changes[1].Field, "Footprint")
+	ExpectTrue(t, changes[1].Conflict, "footprint edited since")
+
+	ExpectTrue(t, queue.Approve(store, id, Editor{User: "alice"}) == nil, "approve")
+	c := store.FindById(1)
+	expectEqual(t, c.Value, "100k")
+	expectEqual(t, c.Footprint, "0805")
+	expectEqual(t, c.Description, "1/8W") // Later edit is kept.
+	expectEqual(t, queue.Find(id).Status, kChangeApproved)
+	ExpectTrue(t, queue.Approve(store, id, Editor{User: "alice"}) != nil, "only once")
+	expectEqualInt(t, queue.PendingCount(), 0)
+}
+
+func TestModerationNewComponentAndReject(t *testing.T) {
+	store, queue, cleanup := newModerationTestStore(t)
+	defer cleanup()
+	new_id, _ := queue.Propose(Editor{}, nil, Component{Id: 5, Value: "NE555"})
+	bogus_id, _ := queue.Propose(Editor{}, nil, Component{Id: 6, Value: "spam"})
+	expectEqualInt(t, len(queue.Pending()), 2)
+
+	changes := queue.Find(new_id).Changes(nil)
+	expectEqualInt(t, len(changes), 1)
+	expectEqual(t, changes[0].Old, "")
+
+	ExpectTrue(t, queue.Resolve(bogus_id, kChangeRejected, Editor{User: "alice"}) == nil, "reject")
+	ExpectTrue(t, queue.Approve(store, bogus_id, Editor{User: "alice"}) != nil, "rejected is final")
+	ExpectTrue(t, queue.Approve(store, new_id, Editor{User: "alice"}) == nil, "approve")
+	expectEqual(t, store.FindById(5).Value, "NE555")
+	ExpectTrue(t, store.FindById(6) == nil, "rejected not stored")
+	expectEqualInt(t, len(queue.Pending()), 0)
+}
+
+func TestModerationWorkflow(t *testing.T) {
+	store, queue, cleanup := newModerationTestStore(t)
+	defer cleanup()
+	store.EditRecord(Editor{}, 1, func(c *Component) bool {
+		c.Category = "Resistor"
+		c.Value = "10k"
+		return true
+	})
+	_, hackerspace, _ := net.ParseCIDR("10.0.0.0/8")
+	auth := NewAuth(nil, []*net.IPNet{hackerspace}, RoleEditor, nil)
+	templates := NewTemplateRenderer("template", false)
+	form := &FormHandler{store: store, template: templates, auth: auth, moderation: queue}
+	moderation := &ModerationHandler{store: store, moderation: queue, auth: auth, template: templates}
+
+	post := func(h http.Handler, from string, path string, values url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = from + ":1234"
+		addCsrfToken(r)
+		out := httptest.NewRecorder()
+		h.ServeHTTP(out, r)
+		return out
+	}
+	edit := url.Values{"edit_id": {"1"}, "id": {"1"}, "value": {"22k"},
+		"category_select": {"Resistor"}}
+
+	// The public proposes, nothing is changed yet.
+	out := post(form, "192.0.2.1", "/form", edit)
+	ExpectTrue(t, strings.Contains(out.Body.String(), "will be reviewed"), "proposal message")
+	expectEqual(t, store.FindById(1).Value, "10k")
+	expectEqualInt(t, queue.PendingCount(), 1)
+	proposal := queue.Pending()[0]
+
+	// Only editors see the moderation page.
+	out = httptest.NewRecorder()
+	moderation.ServeHTTP(out, httptest.NewRequest("GET", kModerationPage, nil))
+	expectEqualInt(t, out.Code, http.StatusForbidden)
+	r := httptest.NewRequest("GET", kModerationPage, nil)
+	r.RemoteAddr = "10.1.1.1:1234"
+	out = httptest.NewRecorder()
+	moderation.ServeHTTP(out, r)
+	expectEqualInt(t, out.Code, http.StatusOK)
+	ExpectTrue(t, strings.Contains(out.Body.String(), "22k"), "diff shown")
+
+	// Edit, then approve.
+	r = httptest.NewRequest("GET", "/form?id=1&proposal="+strconv.Itoa(proposal.Id), nil)
+	r.RemoteAddr = "10.1.1.1:1234"
+	out = httptest.NewRecorder()
+	form.ServeHTTP(out, r)
+	ExpectTrue(t, strings.Contains(out.Body.String(), `value="22k"`), "proposal in form")
+
+	edit.Set("value", "22k 1%")
+	edit.Set("proposal", strconv.Itoa(proposal.Id))
+	post(form, "10.1.1.1", "/form", edit)
+	expectEqual(t, store.FindById(1).Value, "22k 1%")
+	expectEqual(t, queue.Find(proposal.Id).Status, kChangeApproved)
+
+	// Reject via moderation page.
+	edit.Del("proposal")
+	edit.Set("value", "spam")
+	post(form, "192.0.2.1", "/form", edit)
+	spam := queue.Pending()[0]
+	out = post(moderation, "10.1.1.1", kModerationPage, url.Values{"op": {"reject"}, "id": {strconv.Itoa(spam.Id)}})
+	ExpectTrue(t, strings.Contains(out.Body.String(), "item 1: rejected"), "reject message")
+	expectEqual(t, queue.Find(spam.Id).Status, kChangeRejected)
+	expectEqual(t, store.FindById(1).Value, "22k 1%")
+
+	// A proposal can only be approved with the item it is for.
+	edit.Set("value", "4k7")
+	post(form, "192.0.2.1", "/form", edit)
+	other := queue.Pending()[0]
+	edit = url.Values{"edit_id": {"2"}, "id": {"2"}, "value": {"4k7"},
+		"category_select": {"Resistor"}, "proposal": {strconv.Itoa(other.Id)}}
+	out = post(form, "10.1.1.1", "/form", edit)
+	ExpectTrue(t, strings.Contains(out.Body.String(), "not pending for it"), "mismatch message")
+	ExpectTrue(t, store.FindById(2) == nil, "mismatch not stored")
+	expectEqual(t, queue.Find(other.Id).Status, kChangePending)
+}
+
+func TestModerationApproveFailedEditStaysPending(t *testing.T) {
+	store, queue, cleanup := newModerationTestStore(t)
+	defer cleanup()
+	store.EditRecord(Editor{}, 1, func(c *Component) bool {
+		c.Value = "10k"
+		return true
+	})
+	id, _ := queue.Propose(Editor{}, store.FindById(1), Component{Id: 1, Value: "22k"})
+	queue.db.Exec("DROP TABLE component") // Every edit fails from now on.
+	ExpectTrue(t, queue.Approve(store, id, Editor{User: "alice"}) != nil, "edit failed")
+	expectEqual(t, queue.Find(id).Status, kChangePending)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Check that what the JSON endpoints return matches what we promise in
+// static/openapi.json. Only the subset of JSON schema used there is
+// implemented.
+
+type specValidator struct {
+	schemas map[string]interface{}
+}
+
+func (v *specValidator) validate(where string, schema map[string]interface{}, value interface{}) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		resolved, ok := v.schemas[name].(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: unknown schema %s", where, ref)}
+		}
+		return v.validate(where, resolved, value)
+	}
+	var errors []string
+	fail := func(format string, args ...interface{}) []string {
+		return append(errors, where+": "+fmt.Sprintf(format, args...))
+	}
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fail("expected object, got %T", value)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, found := object[name.(string)]; !found {
+				errors = fail("missing required '%s'", name)
+			}
+		}
+		for name, field := range object {
+			property, found := properties[name].(map[string]interface{})
+			if !found {
+				if schema["additionalProperties"] == false {
+					errors = fail("'%s' not in spec", name)
+				}
+				continue
+			}
+			errors = append(errors, v.validate(where+"."+name, property, field)...)
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fail("expected array, got %T", value)
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range array {
+			errors = append(errors, v.validate(fmt.Sprintf("%s[%d]", where, i), items, item)...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fail("expected string, got %T", value)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fail("not a date-time: %s", str)
+			}
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return fail("expected integer, got %v", value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fail("expected boolean, got %T", value)
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		for _, allowed := range enum {
+			if allowed == value {
+				return errors
+			}
+		}
+		return fail("%v not in %v", value, enum)
+	}
+	return errors
+}
+
+type openApiCase struct {
+	method string
+	path   string // As in the spec.
+	url    string
+	body   string
+	status int
+}
+
+func TestOpenApiSpecMatchesResponses(t *testing.T) {
+	content, err := ioutil.ReadFile("static/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(content, &spec); err != nil {
+		t.Fatalf("openapi.json: %s", err)
+	}
+	paths := spec["paths"].(map[string]interface{})
+	validator := &specValidator{
+		schemas: spec["components"].(map[string]interface{})["schemas"].(map[string]interface{}),
+	}
+
+	dbfile, _ := ioutil.TempFile("", "openapi")
+	defer syscall.Unlink(dbfile.Name())
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	imgdir, _ := ioutil.TempDir("", "openapi-img")
+	defer os.RemoveAll(imgdir)
+	store, _ := NewDBBackend(db, true, kSearchEngineMemory, "")
+	templates := NewTemplateRenderer("template", false)
+
+	categories, err := NewCategoryStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moderation, err := NewModerationQueue(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The routes exactly as the server has them.
+	mux := &routeRecorder{ServeMux: http.NewServeMux()}
+	AddHandlers(mux, store, templates, imgdir, NewAssets("static", ""),
+		NewAuth(nil, nil, RoleEditor, nil), moderation, categories, "")
+
+	cases := []openApiCase{
+		{"POST", "/api/v1/components", "/api/v1/components",
+			`{"id":1, "category":"Resistor", "value":"10k", "quantity":"5", "footprint":"0805"}`, 201},
+		{"POST", "/api/v1/components", "/api/v1/components",
+			`{"id":2, "category":"Resistor", "value":"10k", "notes":"n", "drawersize":2}`, 201},
+		{"POST", "/api/v1/components", "/api/v1/components", `{"id":1, "value":"x"}`, 409},
+		{"POST", "/api/v1/components", "/api/v1/components", `{"bogus":1}`, 400},
+		{"GET", "/api/v1/components", "/api/v1/components?limit=5", "", 200},
+		{"GET", "/api/v1/components", "/api/v1/components?limit=x", "", 400},
+		{"GET", "/api/v1/components/{id}", "/api/v1/components/1", "", 200},
+		{"GET", "/api/v1/components/{id}", "/api/v1/components/7", "", 404},
+		{"PUT", "/api/v1/components/{id}", "/api/v1/components/3",
+			`{"category":"Resistor", "value":"22k", "datasheet_url":"http://example.com/"}`, 201},
+		{"PUT", "/api/v1/components/{id}", "/api/v1/components/3",
+			`{"category":"Resistor", "value":"22k"}`, 200},
+		{"PUT", "/api/v1/components/{id}", "/api/v1/components/3", `{"id":4}`, 400},
+		{"PATCH", "/api/v1/components/{id}", "/api/v1/components/3", `{"quantity":"7"}`, 200},
+		{"PATCH", "/api/v1/components/{id}", "/api/v1/components/3", `{"equiv_set":1}`, 400},
+		{"PATCH", "/api/v1/components/{id}", "/api/v1/components/9", `{"quantity":"7"}`, 404},
+		{"PUT", "/api/v1/sets/{set}/members/{id}", "/api/v1/sets/1/members/2", "", 200},
+		{"PUT", "/api/v1/sets/{set}/members/{id}", "/api/v1/sets/9/members/2", "", 404},
+		{"GET", "/api/v1/sets/{set}", "/api/v1/sets/1", "", 200},
+		{"GET", "/api/v1/sets/{set}", "/api/v1/sets/9", "", 404},
+		{"GET", "/api/v1/sets", "/api/v1/sets?component=1", "", 200},
+		{"GET", "/api/v1/sets", "/api/v1/sets", "", 400},
+		{"DELETE", "/api/v1/sets/{set}/members/{id}", "/api/v1/sets/1/members/3", "", 404},
+		{"DELETE", "/api/v1/sets/{set}/members/{id}", "/api/v1/sets/1/members/2", "", 204},
+		{"PUT", "/api/v1/sets/{set}/members/{id}", "/api/v1/sets/1/members/2", "", 200},
+		{"GET", "/api/search", "/api/search?q=resistor", "", 200},
+		{"GET", "/api/search", "/api/search?q=10k&collapse=1", "", 200},
+		{"GET", "/api/search-formatted", "/api/search-formatted?q=resistor", "", 200},
+		{"GET", "/api/search-formatted", "/api/search-formatted?q=10k&collapse=1&expand=3", "", 200},
+		{"GET", "/api/search-formatted", "/api/search-formatted?q=", "", 200},
+		{"GET", "/api/status", "/api/status?offset=0&limit=5", "", 200},
+		{"GET", "/api/info", "/api/info?id=1", "", 200},
+		{"GET", "/api/info", "/api/info?id=42", "", 200},
+		{"GET", "/api/stats/searches", "/api/stats/searches", "", 200},
+	}
+
+	covered := make(map[string]bool)
+	for _, c := range cases {
+		name := fmt.Sprintf("%s %s (%d)", c.method, c.url, c.status)
+		operation, ok := paths[c.path].(map[string]interface{})[strings.ToLower(c.method)].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: %s %s not in spec", name, c.method, c.path)
+			continue
+		}
+		covered[c.method+" "+c.path] = true
+		out := httptest.NewRecorder()
+		mux.ServeHTTP(out, httptest.NewRequest(c.method, c.url, strings.NewReader(c.body)))
+		if out.Code != c.status {
+			t.Errorf("%s: got status %d: %s", name, out.Code, out.Body.String())
+			continue
+		}
+		response, ok := operation["responses"].(map[string]interface{})[fmt.Sprintf("%d", c.status)].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: status not in spec", name)
+			continue
+		}
+		content, hasContent := response["content"].(map[string]interface{})
+		if !hasContent {
+			if out.Body.Len() != 0 {
+				t.Errorf("%s: expected empty body, got %s", name, out.Body.String())
+			}
+			continue
+		}
+		schema := content["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+		var body interface{}
+		if err := json.Unmarshal(out.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: invalid JSON %s", name, err)
+			continue
+		}
+		for _, e := range validator.validate("response", schema, body) {
+			t.Errorf("%s: %s", name, e)
+		}
+	}
+
+	// Every documented operation needs to be checked.
+	var missing []string
+	for path, item := range paths {
+		for method := range item.(map[string]interface{}) {
+			if method == "parameters" {
+				continue
+			}
+			if !covered[strings.ToUpper(method)+" "+path] {
+				missing = append(missing, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	sort.Strings(missing)
+	for _, m := range missing {
+		t.Errorf("%s is in spec, but not tested", m)
+	}
+
+	// Every API we serve needs to be in the spec, with all the methods
+	// it answers.
+	for _, pattern := range mux.patterns {
+		if !strings.HasPrefix(pattern, "/api/") || kUndocumentedApis[pattern] {
+			continue
+		}
+		documented := false
+		for path := range paths {
+			if path == pattern || (strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern)) {
+				documented = true
+			}
+		}
+		if !documented {
+			t.Errorf("%s is served, but not in spec", pattern)
+		}
+	}
+	for path, item := range paths {
+		url := strings.NewReplacer("{id}", "1", "{set}", "1").Replace(path)
+		for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+			if _, found := item.(map[string]interface{})[strings.ToLower(method)]; found {
+				continue
+			}
+			out := httptest.NewRecorder()
+			mux.ServeHTTP(out, httptest.NewRequest(method, url, strings.NewReader("{}")))
+			if out.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s %s is answered with %d, but not in spec", method, path, out.Code)
+			}
+		}
+	}
+}
+
+// Served below /api/, but not for use by others.
+var kUndocumentedApis = map[string]bool{
+	kSetApi:     true, // HTML snippets and set operations of the form page.
+	kApiOpenApi: true, // The spec itself.
+}
+
+// Remembers which patterns the handlers registered.
+type routeRecorder struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func (r *routeRecorder) Handle(pattern string, handler http.Handler) {
+	r.patterns = append(r.patterns, pattern)
+	r.ServeMux.Handle(pattern, handler)
+}
+
+func (r *routeRecorder) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	r.patterns = append(r.patterns, pattern)
+	r.ServeMux.HandleFunc(pattern, handler)
+}
+
+func TestOpenApiValidatorDetectsDrift(t *testing.T) {
+	validator := &specValidator{schemas: map[string]interface{}{}}
+	var schema map[string]interface{}
+	json.Unmarshal([]byte(`{"type":"object", "additionalProperties":false,
+		"required":["a"], "properties":{"a":{"type":"integer"}}}`), &schema)
+	parse := func(s string) interface{} {
+		var v interface{}
+		json.Unmarshal([]byte(s), &v)
+		return v
+	}
+	ExpectTrue(t, len(validator.validate("", schema, parse(`{"a":1}`))) == 0, "valid")
+	ExpectTrue(t, len(validator.validate("", schema, parse(`{"a":1.5}`))) == 1, "type")
+	ExpectTrue(t, len(validator.validate("", schema, parse(`{}`))) == 1, "required")
+	ExpectTrue(t, len(validator.validate("", schema, parse(`{"a":1,"b":2}`))) == 1, "additional")
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Drawings of packages for which there is no hand-drawn package-*.svg.
+// The footprint tells the family and number of pins; from that we know
+// the dimensions and draw the top view with pin 1 marked and the value
+// written on the body.
+
+const kPackageDrawingTemplate = "Package_Drawing.svg"
+
+type leadStyle int
+
+const (
+	kThroughHole leadStyle = iota // Straight pins, e.g. DIP.
+	kGullWing                     // Bent outwards, e.g. SOIC.
+	kJLead                        // Bent under the body, e.g. PLCC.
+	kNoLead                       // Pads at the edge of the body, e.g. QFN.
+)
+
+// Dimensions in mm. The pins are at positions around the body, counted
+// counter-clockwise: with pins on two sides, starting bottom-left; on
+// four sides, starting top-left going down.
+type packageShape struct {
+	sides       int     // Sides with pins: 1, 2 or 4; 0 for chips with end caps.
+	per_side    int     // Positions for pins per side.
+	pitch       float64 // Distance between pins.
+	width       float64 // Body along the pins; left to right.
+	height      float64 // Body across the pins; top to bottom.
+	lead        float64 // How far pins stick out (into for kNoLead).
+	lead_width  float64
+	style       leadStyle
+	positions   []int // Position of each pin; nil: pin i at position first_pin+i.
+	first_pin   int
+	notch       bool    // DIP half circle at the pin 1 end.
+	chamfer     bool    // Corner cut at pin 1 (PLCC).
+	exposed_pad bool    // Thermal pad below the body (QFN).
+	tab_width   float64 // Last pin is a wide tab (SOT-223).
+}
+
+var (
+	packageRegexp  = regexp.MustCompile(`^([A-Z]+)-(\d+)(?:-(\d+))?$`)
+	chipSizeRegexp = regexp.MustCompile(`^(0[24-9]|1[0-9]|2[0-5])(0[1-9]|[1-6][0-9])$`) // 0805, 2512...
+)
+
+// Families we can draw, given the number of pins.
+var kPackageFamilies = map[string]func(pins int) *packageShape{
+	"DIP": func(pins int) *packageShape {
+		if pins < 4 || pins > 64 || pins%2 != 0 {
+			return nil
+		}
+		height := 6.35
+		if pins >= 28 {
+			height = 13.97 // Wide 600mil packages.
+		}
+		return dualRow(pins, 2.54, height, 0.9, 1.2, kThroughHole)
+	},
+	"SIP": func(pins int) *packageShape {
+		if pins < 2 || pins > 40 {
+			return nil
+		}
+		return &packageShape{sides: 1, per_side: pins, pitch: 2.54,
+			width: float64(pins) * 2.54, height: 6, lead: 3, lead_width: 0.6,
+			style: kThroughHole}
+	},
+	"SOIC": func(pins int) *packageShape {
+		if pins < 4 || pins > 32 || pins%2 != 0 {
+			return nil
+		}
+		if pins > 16 {
+			return dualRow(pins, 1.27, 7.5, 1.4, 0.45, kGullWing)
+		}
+		return dualRow(pins, 1.27, 3.9, 1.05, 0.45, kGullWing)
+	},
+	"SSOP":  fineDualRow(5.3, 1.25),
+	"TSSOP": fineDualRow(4.4, 1.0),
+	"MSOP":  fineDualRow(3.0, 0.95),
+	"QFP":   quadRow(0.8, 0.5, 1.0, kGullWing),
+	"TQFP":  quadRow(0.8, 0.5, 1.0, kGullWing),
+	"QFN": func(pins int) *packageShape {
+		shape := quadRow(0.5, 0.5, 0.4, kNoLead)(pins)
+		if shape != nil {
+			shape.exposed_pad = true
+		}
+		return shape
+	},
+	"PLCC": func(pins int) *packageShape {
+		if pins < 20 || pins > 84 || pins%4 != 0 {
+			return nil
+		}
+		per_side := pins / 4
+		size := float64(per_side)*1.27 + 2.5
+		// Pin 1 is in the middle of the top side.
+		return &packageShape{sides: 4, per_side: per_side, pitch: 1.27,
+			width: size, height: size, lead: 0.6, lead_width: 0.5, style: kJLead,
+			first_pin: 3*per_side + per_side/2, chamfer: true}
+	},
+}
+
+// Small outline transistors: the number is the package, not the pins.
+var kSotPackages = map[string]*packageShape{
+	"SOT-23": {sides: 2, per_side: 3, pitch: 0.95, width: 2.9, height: 1.3,
+		lead: 0.55, lead_width: 0.4, style: kGullWing, positions: []int{0, 2, 4}},
+	"SOT-23-5": {sides: 2, per_side: 3, pitch: 0.95, width: 2.9, height: 1.6,
+		lead: 0.6, lead_width: 0.4, style: kGullWing, positions: []int{0, 1, 2, 3, 5}},
+	"SOT-23-6": {sides: 2, per_side: 3, pitch: 0.95, width: 2.9, height: 1.6,
+		lead: 0.6, lead_width: 0.4, style: kGullWing},
+	"SOT-223": {sides: 2, per_side: 3, pitch: 2.3, width: 6.5, height: 3.5,
+		lead: 1.5, lead_width: 0.7, style: kGullWing, positions: []int{0, 1, 2, 4},
+		tab_width: 3.0},
+}
+
+func dualRow(pins int, pitch, height, lead, lead_width float64, style leadStyle) *packageShape {
+	return &packageShape{sides: 2, per_side: pins / 2, pitch: pitch,
+		width: float64(pins/2)*pitch + 0.3, height: height,
+		lead: lead, lead_width: lead_width, style: style, notch: style == kThroughHole}
+}
+
+// Fine pitch versions of SOIC.
+func fineDualRow(height, lead float64) func(pins int) *packageShape {
+	return func(pins int) *packageShape {
+		if pins < 8 || pins > 64 || pins%2 != 0 {
+			return nil
+		}
+		return dualRow(pins, 0.65, height, lead, 0.3, kGullWing)
+	}
+}
+
+// Square packages with pins on all sides; fine pitch for many pins.
+func quadRow(pitch, fine_pitch, lead float64, style leadStyle) func(pins int) *packageShape {
+	return func(pins int) *packageShape {
+		if pins < 8 || pins > 256 || pins%4 != 0 {
+			return nil
+		}
+		per_side := pins / 4
+		shape := &packageShape{sides: 4, per_side: per_side, pitch: pitch,
+			lead: lead, style: style}
+		if pins > 44 {
+			shape.pitch = fine_pitch
+		}
+		shape.width = float64(per_side)*shape.pitch + 1.5
+		if style == kNoLead {
+			shape.width = float64(per_side)*shape.pitch + 1.0
+		}
+		shape.height = shape.width
+		shape.lead_width = shape.pitch * 0.45
+		return shape
+	}
+}
+
+// Shape of the footprint; nil if we don't know how to draw it.
+func parsePackageShape(footprint string) *packageShape {
+	canonical := canonicalFootprint(footprint)
+	if shape, found := kSotPackages[canonical]; found {
+		return shape
+	}
+	if match := chipSizeRegexp.FindStringSubmatch(canonical); match != nil {
+		// Imperial size code: length and width in 1/100 inch.
+		length, _ := strconv.Atoi(match[1])
+		width, _ := strconv.Atoi(match[2])
+		return &packageShape{width: float64(length) * 0.254, height: float64(width) * 0.254}
+	}
+	match := packageRegexp.FindStringSubmatch(canonical)
+	if match == nil || match[3] != "" {
+		return nil
+	}
+	family, found := kPackageFamilies[match[1]]
+	if !found {
+		return nil
+	}
+	pins, _ := strconv.Atoi(match[2])
+	return family(pins)
+}
+
+// What the Package_Drawing.svg template draws, in pixels.
+type PackageDrawing struct {
+	Footprint  string
+	Value      string
+	ValueSize  float64   // Font size to fit the body.
+	Body       string    // Polygon points.
+	Notch      string    // Path; empty if none.
+	Leads      []SvgRect // Below the body.
+	Pads       []SvgRect // On the body.
+	ExposedPad *SvgRect
+	Pin1       *SvgCircle // nil if there is no pin 1, e.g. chip resistors.
+	Pin1Label  SvgPoint
+	Center     SvgPoint
+}
+
+type SvgRect struct{ X, Y, W, H float64 }
+type SvgCircle struct{ X, Y, R float64 }
+type SvgPoint struct{ X, Y float64 }
+
+const (
+	kDrawingWidth  = 200.0
+	kDrawingHeight = 160.0
+	kMaxScale      = 24.0 // px/mm; tiny packages would be blown up otherwise.
+	kLabelDistance = 8.0  // px from the end of pin 1 to its label.
+)
+
+// Drawing of the package with the given footprint; nil if we can't.
+func NewPackageDrawing(footprint string, value string) *PackageDrawing {
+	shape := parsePackageShape(footprint)
+	if shape == nil {
+		return nil
+	}
+	return shape.draw(canonicalFootprint(footprint), value)
+}
+
+func round(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+func (s *packageShape) draw(footprint string, value string) *PackageDrawing {
+	// Size including the leads sticking out.
+	outside := s.lead
+	if s.style == kNoLead || s.sides == 0 {
+		outside = 0
+	}
+	extent_x, extent_y := s.width, s.height
+	switch s.sides {
+	case 1:
+		extent_y += outside
+	case 2:
+		extent_y += 2 * outside
+	case 4:
+		extent_x += 2 * outside
+		extent_y += 2 * outside
+	}
+	// Room for the pin 1 label around and the footprint name below.
+	scale := math.Min(kMaxScale, math.Min((kDrawingWidth-40)/extent_x, (kDrawingHeight-55)/extent_y))
+	center := SvgPoint{kDrawingWidth / 2, (kDrawingHeight - 15) / 2}
+	if s.sides == 1 {
+		center.Y -= outside * scale / 2 // Pins only below.
+	}
+	px := func(x, y float64) SvgPoint { // mm from the center to pixels.
+		return SvgPoint{round(center.X + x*scale), round(center.Y + y*scale)}
+	}
+	rect := func(x, y, w, h float64) SvgRect {
+		p := px(x, y)
+		return SvgRect{p.X, p.Y, round(w * scale), round(h * scale)}
+	}
+	left, right := -s.width/2, s.width/2
+	top, bottom := -s.height/2, s.height/2
+
+	result := &PackageDrawing{
+		Footprint: footprint,
+		Value:     value,
+		Center:    px(0, 0),
+	}
+	corners := []SvgPoint{px(left, top), px(right, top), px(right, bottom), px(left, bottom)}
+	if s.chamfer {
+		cut := s.width / 12
+		corners = []SvgPoint{px(left+cut, top), px(right, top), px(right, bottom),
+			px(left, bottom), px(left, top+cut)}
+	}
+	points := make([]string, len(corners))
+	for i, p := range corners {
+		points[i] = fmt.Sprintf("%g,%g", p.X, p.Y)
+	}
+	result.Body = strings.Join(points, " ")
+
+	if s.sides == 0 { // End caps of chip components.
+		end_cap := s.width / 4
+		result.Pads = []SvgRect{
+			rect(left, top, end_cap, s.height),
+			rect(right-end_cap, top, end_cap, s.height)}
+		result.ValueSize = fitText(value, (s.width-2*end_cap)*scale, s.height*scale)
+		return result
+	}
+
+	positions := s.positions
+	if positions == nil {
+		pins := s.sides * s.per_side
+		positions = make([]int, pins)
+		for i := range positions {
+			positions[i] = (s.first_pin + i) % pins
+		}
+	}
+	for i, position := range positions {
+		lead, edge, inward := s.leadAt(position, left, right, top, bottom)
+		if s.tab_width > 0 && i == len(positions)-1 {
+			lead.X -= (s.tab_width - s.lead_width) / 2
+			lead.W = s.tab_width
+		}
+		if s.style == kNoLead {
+			result.Pads = append(result.Pads, rect(lead.X, lead.Y, lead.W, lead.H))
+		} else {
+			result.Leads = append(result.Leads, rect(lead.X, lead.Y, lead.W, lead.H))
+		}
+		if i != 0 {
+			continue
+		}
+		// Label beyond the end of pin 1, dot on the body next to it.
+		end := px(edge.X-inward.X*outside, edge.Y-inward.Y*outside)
+		result.Pin1Label = SvgPoint{end.X - inward.X*kLabelDistance, end.Y - inward.Y*kLabelDistance}
+		size := math.Min(s.width, s.height)
+		inside, radius := size/5, size/14
+		if s.style == kNoLead { // Between pads and exposed pad.
+			inside, radius = s.lead+0.3, 0.2
+		}
+		dot := SvgPoint{edge.X + inward.X*inside, edge.Y + inward.Y*inside}
+		if s.sides != 4 {
+			dot.X = math.Max(dot.X, left+size/5) // Not into the notch.
+		}
+		p := px(dot.X, dot.Y)
+		result.Pin1 = &SvgCircle{p.X, p.Y, round(math.Max(1.5, radius*scale))}
+	}
+	if s.notch {
+		r := s.height / 6
+		from, to := px(left, -r), px(left, r)
+		result.Notch = fmt.Sprintf("M %g,%g A %g,%g 0 0 1 %g,%g Z",
+			from.X, from.Y, round(r*scale), round(r*scale), to.X, to.Y)
+	}
+	if s.exposed_pad {
+		pad := s.width - 2*(s.lead+0.5)
+		r := rect(-pad/2, -pad/2, pad, pad)
+		result.ExposedPad = &r
+	}
+	result.ValueSize = fitText(value, s.width*scale*0.85, s.height*scale)
+	return result
+}
+
+// Lead at position (in mm), the point on the body edge where it is and
+// the direction into the body from there.
+func (s *packageShape) leadAt(position int, left, right, top, bottom float64) (SvgRect, SvgPoint, SvgPoint) {
+	side, index := position/s.per_side, position%s.per_side
+	// Offset of the pin along its side, counting in the direction of the side.
+	along := (float64(index) - float64(s.per_side-1)/2) * s.pitch
+	half := s.lead_width / 2
+	// Sides in counter-clockwise order: left, bottom, right, top. With
+	// two rows, only bottom and top.
+	if s.sides <= 2 {
+		side = 2*side + 1
+	}
+	var lead SvgRect
+	var edge, inward SvgPoint
+	switch side {
+	case 0: // Left, top to bottom.
+		lead = SvgRect{left - s.lead, along - half, s.lead, s.lead_width}
+		edge, inward = SvgPoint{left, along}, SvgPoint{1, 0}
+	case 1: // Bottom, left to right.
+		lead = SvgRect{along - half, bottom, s.lead_width, s.lead}
+		edge, inward = SvgPoint{along, bottom}, SvgPoint{0, -1}
+	case 2: // Right, bottom to top.
+		lead = SvgRect{right, -along - half, s.lead, s.lead_width}
+		edge, inward = SvgPoint{right, -along}, SvgPoint{-1, 0}
+	default: // Top, right to left.
+		lead = SvgRect{-along - half, top - s.lead, s.lead_width, s.lead}
+		edge, inward = SvgPoint{-along, top}, SvgPoint{0, 1}
+	}
+	if s.style == kNoLead { // Pads are inside the body outline.
+		lead.X += inward.X * s.lead
+		lead.Y += inward.Y * s.lead
+	}
+	return lead, edge, inward
+}
+
+// Font size for text to fit into the box.
+func fitText(text string, width, height float64) float64 {
+	length := float64(len([]rune(text)))
+	if length == 0 {
+		return 0
+	}
+	return round(math.Min(24, math.Min(height*0.45, width/(0.6*length))))
+}
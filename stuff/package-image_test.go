@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParsePackageShape(t *testing.T) {
+	dip := parsePackageShape("DIP-20")
+	expectEqualInt(t, dip.sides, 2)
+	expectEqualInt(t, dip.per_side, 10)
+	ExpectTrue(t, dip.notch, "DIP has notch")
+	ExpectTrue(t, parsePackageShape("8-dip") != nil, "Other spelling")
+	ExpectTrue(t, parsePackageShape("DIP-40").height > dip.height, "Wide DIP")
+
+	ExpectTrue(t, parsePackageShape("SOIC-20").height > parsePackageShape("SOIC-16").height,
+		"Wide SOIC")
+	expectEqualInt(t, parsePackageShape("SIP-9").sides, 1)
+	expectEqualInt(t, parsePackageShape("TSSOP-20").per_side, 10)
+
+	// Fine pitch for many pins, without changing the others.
+	ExpectTrue(t, parsePackageShape("QFP-64").pitch == 0.5, "Fine pitch")
+	ExpectTrue(t, parsePackageShape("QFP-44").pitch == 0.8, "Normal pitch")
+	ExpectTrue(t, parsePackageShape("LQFP-44").pitch == 0.8, "Alias")
+	ExpectTrue(t, parsePackageShape("QFN-32").exposed_pad, "Exposed pad")
+	expectEqualInt(t, parsePackageShape("PLCC-44").first_pin, 38) // Top center.
+
+	expectEqualInt(t, len(parsePackageShape("SOT-23").positions), 3)
+	expectEqualInt(t, len(parsePackageShape("sot23-5").positions), 5)
+	ExpectTrue(t, parsePackageShape("SOT-223").tab_width > 0, "SOT-223 tab")
+	chip := parsePackageShape("0805")
+	expectEqualInt(t, chip.sides, 0)
+	ExpectTrue(t, chip.width > chip.height, "0805 is longer than wide")
+
+	for _, unknown := range []string{"", "DIP-7", "DIP-8-3", "QFP-42", "FOO-8", "TO-92", "SOT-89", "0000"} {
+		ExpectTrue(t, parsePackageShape(unknown) == nil, unknown)
+	}
+}
+
+func TestPackageDrawing(t *testing.T) {
+	soic := NewPackageDrawing("SOIC-8", "LM358")
+	expectEqual(t, soic.Footprint, "SOIC-8")
+	expectEqualInt(t, len(soic.Leads), 8)
+	// Pin 1 is bottom left, with its label below.
+	ExpectTrue(t, soic.Pin1 != nil && soic.Pin1.X < soic.Center.X && soic.Pin1.Y > soic.Center.Y,
+		"Pin 1 dot bottom left")
+	ExpectTrue(t, soic.Pin1Label.Y > soic.Leads[0].Y+soic.Leads[0].H, "Label below pin 1")
+	ExpectTrue(t, soic.ValueSize > 0, "Value fits")
+
+	qfn := NewPackageDrawing("QFN-32", "")
+	expectEqualInt(t, len(qfn.Pads), 32)
+	expectEqualInt(t, len(qfn.Leads), 0)
+	ExpectTrue(t, qfn.ExposedPad != nil, "Exposed pad")
+
+	chip := NewPackageDrawing("0805", "10k")
+	expectEqualInt(t, len(chip.Pads), 2)
+	ExpectTrue(t, chip.Pin1 == nil, "No pin 1 on chip resistors")
+	ExpectTrue(t, NewPackageDrawing("TO-92", "") == nil, "Unknown package")
+
+	// Everything needs to be on the canvas, leaving room for the name.
+	for _, footprint := range []string{"DIP-4", "DIP-64", "SIP-2", "SIP-40", "SOIC-32",
+		"SSOP-64", "MSOP-8", "QFP-256", "TQFP-32", "QFN-8", "PLCC-84", "SOT-23",
+		"SOT-23-6", "SOT-223", "0402", "2512"} {
+		drawing := NewPackageDrawing(footprint, "value")
+		for _, r := range append(drawing.Leads, drawing.Pads...) {
+			ExpectTrue(t, r.X >= 0 && r.Y >= 0 && r.X+r.W <= kDrawingWidth && r.Y+r.H <= 140,
+				footprint+" on canvas")
+		}
+		if drawing.Pin1 != nil {
+			ExpectTrue(t, drawing.Pin1Label.X > 0 && drawing.Pin1Label.Y < 145,
+				footprint+" pin 1 label on canvas")
+		}
+	}
+}
+
+func TestGeneratedPackageImage(t *testing.T) {
+	store, cleanup := newHistoryTestStore(t)
+	defer cleanup()
+	handler := &ImageHandler{store: store, template: NewTemplateRenderer("", true)}
+	for id, footprint := range map[int]string{1: "SOIC-8", 2: "DIP-8", 3: "TO-92"} {
+		store.EditRecord(Editor{}, id, func(c *Component) bool {
+			c.Footprint, c.Value = footprint, "LM358"
+			return true
+		})
+	}
+	out := rawGet(handler, "/img/1")
+	expectEqualInt(t, out.Code, http.StatusOK)
+	ExpectTrue(t, strings.Contains(out.Body.String(), ">LM358<"), "Value")
+	ExpectTrue(t, strings.Contains(out.Body.String(), ">SOIC-8<"), "Footprint")
+	etag := out.Header().Get("ETag")
+	ExpectTrue(t, etag != "", "ETag")
+	expectEqualInt(t, conditionalGet(handler, "/img/1", etag).Code, http.StatusNotModified)
+
+	// Hand-drawn one takes precedence.
+	out = rawGet(handler, "/img/2")
+	expectEqualInt(t, out.Code, http.StatusOK)
+	ExpectTrue(t, strings.Contains(out.Body.String(), "docname=\"package-DIP-8.svg\""),
+		"Hand-drawn DIP-8")
+
+	expectEqualInt(t, rawGet(handler, "/img/3").Code, http.StatusNotFound)
+}
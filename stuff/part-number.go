@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+)
+
+// Manufacturers decorate a generic part number with all kinds of
+// prefixes and suffixes: 2N3904BU is a 2N3904 in bulk packaging, NE555P
+// is an NE555 in a plastic DIP, SN74HC00N is a 74HC00 made by TI. People
+// type whatever is printed on the part or the bag, so we want both
+// spellings to find each other. We do this by reducing tokens that look
+// like part numbers to their base part number, which is indexed next
+// to the regular terms.
+
+// Manufacturer prefixes in front of the generic 74xx/54xx logic families.
+// Only stripped if the remainder starts with the family number, as many
+// of these letters are also regular parts of a part number.
+var logicFamilyPrefixes = []string{"sn", "mc", "dm", "mm", "hd", "cd"}
+
+// Manufacturer prefixes in front of the 4000 series CMOS.
+var cmosFamilyPrefixes = []string{"cd", "hef", "mc1", "tc"}
+
+// Known suffix codes, in lowercase. A trailing run of letters is only
+// removed if it can be fully composed of these.
+var partNumberSuffixes = map[string]bool{
+	// Package codes
+	"n": true, "p": true, "d": true, "dr": true, "dt": true,
+	"pw": true, "dw": true, "ct": true, "t": true, "u": true,
+	"bu": true, "ta": true, "tu": true, "be": true, "bp": true,
+	"cp": true, "cn": true, "j": true, "fb": true, "z": true,
+	"kc": true, "pu": true, "au": true,
+	// Buffered 4000 series CMOS
+	"b": true,
+	// Temperature range
+	"c": true, "i": true, "e": true, "m": true,
+	// Tape and reel
+	"tr": true, "rl": true, "reel": true, "r": true,
+	// Lead free
+	"pbf": true, "g": true, "lf": true,
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+// Longer suffixes are not decorations but part of the name.
+const kMaxPartNumberSuffix = 8
+
+// Returns if the (lowercased) suffix can be split into known suffix codes.
+func isPartNumberSuffix(suffix string) bool {
+	if len(suffix) > kMaxPartNumberSuffix {
+		return false
+	}
+	// splits[i]: suffix[i:] can be split. Going backwards, every
+	// position is only looked at once.
+	splits := make([]bool, len(suffix)+1)
+	splits[len(suffix)] = true
+	for i := len(suffix) - 1; i >= 0; i-- {
+		for j := i + 1; j <= len(suffix) && !splits[i]; j++ {
+			splits[i] = splits[j] && partNumberSuffixes[suffix[i:j]]
+		}
+	}
+	return splits[0]
+}
+
+// basePartNumber returns the base part number of a lowercased token
+// without dashes (see preprocessTerm()), or an empty string if the token
+// does not look like a part number.
+//
+// Part numbers are letters and digits with at least one letter before
+// the last digit, which keeps values such as '100n' or '10k' out.
+func basePartNumber(token string) string {
+	lastDigit := -1
+	for i := 0; i < len(token); i++ {
+		switch c := token[i]; {
+		case isDigit(c):
+			lastDigit = i
+		case !isLetter(c):
+			return ""
+		}
+	}
+	if lastDigit < 0 || len(token) < 4 {
+		return ""
+	}
+	hasLetter := false
+	for i := 0; i < lastDigit && !hasLetter; i++ {
+		hasLetter = isLetter(token[i])
+	}
+	if !hasLetter {
+		return ""
+	}
+
+	base := token
+	if isPartNumberSuffix(token[lastDigit+1:]) {
+		base = token[:lastDigit+1]
+	}
+	for _, prefix := range logicFamilyPrefixes {
+		rest := strings.TrimPrefix(base, prefix)
+		if rest != base && (strings.HasPrefix(rest, "74") || strings.HasPrefix(rest, "54")) {
+			return rest
+		}
+	}
+	for _, prefix := range cmosFamilyPrefixes {
+		rest := strings.TrimPrefix(base, prefix)
+		if rest != base && len(rest) >= 4 && rest[0] == '4' && isDigit(rest[1]) {
+			return rest
+		}
+	}
+	return base
+}
+
+// Returns the base part numbers of all the tokens in the preprocessed
+// text that look like part numbers, separated by space.
+func basePartNumbers(text string) string {
+	var result []string
+	for _, token := range strings.FieldsFunc(text, func(r rune) bool {
+		return r < 128 && isSeparator(byte(r))
+	}) {
+		if base := basePartNumber(token); base != "" {
+			result = append(result, base)
+		}
+	}
+	return strings.Join(result, " ")
+}
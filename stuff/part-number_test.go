@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBasePartNumber(t *testing.T) {
+	// Not part numbers.
+	expectEqual(t, basePartNumber("resistor"), "")
+	expectEqual(t, basePartNumber("10k"), "")
+	expectEqual(t, basePartNumber("100n"), "")
+	expectEqual(t, basePartNumber("7805"), "")
+	expectEqual(t, basePartNumber("1/4w"), "")
+
+	// Already base part numbers.
+	expectEqual(t, basePartNumber("2n3904"), "2n3904")
+	expectEqual(t, basePartNumber("ne555"), "ne555")
+	expectEqual(t, basePartNumber("74hc595"), "74hc595")
+
+	// Package, temperature, tape/reel and lead-free suffixes.
+	expectEqual(t, basePartNumber("2n3904bu"), "2n3904")
+	expectEqual(t, basePartNumber("2n3904ta"), "2n3904")
+	expectEqual(t, basePartNumber("ne555p"), "ne555")
+	expectEqual(t, basePartNumber("lm358dr"), "lm358")
+	expectEqual(t, basePartNumber("max232cpe"), "max232")
+	expectEqual(t, basePartNumber("irf540npbf"), "irf540")
+	expectEqual(t, basePartNumber("atmega328ppu"), "atmega328")
+	expectEqual(t, basePartNumber("lm317tr"), "lm317")
+
+	// Unknown suffixes are left alone.
+	expectEqual(t, basePartNumber("lm358xyz"), "lm358xyz")
+	expectEqual(t, basePartNumber("lm358trtrtrtrtr"), "lm358trtrtrtrtr") // too long
+
+	// Manufacturer prefixes of logic families.
+	expectEqual(t, basePartNumber("sn74hc00n"), "74hc00")
+	expectEqual(t, basePartNumber("mc74hc595"), "74hc595")
+	expectEqual(t, basePartNumber("cd4017be"), "4017")
+	expectEqual(t, basePartNumber("hef4017bp"), "4017")
+	expectEqual(t, basePartNumber("mc14017b"), "4017")
+	expectEqual(t, basePartNumber("mc7805"), "mc7805")
+}
+
+// Splitting the suffix must not take exponential time on tokens that
+// almost, but not quite, consist of suffix codes: suffixes are capped at
+// kMaxPartNumberSuffix, anything longer is not even looked at.
+func TestBasePartNumberPathologicalSuffix(t *testing.T) {
+	token := "ab1" + strings.Repeat("tr", 24) + "x"
+	expectEqual(t, basePartNumber(token), token)
+	ExpectTrue(t, isPartNumberSuffix("trtr"), "short suffix")
+	ExpectTrue(t, isPartNumberSuffix(strings.Repeat("tr", kMaxPartNumberSuffix/2)), "longest suffix")
+	ExpectTrue(t, !isPartNumberSuffix(strings.Repeat("tr", kMaxPartNumberSuffix/2+1)), "too long")
+	ExpectTrue(t, !isPartNumberSuffix(strings.Repeat("tr", 24)+"x"), "long suffix")
+}
+
+func BenchmarkBasePartNumberPathologicalSuffix(b *testing.B) {
+	token := "ab1" + strings.Repeat("tr", 24) + "x"
+	for i := 0; i < b.N; i++ {
+		basePartNumber(token)
+	}
+}
+
+func TestBasePartNumbers(t *testing.T) {
+	expectEqual(t, basePartNumbers(""), "")
+	expectEqual(t, basePartNumbers("npn transistor, 2n3904bu"), "2n3904")
+	expectEqual(t, basePartNumbers("ne555p; lm358n"), "ne555 lm358")
+}
+
+func TestSearchPartNumbers(t *testing.T) {
+	fts := NewFulltextSearch()
+	fts.Update(&Component{Id: 1, Category: "Transistor", Value: "2N3904"})
+	fts.Update(&Component{Id: 2, Category: "Integrated Circuit (IC)", Value: "NE555P"})
+	fts.Update(&Component{Id: 3, Category: "Transistor", Value: "2N3906"})
+	fts.Update(&Component{Id: 4, Category: "Transistor", Value: "2N3904BU"})
+
+	expectResultIds := func(query string, ids ...int) {
+		result := fts.Search(query, 0).Results
+		if len(result) != len(ids) {
+			t.Errorf("%s: expected %d results, got %d", query, len(ids), len(result))
+			return
+		}
+		for i, id := range ids {
+			if result[i].Id != id {
+				t.Errorf("%s: expected id %d at position %d, got %d",
+					query, id, i, result[i].Id)
+			}
+		}
+	}
+
+	// Exact match is scored higher than base part number match.
+	expectResultIds("2N3904BU", 4, 1)
+	expectResultIds("2N3904", 1, 4)
+	expectResultIds("NE555", 2)
+	expectResultIds("NE555N", 2)
+	expectResultIds("2N3906TA", 3)
+}
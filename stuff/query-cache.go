@@ -0,0 +1,97 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Search-as-you-type sends the same queries over and over again while
+// nothing in the inventory changes. We remember the ranked result IDs of
+// recent queries; entries are only valid for the index generation they
+// were computed in.
+
+const kQueryCacheSize = 1000
+
+var (
+	queryCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "stuff_search_cache_hits_total",
+		Help: "Number of searches answered from the query cache.",
+	})
+	queryCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "stuff_search_cache_misses_total",
+		Help: "Number of searches not found in the query cache.",
+	})
+)
+
+type queryCacheKey struct {
+	query string // Rewritten and preprocessed query.
+	limit int
+}
+
+type queryCacheEntry struct {
+	key        queryCacheKey
+	generation uint64 // Index generation this was computed in.
+	ids        []int  // Ranked result
+	totalCount int
+}
+
+// Bounded LRU cache of query results.
+type queryCache struct {
+	lock     sync.Mutex
+	capacity int
+	lru      *list.List // of *queryCacheEntry, most recently used first.
+	entries  map[queryCacheKey]*list.Element
+}
+
+func newQueryCache(capacity int) *queryCache {
+	return &queryCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[queryCacheKey]*list.Element),
+	}
+}
+
+// Look up the result for the key. Entries of an older generation
+// are stale and removed.
+func (c *queryCache) get(key queryCacheKey, generation uint64) (*queryCacheEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, found := c.entries[key]
+	if found && element.Value.(*queryCacheEntry).generation != generation {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		found = false
+	}
+	if !found {
+		queryCacheMisses.Inc()
+		return nil, false
+	}
+	queryCacheHits.Inc()
+	c.lru.MoveToFront(element)
+	return element.Value.(*queryCacheEntry), true
+}
+
+func (c *queryCache) put(entry *queryCacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, found := c.entries[entry.key]; found {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*queryCacheEntry).key)
+	}
+}
+
+func (c *queryCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
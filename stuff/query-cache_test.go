@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQueryCacheLRU(t *testing.T) {
+	cache := newQueryCache(2)
+	key := func(q string) queryCacheKey { return queryCacheKey{query: q, limit: 24} }
+	cache.put(&queryCacheEntry{key: key("a"), ids: []int{1}})
+	cache.put(&queryCacheEntry{key: key("b"), ids: []int{2}})
+
+	_, found := cache.get(key("a"), 0) // 'a' is now most recently used.
+	ExpectTrue(t, found, "a cached")
+	cache.put(&queryCacheEntry{key: key("c"), ids: []int{3}})
+	ExpectTrue(t, cache.Len() == 2, "Bounded size")
+	_, found = cache.get(key("b"), 0)
+	ExpectTrue(t, !found, "b evicted")
+	_, found = cache.get(key("a"), 0)
+	ExpectTrue(t, found, "a still cached")
+
+	// Same query with a different limit is a different result.
+	_, found = cache.get(queryCacheKey{query: "a", limit: 100}, 0)
+	ExpectTrue(t, !found, "Limit is part of key")
+
+	// Entries of older generations are stale.
+	entry, found := cache.get(key("c"), 1)
+	ExpectTrue(t, !found && entry == nil, "c is stale")
+	ExpectTrue(t, cache.Len() == 1, "Stale entry removed")
+}
+
+func TestSearchUsesQueryCache(t *testing.T) {
+	fts := NewFulltextSearch()
+	fts.Update(&Component{Id: 1, Category: "Resistor", Value: "10k"})
+	fts.Update(&Component{Id: 2, Category: "Resistor", Value: "1k"})
+
+	hits := testutil.ToFloat64(queryCacheHits)
+	misses := testutil.ToFloat64(queryCacheMisses)
+	ExpectTrue(t, len(fts.Search("resistor", 24).Results) == 2, "First search")
+	ExpectTrue(t, testutil.ToFloat64(queryCacheMisses) == misses+1, "Miss")
+	result := fts.Search("resistor", 24)
+	ExpectTrue(t, testutil.ToFloat64(queryCacheHits) == hits+1, "Hit")
+	ExpectTrue(t, len(result.Results) == 2 && result.TotalCount == 2 &&
+		result.Results[0].Id == 1, "Cached result")
+
+	// Any update invalidates.
+	fts.Update(&Component{Id: 1, Category: "Resistor", Value: "22k"})
+	result = fts.Search("resistor", 24)
+	ExpectTrue(t, testutil.ToFloat64(queryCacheMisses) == misses+2, "Miss after update")
+	ExpectTrue(t, len(result.Results) == 2 && result.Results[0].Id == 2 &&
+		result.Results[1].Value == "22k", "Fresh result")
+}
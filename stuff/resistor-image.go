@@ -1,9 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"regexp"
-	"time"
+	"strconv"
 )
 
 type ResistorDigit struct {
@@ -11,18 +12,19 @@ type ResistorDigit struct {
 	Digit      string
 	Multiplier string
 	Tolerance  string
+	Tempco     string // Temperature coefficient in the sixth band.
 }
 
 var resistorColorConstants []ResistorDigit = []ResistorDigit{
-	{Color: "#000000", Digit: "0 (Black)", Multiplier: "x1Ω (Black)"},
-	{Color: "#885500", Digit: "1 (Brown)", Multiplier: "x10Ω (Brown)", Tolerance: "1% (Brown)"},
-	{Color: "#ff0000", Digit: "2 (Red)", Multiplier: "x100Ω (Red)", Tolerance: "2% (Red)"},
-	{Color: "#ffbb00", Digit: "3 (Orange)", Multiplier: "x1kΩ (Orange)"},
-	{Color: "#ffff00", Digit: "4 (Yellow)", Multiplier: "x10kΩ (Yellow)"},
-	{Color: "#00ff00", Digit: "5 (Green)", Multiplier: "x100kΩ (Green)", Tolerance: ".5% (Green)"},
-	{Color: "#0000ff", Digit: "6 (Blue)", Multiplier: "x1MΩ (Blue)", Tolerance: ".25% (Blue)"},
-	{Color: "#cd65ff", Digit: "7 (Violet)", Multiplier: "x10MΩ (Violet)", Tolerance: ".1% (Violet)"},
-	{Color: "#a0a0a0", Digit: "8 (Gray)", Tolerance: "0.05%"},
+	{Color: "#000000", Digit: "0 (Black)", Multiplier: "x1Ω (Black)", Tempco: "250ppm/K (Black)"},
+	{Color: "#885500", Digit: "1 (Brown)", Multiplier: "x10Ω (Brown)", Tolerance: "1% (Brown)", Tempco: "100ppm/K (Brown)"},
+	{Color: "#ff0000", Digit: "2 (Red)", Multiplier: "x100Ω (Red)", Tolerance: "2% (Red)", Tempco: "50ppm/K (Red)"},
+	{Color: "#ffbb00", Digit: "3 (Orange)", Multiplier: "x1kΩ (Orange)", Tempco: "15ppm/K (Orange)"},
+	{Color: "#ffff00", Digit: "4 (Yellow)", Multiplier: "x10kΩ (Yellow)", Tempco: "25ppm/K (Yellow)"},
+	{Color: "#00ff00", Digit: "5 (Green)", Multiplier: "x100kΩ (Green)", Tolerance: ".5% (Green)", Tempco: "20ppm/K (Green)"},
+	{Color: "#0000ff", Digit: "6 (Blue)", Multiplier: "x1MΩ (Blue)", Tolerance: ".25% (Blue)", Tempco: "10ppm/K (Blue)"},
+	{Color: "#cd65ff", Digit: "7 (Violet)", Multiplier: "x10MΩ (Violet)", Tolerance: ".1% (Violet)", Tempco: "5ppm/K (Violet)"},
+	{Color: "#a0a0a0", Digit: "8 (Gray)", Tolerance: "0.05%", Tempco: "1ppm/K (Gray)"},
 	{Color: "#ffffff", Digit: "9 (White)"},
 	// Tolerances
 	{Color: "#d57c00", Multiplier: "x0.1Ω (Gold)", Tolerance: "5% (Gold)"},
@@ -34,6 +36,14 @@ type ResistorTemplate struct {
 	First, Second, Third ResistorDigit
 	Multiplier           ResistorDigit
 	Tolerance            ResistorDigit
+	Tempco               ResistorDigit
+}
+
+// Printed code on chip resistors.
+type SmdResistorTemplate struct {
+	Value     string
+	Code      string // e.g. "472", "4701" or "01C" (EIA-96).
+	Footprint string
 }
 
 func expToIndex(exp int) int {
@@ -49,6 +59,33 @@ func expToIndex(exp int) int {
 	}
 }
 
+// Inverse of expToIndex().
+func indexToExp(index int) int {
+	switch index {
+	case 10:
+		return -1
+	case 11:
+		return -2
+	default:
+		return index
+	}
+}
+
+// Color index of the temperature coefficient, e.g. "100ppm"; -1 if there
+// is no color for it.
+func tempcoFromString(tempco_string string) int {
+	ppm, err := strconv.Atoi(tempco_string)
+	if err != nil {
+		return -1
+	}
+	for i, c := range []int{250, 100, 50, 15, 25, 20, 10, 5, 1} {
+		if c == ppm {
+			return i
+		}
+	}
+	return -1
+}
+
 func toleranceFromString(tolerance_string string, default_value int) int {
 	switch tolerance_string {
 	case "5%":
@@ -72,9 +109,11 @@ func toleranceFromString(tolerance_string string, default_value int) int {
 
 // Extract the values from the given string.
 // Returns an array of either 4 or 5 integers depending
-// on precision.
-// Returns nil on error.
-func extractResistorDigits(value string, tolerance string) []int {
+// on precision; 3 for two digit values with 20% tolerance (no tolerance
+// band), 6 if there is a temperature coefficient and a single 0 for a
+// zero ohm jumper.
+// Returns nil on error, or if 20% tolerance would need a tolerance band.
+func extractResistorDigits(value string, tolerance string, tempco string) []int {
 	if len(value) == 0 {
 		return nil
 	}
@@ -83,9 +122,15 @@ func extractResistorDigits(value string, tolerance string) []int {
 	dot_seen := false
 	post_dot_digits := 0
 	zero_prefix := true
+	digit_seen := false
+	non_zero_seen := false
 	var digits [3]int
 	digit_pos := 0
 	for _, c := range value {
+		if c >= '0' && c <= '9' {
+			digit_seen = true
+			non_zero_seen = non_zero_seen || c != '0'
+		}
 		if c == '0' && zero_prefix {
 			continue // eat leading zeroes
 		}
@@ -101,7 +146,7 @@ func extractResistorDigits(value string, tolerance string) []int {
 				digits[digit_pos] = int(c - '0')
 				digit_pos++
 			}
-		case c == '.':
+		case c == '.' || c == 'R' || c == 'r': // 4R7 is 4.7
 			if dot_seen { // uh, multiple dots ?
 				return nil
 			}
@@ -115,6 +160,13 @@ func extractResistorDigits(value string, tolerance string) []int {
 		}
 	}
 
+	if !digit_seen {
+		return nil
+	}
+	if !non_zero_seen {
+		return []int{0} // Jumper.
+	}
+
 	// See how many relevant digits we have. Zeroes at end don't count
 	relevant_digits := 0
 	for relevant_digits = len(digits); relevant_digits > 0 && digits[relevant_digits-1] == 0; relevant_digits-- {
@@ -125,7 +177,19 @@ func extractResistorDigits(value string, tolerance string) []int {
 	}
 	var result []int
 	var multiplier_digit int
-	if relevant_digits <= 2 {
+	tempco_digit := tempcoFromString(tempco)
+	if tolerance == "20%" && (relevant_digits > 2 || tempco_digit >= 0) {
+		return nil // No band means 20% only with three bands.
+	}
+	if tempco_digit >= 0 && expToIndex(exp-3) >= 0 {
+		// Six bands always have three digits.
+		multiplier_digit = expToIndex(exp - 3)
+		result = []int{digits[0], digits[1], digits[2], multiplier_digit,
+			toleranceFromString(tolerance /*default 1%:*/, 1), tempco_digit}
+	} else if relevant_digits <= 2 && tolerance == "20%" {
+		multiplier_digit = expToIndex(exp - 2)
+		result = []int{digits[0], digits[1], multiplier_digit}
+	} else if relevant_digits <= 2 {
 		multiplier_digit = expToIndex(exp - 2)
 		result = []int{digits[0], digits[1], multiplier_digit,
 			toleranceFromString(tolerance /*default 5%:*/, 10)}
@@ -141,12 +205,83 @@ func extractResistorDigits(value string, tolerance string) []int {
 	}
 }
 
-var tolerance_regexp, _ = regexp.Compile(`((0?.)?\d+\%)`)
+var tolerance_regexp, _ = regexp.Compile(`((0?\.)?\d+\%)`)
+var tempco_regexp, _ = regexp.Compile(`(?i)(\d+)\s*ppm`)
+
+// E96 series: values of 1% resistors, numbered 01..96 in EIA-96 codes.
+var kE96Values = []int{
+	100, 102, 105, 107, 110, 113, 115, 118, 121, 124, 127, 130,
+	133, 137, 140, 143, 147, 150, 154, 158, 162, 165, 169, 174,
+	178, 182, 187, 191, 196, 200, 205, 210, 215, 221, 226, 232,
+	237, 243, 249, 255, 261, 267, 274, 280, 287, 294, 301, 309,
+	316, 324, 332, 340, 348, 357, 365, 374, 383, 392, 402, 412,
+	422, 432, 442, 453, 464, 475, 487, 499, 511, 523, 536, 549,
+	562, 576, 590, 604, 619, 634, 649, 665, 681, 698, 715, 732,
+	750, 768, 787, 806, 825, 845, 866, 887, 909, 931, 953, 976,
+}
+
+// EIA-96 multiplier letters, starting with 10^-2.
+const kEia96Multipliers = "YXABCDEF"
+
+// Chip resistors show a code instead of color bands; "SMD" if we only
+// know that it is one. Returns the chip size, e.g. 603 for 0603; 0 if
+// unknown, -1 if this is not a chip resistor.
+func smdChipSize(footprint string) int {
+	canonical := canonicalFootprint(footprint)
+	if canonical == "SMD" {
+		return 0
+	}
+	if match := chipSizeRegexp.FindStringSubmatch(canonical); match != nil {
+		size, _ := strconv.Atoi(canonical)
+		return size
+	}
+	return -1
+}
+
+// Code printed on a chip resistor for the digits of extractResistorDigits().
+// Precise values get four digits, or the EIA-96 code on chips too small for
+// that (0603 and below). Below 10 (or 100) the R marks the decimal point.
+func smdResistorCode(digits []int, chip_size int) string {
+	var value, exp int // Three digits and the exponent.
+	switch len(digits) {
+	case 1:
+		return "0"
+	case 3, 4:
+		if len(digits) == 3 || digits[3] == 10 || digits[3] == 11 { // 5% or more
+			return smdDigitsCode(fmt.Sprintf("%d%d", digits[0], digits[1]), indexToExp(digits[2]))
+		}
+		value, exp = 100*digits[0]+10*digits[1], indexToExp(digits[2])-1
+	default:
+		value, exp = 100*digits[0]+10*digits[1]+digits[2], indexToExp(digits[3])
+	}
+	if chip_size > 0 && chip_size <= 603 && exp >= -2 && exp <= 5 {
+		for i, e96 := range kE96Values {
+			if e96 == value {
+				return fmt.Sprintf("%02d%c", i+1, kEia96Multipliers[exp+2])
+			}
+		}
+	}
+	return smdDigitsCode(strconv.Itoa(value), exp)
+}
+
+// Digits followed by the number of zeros; negative exponents put an R
+// where the decimal point is.
+func smdDigitsCode(code string, exp int) string {
+	if exp >= 0 {
+		return code + strconv.Itoa(exp)
+	}
+	point := len(code) + exp
+	if point < 0 {
+		return ""
+	}
+	return code[:point] + "R" + code[point:]
+}
 
 func serveResistorImage(component *Component, value string, tmpl *TemplateRenderer, out http.ResponseWriter) bool {
-	defer ElapsedPrint("resistor-image", time.Now())
 
 	tolerance := ""
+	tempco := ""
+	chip_size := -1
 	if component != nil {
 		if len(value) == 0 {
 			value = component.Value
@@ -154,30 +289,56 @@ func serveResistorImage(component *Component, value string, tmpl *TemplateRender
 		if match := tolerance_regexp.FindStringSubmatch(component.Description); match != nil {
 			tolerance = match[1]
 		}
+		if match := tempco_regexp.FindStringSubmatch(component.Description); match != nil {
+			tempco = match[1]
+		}
+		chip_size = smdChipSize(component.Footprint)
 	}
 
-	digits := extractResistorDigits(value, tolerance)
+	digits := extractResistorDigits(value, tolerance, tempco)
 	if digits == nil {
 		return false
 	}
 
+	if chip_size >= 0 {
+		code := smdResistorCode(digits, chip_size)
+		if code == "" {
+			return false
+		}
+		return tmpl.Render(out, "SMD_Resistor.svg", &SmdResistorTemplate{
+			Value:     value + "Ω",
+			Code:      code,
+			Footprint: canonicalFootprint(component.Footprint),
+		})
+	}
+
 	bands := &ResistorTemplate{
 		Value: value + "Ω",
 	}
-	if len(digits) == 4 {
+	switch len(digits) {
+	case 1:
+		return tmpl.Render(out, "Zero_Ohm_Resistor.svg", bands)
+	case 3:
+		bands.First = resistorColorConstants[digits[0]]
+		bands.Second = resistorColorConstants[digits[1]]
+		bands.Multiplier = resistorColorConstants[digits[2]]
+		return tmpl.Render(out, "3-Band_Resistor.svg", bands)
+	case 4:
 		bands.First = resistorColorConstants[digits[0]]
 		bands.Second = resistorColorConstants[digits[1]]
 		bands.Multiplier = resistorColorConstants[digits[2]]
 		bands.Tolerance = resistorColorConstants[digits[3]]
-		tmpl.Render(out, "4-Band_Resistor.svg", bands)
-	} else {
+		return tmpl.Render(out, "4-Band_Resistor.svg", bands)
+	default:
 		bands.First = resistorColorConstants[digits[0]]
 		bands.Second = resistorColorConstants[digits[1]]
 		bands.Third = resistorColorConstants[digits[2]]
 		bands.Multiplier = resistorColorConstants[digits[3]]
 		bands.Tolerance = resistorColorConstants[digits[4]]
-		tmpl.Render(out, "5-Band_Resistor.svg", bands)
+		if len(digits) == 6 {
+			bands.Tempco = resistorColorConstants[digits[5]]
+			return tmpl.Render(out, "6-Band_Resistor.svg", bands)
+		}
+		return tmpl.Render(out, "5-Band_Resistor.svg", bands)
 	}
-
-	return true
 }
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
 func ExpectValue(t *testing.T, expected []int, value string, tolerance string) bool {
-	result := extractResistorDigits(value, tolerance)
+	result := extractResistorDigits(value, tolerance, "")
 	if result == nil && expected != nil {
 		t.Errorf("Unexpected nil for '%s'", value)
 		return false
@@ -50,3 +52,87 @@ func TestExtractResistorValue(t *testing.T) {
 	ExpectValue(t, nil, "0.111", "5%") // impossible multiplier
 	ExpectValue(t, []int{1, 1, 1, 11, 1}, "1.11", "")
 }
+
+func TestExtractResistorBands(t *testing.T) {
+	// 20% has no tolerance band.
+	ExpectValue(t, []int{4, 7, 3}, "47k", "20%")
+	ExpectValue(t, nil, "4.75k", "20%") // More bands would claim 1%.
+	ExpectValue(t, []int{4, 7, 1, 10}, "470", "5%")
+
+	// Zero ohm jumpers have a single black band.
+	ExpectValue(t, []int{0}, "0", "")
+	ExpectValue(t, []int{0}, "0R", "")
+	ExpectValue(t, []int{0}, "0.0", "")
+	ExpectValue(t, nil, "k", "")
+
+	// R as decimal point.
+	ExpectValue(t, []int{4, 7, 10, 10}, "4R7", "")
+	ExpectValue(t, nil, "4R7.1", "")
+
+	// Temperature coefficient adds a sixth band; always three digits.
+	expectTempco := func(expected []int, value string, tolerance string, tempco string) {
+		result := extractResistorDigits(value, tolerance, tempco)
+		if len(result) != len(expected) {
+			t.Errorf("%s %s: expected %v, got %v", value, tempco, expected, result)
+			return
+		}
+		for i := range result {
+			expectEqualInt(t, result[i], expected[i])
+		}
+	}
+	expectTempco([]int{1, 0, 0, 2, 1, 1}, "10k", "", "100")
+	expectTempco([]int{4, 9, 9, 0, 7, 3}, "499", "0.1%", "15")
+	expectTempco([]int{1, 0, 2, 10}, "1k", "", "42") // No color for that.
+	expectTempco(nil, "10k", "20%", "100")
+}
+
+func TestSmdResistorCode(t *testing.T) {
+	for _, test := range []struct {
+		value, tolerance string
+		size             int
+		expected         string
+	}{
+		{"4.7k", "", 805, "472"},
+		{"10", "", 1206, "100"},
+		{"4.7", "", 805, "4R7"},
+		{"0.47", "", 805, "R47"},
+		{"0", "", 805, "0"},
+		{"47k", "20%", 805, "473"},
+		{"10k", "1%", 805, "1002"},
+		{"49.9", "", 805, "49R9"},
+		{"23.7k", "", 1206, "2372"},
+		{"10k", "1%", 603, "01C"},
+		{"49.9", "", 402, "68X"},
+		{"23.7k", "", 603, "37C"},
+		{"23.7k", "", 0, "2372"},   // Size unknown.
+		{"10.1k", "", 603, "1012"}, // Not in E96.
+	} {
+		code := smdResistorCode(extractResistorDigits(test.value, test.tolerance, ""), test.size)
+		if code != test.expected {
+			t.Errorf("%s %s (%04d): expected %s, got %s", test.value, test.tolerance, test.size, test.expected, code)
+		}
+	}
+	expectEqualInt(t, smdChipSize("0603"), 603)
+	expectEqualInt(t, smdChipSize("smd"), 0)
+	expectEqualInt(t, smdChipSize("Axial"), -1)
+}
+
+func TestResistorImageTemplates(t *testing.T) {
+	tmpl := NewTemplateRenderer("", false)
+	for _, test := range []struct {
+		component *Component
+		expected  string
+	}{
+		{&Component{Value: "47k", Description: "20%"}, "x1kΩ (Orange)"},
+		{&Component{Value: "10k", Description: "1%; 50ppm"}, "50ppm/K (Red)"},
+		{&Component{Value: "10k", Description: "Metal film 1%"}, "1% (Brown)"},
+		{&Component{Value: "0"}, "0 (Black)"},
+		{&Component{Value: "4.7k", Footprint: "0805"}, ">472<"},
+		{&Component{Value: "10k", Description: "1%", Footprint: "0603"}, ">01C<"},
+	} {
+		out := httptest.NewRecorder()
+		ExpectTrue(t, serveResistorImage(test.component, "", tmpl, out), test.component.Value)
+		ExpectTrue(t, strings.Contains(out.Body.String(), test.expected), test.expected)
+	}
+	ExpectTrue(t, !serveResistorImage(&Component{Value: "k"}, "", tmpl, httptest.NewRecorder()), "garbage")
+}
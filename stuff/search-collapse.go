@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Components in the same equivalence set are interchangeable, often just
+// the same part stored in different drawers. For searching, they can be
+// collapsed into one "virtual drawer".
+
+// Search result representing all matching members of an equivalence set.
+type CollapsedResult struct {
+	*Component              // Best ranked member, representing the set.
+	Members          []int  // IDs of all matching members, best ranked first.
+	CombinedQuantity string // Of all members.
+}
+
+var quantityNumberRegex = regexp.MustCompile(`\d+`)
+
+// Add up quantities, which are free-form text. Plain numbers are summed
+// exactly; if any of the quantities is something else ("~50", "lots",
+// empty), the result is marked approximate with a "~" prefix.
+// Returns "" if there is nothing to add up.
+func combineQuantities(quantities []string) string {
+	sum := 0
+	numbers := 0
+	exact := true
+	for _, q := range quantities {
+		q = strings.TrimSpace(q)
+		if n, err := strconv.Atoi(q); err == nil {
+			sum += n
+			numbers++
+			continue
+		}
+		exact = false
+		if number := quantityNumberRegex.FindString(q); number != "" {
+			n, _ := strconv.Atoi(number)
+			sum += n
+			numbers++
+		}
+	}
+	switch {
+	case numbers == 0:
+		return ""
+	case exact:
+		return fmt.Sprintf("%d", sum)
+	default:
+		return fmt.Sprintf("~%d", sum)
+	}
+}
+
+// Collapse ranked results by equivalence set; the position of a set is
+// the position of its best ranked member. Sets listed in "expand" are
+// not collapsed.
+func collapseByEquivSet(results []*Component, expand map[int]bool) []*CollapsedResult {
+	output := make([]*CollapsedResult, 0, len(results))
+	bySet := make(map[int]*CollapsedResult)
+	quantities := make(map[int][]string)
+	for _, c := range results {
+		if expand[c.Equiv_set] {
+			output = append(output, &CollapsedResult{
+				Component:        c,
+				Members:          []int{c.Id},
+				CombinedQuantity: combineQuantities([]string{c.Quantity}),
+			})
+			continue
+		}
+		set, found := bySet[c.Equiv_set]
+		if !found {
+			set = &CollapsedResult{Component: c}
+			bySet[c.Equiv_set] = set
+			output = append(output, set)
+		}
+		set.Members = append(set.Members, c.Id)
+		quantities[c.Equiv_set] = append(quantities[c.Equiv_set], c.Quantity)
+	}
+	for equiv_set, set := range bySet {
+		set.CombinedQuantity = combineQuantities(quantities[equiv_set])
+	}
+	return output
+}
+
+// Parse a comma separated list of equivalence sets to not collapse.
+func parseExpandedSets(value string) map[int]bool {
+	result := make(map[int]bool)
+	for _, s := range strings.Split(value, ",") {
+		if set, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			result[set] = true
+		}
+	}
+	return result
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCombineQuantities(t *testing.T) {
+	expectEqual(t, combineQuantities([]string{}), "")
+	expectEqual(t, combineQuantities([]string{"", "lots"}), "")
+	expectEqual(t, combineQuantities([]string{"10"}), "10")
+	expectEqual(t, combineQuantities([]string{"10", " 5 "}), "15")
+	expectEqual(t, combineQuantities([]string{"10", "~50"}), "~60")
+	expectEqual(t, combineQuantities([]string{"10", ""}), "~10")
+}
+
+func TestCollapseByEquivSet(t *testing.T) {
+	results := []*Component{
+		{Id: 3, Equiv_set: 1, Quantity: "10"},
+		{Id: 7, Equiv_set: 7, Quantity: "5"},
+		{Id: 1, Equiv_set: 1, Quantity: "20"},
+		{Id: 9, Equiv_set: 9},
+		{Id: 4, Equiv_set: 9, Quantity: "3"},
+	}
+	collapsed := collapseByEquivSet(results, map[int]bool{})
+	ExpectTrue(t, len(collapsed) == 3, "Three sets")
+	ExpectTrue(t, collapsed[0].Id == 3, "Best ranked member represents set")
+	ExpectTrue(t, len(collapsed[0].Members) == 2 &&
+		collapsed[0].Members[0] == 3 && collapsed[0].Members[1] == 1, "Members ranked")
+	expectEqual(t, collapsed[0].CombinedQuantity, "30")
+	ExpectTrue(t, collapsed[1].Id == 7 && len(collapsed[1].Members) == 1, "Single")
+	expectEqual(t, collapsed[2].CombinedQuantity, "~3")
+
+	expanded := collapseByEquivSet(results, parseExpandedSets("1, x"))
+	ExpectTrue(t, len(expanded) == 4, "Expanded set not collapsed")
+	ExpectTrue(t, expanded[0].Id == 3 && expanded[2].Id == 1, "Ranking kept")
+	expectEqual(t, expanded[2].CombinedQuantity, "20")
+}
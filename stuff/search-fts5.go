@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Search engine backed by an SQLite FTS5 virtual table. The table is kept
+// in sync with the component table from Update(), and rebuilt on startup,
+// as the database might have been changed by a binary using the memory
+// engine in the meantime.
+//
+// Requires an SQLite with FTS5 enabled; with github.com/mattn/go-sqlite3
+// this means building with -tags sqlite_fts5. Nothing outside the virtual
+// table depends on FTS5, so the same database can still be used by a
+// binary built without it.
+//
+// Terms match the start of words ("2n39" finds 2N3904), unlike the memory
+// engine, which finds them anywhere in a word ("3904" finds 2N3904).
+//
+// Dashes are removed from the indexed text just like preprocessTerm() does.
+var fts5_schema string = `
+create virtual table if not exists component_fts using fts5(
+       category, value, description, notes, footprint);
+`
+
+var fts5_reindex string = `
+delete from component_fts;
+insert into component_fts (rowid, category, value, description, notes, footprint)
+       select id, replace(category, '-', ''), replace(value, '-', ''),
+              replace(description, '-', ''), replace(notes, '-', ''),
+              replace(footprint, '-', '')
+       from component;
+`
+
+// Earlier versions kept the index in sync with triggers, which made every
+// change fail in binaries without FTS5. Removed whatever engine is used.
+var fts5_drop_triggers string = `
+drop trigger if exists component_fts_insert;
+drop trigger if exists component_fts_update;
+drop trigger if exists component_fts_delete;
+`
+
+type FTS5Searcher struct {
+	findById func(id int) *Component
+	search   *sql.Stmt
+	remove   *sql.Stmt
+	insert   *sql.Stmt
+}
+
+// Create an FTS5 searcher, creating and populating the virtual table.
+// findById is used to look up components for similarity searches.
+func NewFTS5Searcher(db *sql.DB, findById func(id int) *Component) (*FTS5Searcher, error) {
+	start := time.Now()
+	if _, err := db.Exec(fts5_schema); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(fts5_reindex); err != nil {
+		return nil, err
+	}
+	log.Printf("Built FTS5 search index (%s)", time.Since(start))
+
+	// Same field weights as in SearchComponent.scoreTerms(); bm25() is
+	// lower for better matches. Ties are broken like in ScoreList.
+	search, err := db.Prepare(`
+	    SELECT id, ` + component_fields + ` FROM component
+	      JOIN (SELECT rowid AS fts_id,
+	                   bm25(component_fts, 2.0, 3.0, 1.5, 1.2, 1.0) AS score
+	              FROM component_fts WHERE component_fts MATCH ?1)
+	        ON id = fts_id
+	    ORDER BY score, value IS NULL, value, description IS NULL, id`)
+	if err != nil {
+		return nil, err
+	}
+	remove, err := db.Prepare("DELETE FROM component_fts WHERE rowid = ?1")
+	if err != nil {
+		return nil, err
+	}
+	insert, err := db.Prepare("INSERT INTO component_fts (rowid, category, value, description, notes, footprint) VALUES (?1, ?2, ?3, ?4, ?5, ?6)")
+	if err != nil {
+		return nil, err
+	}
+	return &FTS5Searcher{
+		findById: findById,
+		search:   search,
+		remove:   remove,
+		insert:   insert,
+	}, nil
+}
+
+func (s *FTS5Searcher) Close() error {
+	for _, stmt := range []*sql.Stmt{s.search, s.remove, s.insert} {
+		stmt.Close()
+	}
+	return nil
+}
+
+func (s *FTS5Searcher) Update(c *Component) {
+	if _, err := s.remove.Exec(c.Id); err != nil {
+		log.Printf("FTS5 update of %d: %s", c.Id, err)
+		return
+	}
+	noDash := func(text string) string { return strings.Replace(text, "-", "", -1) }
+	if _, err := s.insert.Exec(c.Id, noDash(c.Category), noDash(c.Value),
+		noDash(c.Description), noDash(c.Notes), noDash(c.Footprint)); err != nil {
+		log.Printf("FTS5 update of %d: %s", c.Id, err)
+	}
+}
+
+func (s *FTS5Searcher) Remove(id int) {
+	if _, err := s.remove.Exec(id); err != nil {
+		log.Printf("FTS5 removal of %d: %s", id, err)
+	}
+}
+
+func (s *FTS5Searcher) Search(search_term string, limit int) *SearchResult {
+	output := &SearchResult{
+		OrignialQuery: search_term,
+		Results:       make([]*Component, 0, 10),
+	}
+	search_term = queryRewrite(search_term, s.componentTerms)
+	output.RewrittenQuery = search_term
+	match := fts5Query(preprocessTerm(search_term))
+	if match == "" {
+		return output
+	}
+	rows, err := s.search.Query(match)
+	if err != nil {
+		log.Printf("FTS5 query '%s': %s", match, err)
+		return output
+	}
+	defer rows.Close()
+	for rows.Next() {
+		output.TotalCount++
+		if limit > 0 && len(output.Results) >= limit {
+			continue // Only counting.
+		}
+		c, _ := row2Component(rows)
+		output.Results = append(output.Results, c)
+	}
+	return output
+}
+
+func (s *FTS5Searcher) componentTerms(componentID int) string {
+	c := s.findById(componentID)
+	if c == nil {
+		return ""
+	}
+	return newSearchComponent(c).ToQuery()
+}
+
+// Convert a term to an FTS5 prefix phrase. Part numbers also match their
+// base part number. Returns "" for terms that FTS5 would not find anything
+// for.
+func fts5Phrase(term string) string {
+	if strings.IndexFunc(term, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}) < 0 {
+		return ""
+	}
+	quote := func(t string) string {
+		return `"` + strings.Replace(t, `"`, `""`, -1) + `"*`
+	}
+	if base := basePartNumber(term); base != "" && base != term {
+		return "(" + quote(term) + " OR " + quote(base) + ")"
+	}
+	return quote(term)
+}
+
+// Convert the preprocessed query to an FTS5 expression. Like in
+// SearchComponent.scoreTerms(), consecutive terms are AND-ed until an OR
+// operator, and parenthesis start a sub-expression.
+// Returns the expression and last index it went up to.
+func fts5Expression(terms []string, start int) (string, int) {
+	var alternatives, conjunction []string
+	endConjunction := func() {
+		if len(conjunction) > 0 {
+			alternatives = append(alternatives, strings.Join(conjunction, " AND "))
+		}
+		conjunction = nil
+	}
+	for i := start; i < len(terms); i++ {
+		switch part := terms[i]; {
+		case part == "(":
+			sub_expression, subterm_end := fts5Expression(terms, i+1)
+			if sub_expression != "" {
+				conjunction = append(conjunction, "("+sub_expression+")")
+			}
+			i = subterm_end
+		case part == "|":
+			endConjunction()
+		case part == ")":
+			if start != 0 {
+				endConjunction()
+				return strings.Join(alternatives, " OR "), i
+			}
+			// Unbalanced parenthesis: ignore.
+		default:
+			if phrase := fts5Phrase(part); phrase != "" {
+				conjunction = append(conjunction, phrase)
+			}
+		}
+	}
+	endConjunction()
+	return strings.Join(alternatives, " OR "), len(terms)
+}
+
+// Convert a preprocessed query to an FTS5 MATCH expression. Returns ""
+// if nothing is left to search for.
+func fts5Query(term string) string {
+	expression, _ := fts5Expression(strings.Fields(term), 0)
+	return expression
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"html"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -18,24 +17,33 @@ const (
 	kSearchPage         = "/search"
 	kApiSearchFormatted = "/api/search-formatted"
 	kApiSearch          = "/api/search"
+	kStatsSearches      = "/stats/searches"
+	kApiStatsSearches   = "/api/stats/searches"
+
+	kStatsDefaultDays  = 7
+	kStatsDefaultCount = 25
 )
 
 type SearchHandler struct {
 	store        StuffStore
 	template     *TemplateRenderer
 	imagehandler *ImageHandler
+	stats        *SearchStats
 }
 
-func AddSearchHandler(store StuffStore, template *TemplateRenderer, imagehandler *ImageHandler) {
+func AddSearchHandler(mux Router, store StuffStore, template *TemplateRenderer, imagehandler *ImageHandler) {
 	handler := &SearchHandler{
 		store:        store,
 		template:     template,
 		imagehandler: imagehandler,
+		stats:        NewSearchStats(kSearchStatsCapacity),
 	}
-	http.Handle(kSearchPage, handler)
-	http.Handle("/", handler)
-	http.Handle(kApiSearchFormatted, handler)
-	http.Handle(kApiSearch, handler)
+	mux.Handle(kSearchPage, handler)
+	mux.Handle("/", handler)
+	mux.Handle(kApiSearchFormatted, handler)
+	mux.Handle(kApiSearch, handler)
+	mux.Handle(kStatsSearches, handler)
+	mux.Handle(kApiStatsSearches, handler)
 }
 
 func (h *SearchHandler) ServeHTTP(out http.ResponseWriter, req *http.Request) {
@@ -44,6 +52,10 @@ func (h *SearchHandler) ServeHTTP(out http.ResponseWriter, req *http.Request) {
 		h.apiSearchPageItem(out, req)
 	case strings.HasPrefix(req.URL.Path, kApiSearch):
 		h.apiSearch(out, req)
+	case strings.HasPrefix(req.URL.Path, kStatsSearches):
+		h.showSearchStats(out, req)
+	case strings.HasPrefix(req.URL.Path, kApiStatsSearches):
+		h.apiSearchStats(out, req)
 	default:
 		h.showSearchPage(out, req)
 	}
@@ -52,13 +64,52 @@ func (h *SearchHandler) ServeHTTP(out http.ResponseWriter, req *http.Request) {
 func (h *SearchHandler) showSearchPage(out http.ResponseWriter, r *http.Request) {
 	out.Header().Set("Content-Type", "text/html; charset=utf-8")
 	// Just static html. Maybe serve from /static ?
-	content, _ := ioutil.ReadFile(h.template.baseDir + "/search-result.html")
+	content, _ := h.template.ReadFile("search-result.html")
 	out.Write(content)
 }
 
+// Search and cut the result to the limit. If collapse is set, the
+// results are collapsed by equivalence set (except the sets in expand)
+// and the TotalCount is the number of collapsed results. Only submitted
+// queries are kept in the search statistics.
+func (h *SearchHandler) search(endpoint string, query string, limit int,
+	collapse bool, expand map[int]bool, submitted bool) (*SearchResult, []*CollapsedResult) {
+	if query == "" {
+		return &SearchResult{}, nil
+	}
+	start := time.Now()
+	if !collapse {
+		searchResults := h.store.Search(query, limit)
+		h.stats.Record(endpoint, searchResults, time.Since(start), submitted)
+		output := make([]*CollapsedResult, 0, len(searchResults.Results))
+		for _, c := range searchResults.Results {
+			output = append(output, &CollapsedResult{Component: c})
+		}
+		return searchResults, output
+	}
+	// Need to see all results to know all the members of each set.
+	searchResults := h.store.Search(query, 0)
+	h.stats.Record(endpoint, searchResults, time.Since(start), submitted)
+	output := collapseByEquivSet(searchResults.Results, expand)
+	searchResults.TotalCount = len(output)
+	if len(output) > limit {
+		output = output[:limit]
+	}
+	return searchResults, output
+}
+
+// Collapsing is requested with collapse=1, sets to be shown
+// uncollapsed with expand=<set>,<set>...
+func collapseParams(r *http.Request) (bool, map[int]bool) {
+	collapse := r.FormValue("collapse")
+	return collapse != "" && collapse != "0", parseExpandedSets(r.FormValue("expand"))
+}
+
 type JsonComponent struct {
 	Component
-	Image string `json:"img"`
+	Image            string `json:"img"`
+	Members          []int  `json:"members,omitempty"` // If collapsed.
+	CombinedQuantity string `json:"combined_quantity,omitempty"`
 }
 type JsonApiSearchResult struct {
 	Directlink string          `json:"link"`
@@ -73,6 +124,9 @@ func encodeUriComponent(str string) string {
 	return u.String()
 }
 func (h *SearchHandler) apiSearch(out http.ResponseWriter, r *http.Request) {
+	if !readOnlyRequest(out, r) {
+		return
+	}
 	// Allow very brief caching, so that editing the query does not
 	// necessarily has to trigger a new server roundtrip.
 	out.Header().Set("Cache-Control", "max-age=10")
@@ -87,34 +141,32 @@ func (h *SearchHandler) apiSearch(out http.ResponseWriter, r *http.Request) {
 	if limit > maxOutLen {
 		limit = maxOutLen
 	}
-	var searchResults *SearchResult
-	if query != "" {
-		searchResults = h.store.Search(query)
-	}
-	outlen := limit
-	if len(searchResults.Results) < limit {
-		outlen = len(searchResults.Results)
-	}
+	collapse, expand := collapseParams(r)
+	_, results := h.search("search", query, limit, collapse, expand, true)
 	jsonResult := &JsonApiSearchResult{
 		Directlink: encodeUriComponent("/search#" + query),
-		Items:      make([]JsonComponent, outlen),
+		Items:      make([]JsonComponent, len(results)),
 	}
 
-	for i := 0; i < outlen; i++ {
-		var c = searchResults.Results[i]
-		jsonResult.Items[i].Component = *c
+	for i, c := range results {
+		jsonResult.Items[i].Component = *c.Component
 		jsonResult.Items[i].Image = fmt.Sprintf("/img/%d", c.Id)
+		if collapse {
+			jsonResult.Items[i].Members = c.Members
+			jsonResult.Items[i].CombinedQuantity = c.CombinedQuantity
+		}
 	}
 
 	json, _ := json.MarshalIndent(jsonResult, "", "  ")
-	out.Write(json)
+	sendWithETag(out, r, json)
 }
 
 // Pre-formatted search for quick div replacements.
 type JsonHtmlSearchResultRecord struct {
-	Id     int    `json:"id"`
-	Label  string `json:"txt"`
-	ImgUrl string `json:"img"`
+	Id      int    `json:"id"`
+	Label   string `json:"txt"`
+	ImgUrl  string `json:"img"`
+	Members []int  `json:"members,omitempty"` // If collapsed.
 }
 
 type JsonHtmlSearchResult struct {
@@ -125,7 +177,9 @@ type JsonHtmlSearchResult struct {
 }
 
 func (h *SearchHandler) apiSearchPageItem(out http.ResponseWriter, r *http.Request) {
-	defer ElapsedPrint("Query", time.Now())
+	if !readOnlyRequest(out, r) {
+		return
+	}
 	// Allow very brief caching, so that editing the query does not
 	// necessarily has to trigger a new server roundtrip.
 	out.Header().Set("Cache-Control", "max-age=10")
@@ -134,8 +188,13 @@ func (h *SearchHandler) apiSearchPageItem(out http.ResponseWriter, r *http.Reque
 		out.Write([]byte(`{"count":0, "queryinfo":"", "resultinfo":"", "items":[]}`))
 		return
 	}
+	outlen := 24 // Limit max output
+	collapse, expand := collapseParams(r)
 	start := time.Now()
-	searchResults := h.store.Search(query)
+	// The search page asks while the user is typing; only the query
+	// the user settled on is counted.
+	submitted := r.FormValue("submit") != "" && r.FormValue("submit") != "0"
+	searchResults, results := h.search("search-formatted", query, outlen, collapse, expand, submitted)
 	elapsed := time.Now().Sub(start)
 	elapsed = time.Microsecond * ((elapsed + time.Microsecond/2) / time.Microsecond)
 
@@ -146,13 +205,12 @@ func (h *SearchHandler) apiSearchPageItem(out http.ResponseWriter, r *http.Reque
 		queryInfo = searchResults.RewrittenQuery
 	}
 
-	outlen := 24 // Limit max output
-	if len(searchResults.Results) < outlen {
-		outlen = len(searchResults.Results)
+	if len(results) < outlen {
+		outlen = len(results)
 	}
 	jsonResult := &JsonHtmlSearchResult{
-		Count:      len(searchResults.Results),
-		ResultInfo: fmt.Sprintf("%d results (%s)", len(searchResults.Results), elapsed),
+		Count:      searchResults.TotalCount,
+		ResultInfo: fmt.Sprintf("%d results (%s)", searchResults.TotalCount, elapsed),
 		QueryInfo:  queryInfo,
 		Items:      make([]JsonHtmlSearchResultRecord, outlen),
 	}
@@ -160,9 +218,9 @@ func (h *SearchHandler) apiSearchPageItem(out http.ResponseWriter, r *http.Reque
 	pusher, _ := out.(http.Pusher) // HTTP/2 pushing if available.
 
 	for i := 0; i < outlen; i++ {
-		var c = searchResults.Results[i]
+		var c = results[i]
 		jsonResult.Items[i].Id = c.Id
-		if h.imagehandler.hasComponentImage(c) {
+		if h.imagehandler.hasComponentImage(c.Component) {
 			imgUrl := fmt.Sprintf("/img/%d", c.Id)
 			jsonResult.Items[i].ImgUrl = imgUrl
 			if pusher != nil {
@@ -180,8 +238,75 @@ func (h *SearchHandler) apiSearchPageItem(out http.ResponseWriter, r *http.Reque
 		jsonResult.Items[i].Label = "<b>" + html.EscapeString(c.Value) + "</b> " +
 			html.EscapeString(c.Description) +
 			fmt.Sprintf(" <span class='idtxt'>(ID:%d)</span>", c.Id)
+		switch {
+		case len(c.Members) > 1:
+			jsonResult.Items[i].Members = c.Members
+			quantity := ""
+			if c.CombinedQuantity != "" {
+				quantity = ", qty " + html.EscapeString(c.CombinedQuantity)
+			}
+			jsonResult.Items[i].Label += fmt.Sprintf(
+				" <span class='settoggle' data-set='%d'>&#9656; %d drawers%s</span>",
+				c.Equiv_set, len(c.Members), quantity)
+		case collapse && expand[c.Equiv_set]:
+			jsonResult.Items[i].Label += fmt.Sprintf(
+				" <span class='settoggle' data-set='%d'>&#9662; combine</span>",
+				c.Equiv_set)
+		}
 	}
 
 	json, _ := json.Marshal(jsonResult)
 	out.Write(json)
 }
+
+type SearchStatsPage struct {
+	Days              int
+	TopQueries        []QueryCount
+	TopZeroResultOnly []QueryCount
+}
+
+type JsonApiSearchStatsResult struct {
+	Since             time.Time    `json:"since"`
+	TopQueries        []QueryCount `json:"top_queries"`
+	TopZeroResultOnly []QueryCount `json:"top_zero_result_queries"`
+}
+
+// Parse the time window and number of queries to show from the request.
+func searchStatsParams(r *http.Request) (days int, count int) {
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days <= 0 {
+		days = kStatsDefaultDays
+	}
+	count, err = strconv.Atoi(r.FormValue("count"))
+	if err != nil || count <= 0 {
+		count = kStatsDefaultCount
+	}
+	return days, count
+}
+
+func (h *SearchHandler) showSearchStats(out http.ResponseWriter, r *http.Request) {
+	days, count := searchStatsParams(r)
+	since := time.Now().AddDate(0, 0, -days)
+	page := &SearchStatsPage{
+		Days:              days,
+		TopQueries:        h.stats.TopQueries(since, count, false),
+		TopZeroResultOnly: h.stats.TopQueries(since, count, true),
+	}
+	h.template.Render(out, "search-stats.html", page)
+}
+
+func (h *SearchHandler) apiSearchStats(out http.ResponseWriter, r *http.Request) {
+	if !readOnlyRequest(out, r) {
+		return
+	}
+	out.Header().Set("Content-Type", "application/json")
+	days, count := searchStatsParams(r)
+	since := time.Now().AddDate(0, 0, -days)
+	jsonResult := &JsonApiSearchStatsResult{
+		Since:             since,
+		TopQueries:        h.stats.TopQueries(since, count, false),
+		TopZeroResultOnly: h.stats.TopQueries(since, count, true),
+	}
+	json, _ := json.MarshalIndent(jsonResult, "", "  ")
+	out.Write(json)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemorySearcher is a Searcher that keeps a FulltextSearch index of all
+// components in memory. The index can be persisted in a snapshot file
+// to not having to rebuild it on each start.
+type MemorySearcher struct {
+	db         *sql.DB
+	iterateAll func(func(comp *Component) bool)
+
+	lock       sync.Mutex
+	fts        *FulltextSearch // The index searches are served from.
+	ftsPending *FulltextSearch // Index currently rebuilt; nil if none.
+	removed    map[int]bool    // Removed while rebuilding; not to be added.
+
+	snapshotFile string         // Persisted search index; "" for none.
+	rebuilding   sync.WaitGroup // Background search index rebuild.
+}
+
+// Create a new in-memory searcher over all the components returned by
+// iterateAll. If snapshotFile is given and it is current, it is used right
+// away, otherwise the index is rebuilt.
+func NewMemorySearcher(db *sql.DB, iterateAll func(func(comp *Component) bool),
+	snapshotFile string) *MemorySearcher {
+	result := &MemorySearcher{
+		db:           db,
+		iterateAll:   iterateAll,
+		snapshotFile: snapshotFile,
+	}
+	result.init()
+	return result
+}
+
+func (s *MemorySearcher) searchGeneration() SearchGeneration {
+	var result SearchGeneration
+	err := s.db.QueryRow("SELECT database_id, generation FROM search_generation").Scan(
+		&result.DatabaseId, &result.Generation)
+	if err != nil {
+		log.Printf("Can't determine search generation: %s", err)
+	}
+	return result
+}
+
+// Populate the search index: from the snapshot if available, otherwise
+// from the database. A snapshot that is not current anymore is still
+// used to serve searches while we rebuild the index in the background.
+func (s *MemorySearcher) init() {
+	if s.snapshotFile != "" {
+		fts, generation, err := LoadSearchSnapshot(s.snapshotFile)
+		if err == nil {
+			s.fts = fts
+			if generation == s.searchGeneration() {
+				log.Printf("Loaded full text search with %d items from %s",
+					fts.Len(), s.snapshotFile)
+				return
+			}
+			log.Printf("Search snapshot %s is stale; rebuilding in background",
+				s.snapshotFile)
+			s.rebuilding.Add(1)
+			go func() {
+				defer s.rebuilding.Done()
+				s.rebuild()
+			}()
+			return
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("Ignoring search snapshot %s: %s", s.snapshotFile, err)
+		}
+	}
+	s.fts = NewFulltextSearch()
+	s.rebuild()
+}
+
+// Build a fresh search index from the database and replace the current one.
+// Updates arriving while we build are applied to both indexes.
+func (s *MemorySearcher) rebuild() {
+	start := time.Now()
+	generation := s.searchGeneration()
+	fresh := NewFulltextSearch()
+	s.lock.Lock()
+	s.ftsPending = fresh
+	s.removed = make(map[int]bool)
+	s.lock.Unlock()
+
+	// Read everything first to not hold the database while indexing.
+	all := make([]*Component, 0, 1000)
+	s.iterateAll(func(c *Component) bool {
+		all = append(all, c)
+		return true
+	})
+	for _, c := range all {
+		// Concurrent updates and removals are more recent than what we read.
+		s.lock.Lock()
+		if !s.removed[c.Id] {
+			fresh.addIfAbsent(c)
+		}
+		s.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	s.fts = fresh
+	s.ftsPending = nil
+	s.removed = nil
+	s.lock.Unlock()
+	log.Printf("Prepopulated full text search with %d items (%s)",
+		len(all), time.Since(start))
+
+	if s.snapshotFile != "" {
+		if err := fresh.SaveSnapshot(s.snapshotFile, generation); err != nil {
+			log.Printf("Can't write search snapshot: %s", err)
+		}
+	}
+}
+
+// Persist the current index, so that the next start does not have to
+// rebuild it. Call when no updates are coming in anymore.
+func (s *MemorySearcher) Close() error {
+	s.rebuilding.Wait()
+	if s.snapshotFile == "" {
+		return nil
+	}
+	return s.index().SaveSnapshot(s.snapshotFile, s.searchGeneration())
+}
+
+func (s *MemorySearcher) index() *FulltextSearch {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.fts
+}
+
+func (s *MemorySearcher) Update(c *Component) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fts.Update(c)
+	if s.ftsPending != nil {
+		s.ftsPending.Update(c)
+		delete(s.removed, c.Id)
+	}
+}
+
+func (s *MemorySearcher) Remove(id int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fts.Remove(id)
+	if s.ftsPending != nil {
+		s.ftsPending.Remove(id)
+		s.removed[id] = true
+	}
+}
+
+func (s *MemorySearcher) Search(search_term string, limit int) *SearchResult {
+	return s.index().Search(search_term, limit)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Building the search index requires reading and preprocessing every
+// component in the database. To start up quickly, we persist the index
+// in a sidecar file next to the database and load it if it is still
+// current.
+//
+// File format: sha256 checksum of the payload, followed by the gob encoded
+// searchSnapshot payload.
+
+// Bump this whenever the preprocessing of the components changes, so that
+// old snapshots are not used anymore.
+const kSearchSnapshotVersion = 1
+
+// SearchGeneration identifies the state of the database a search index
+// has been built from. Every change to the component table results in a
+// new Generation (see search_generation_schema).
+type SearchGeneration struct {
+	DatabaseId string
+	Generation int64
+}
+
+type searchSnapshotComponent struct {
+	Orig         Component
+	Preprocessed Component
+	PartBases    Component
+}
+
+type searchSnapshot struct {
+	Version    int
+	Generation SearchGeneration
+	Components []searchSnapshotComponent
+}
+
+// Write the index with the given generation to the output.
+func (s *FulltextSearch) WriteSnapshot(out io.Writer, generation SearchGeneration) error {
+	snapshot := &searchSnapshot{
+		Version:    kSearchSnapshotVersion,
+		Generation: generation,
+	}
+	snapshot.Components = make([]searchSnapshotComponent, 0, s.Len())
+	for _, shard := range s.shards {
+		shard.lock.RLock()
+		for _, c := range shard.id2Component {
+			snapshot.Components = append(snapshot.Components,
+				searchSnapshotComponent{
+					Orig:         *c.orig,
+					Preprocessed: *c.preprocessed,
+					PartBases:    *c.partBases,
+				})
+		}
+		shard.lock.RUnlock()
+	}
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(snapshot); err != nil {
+		return err
+	}
+	checksum := sha256.Sum256(payload.Bytes())
+	if _, err := out.Write(checksum[:]); err != nil {
+		return err
+	}
+	_, err := payload.WriteTo(out)
+	return err
+}
+
+// Read an index written by WriteSnapshot(). Returns the index and the
+// generation it was built from.
+func ReadSearchSnapshot(in io.Reader) (*FulltextSearch, SearchGeneration, error) {
+	content, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, SearchGeneration{}, err
+	}
+	if len(content) < sha256.Size {
+		return nil, SearchGeneration{}, errors.New("search snapshot truncated")
+	}
+	payload := content[sha256.Size:]
+	checksum := sha256.Sum256(payload)
+	if !bytes.Equal(checksum[:], content[:sha256.Size]) {
+		return nil, SearchGeneration{}, errors.New("search snapshot checksum mismatch")
+	}
+
+	snapshot := &searchSnapshot{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(snapshot); err != nil {
+		return nil, SearchGeneration{}, err
+	}
+	if snapshot.Version != kSearchSnapshotVersion {
+		return nil, SearchGeneration{}, fmt.Errorf("search snapshot version %d, expected %d",
+			snapshot.Version, kSearchSnapshotVersion)
+	}
+
+	result := NewFulltextSearch()
+	for i := range snapshot.Components {
+		c := &snapshot.Components[i]
+		result.shard(c.Orig.Id).id2Component[c.Orig.Id] = &SearchComponent{
+			orig:         &c.Orig,
+			preprocessed: &c.Preprocessed,
+			partBases:    &c.PartBases,
+		}
+	}
+	return result, snapshot.Generation, nil
+}
+
+// Save snapshot to the given file. The file is replaced atomically, so
+// readers never see a partially written snapshot.
+func (s *FulltextSearch) SaveSnapshot(filename string, generation SearchGeneration) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after successful rename.
+	if err = s.WriteSnapshot(tmp, generation); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Load snapshot from the given file.
+func LoadSearchSnapshot(filename string) (*FulltextSearch, SearchGeneration, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, SearchGeneration{}, err
+	}
+	defer f.Close()
+	return ReadSearchSnapshot(f)
+}
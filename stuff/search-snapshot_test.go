@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestSearchSnapshotRoundtrip(t *testing.T) {
+	fts := NewFulltextSearch()
+	fts.Update(&Component{Id: 1, Category: "Resistor", Value: "10k"})
+	fts.Update(&Component{Id: 2, Category: "Transistor", Value: "2N3904"})
+
+	generation := SearchGeneration{DatabaseId: "abc", Generation: 42}
+	var buf bytes.Buffer
+	if err := fts.WriteSnapshot(&buf, generation); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	loaded, loadedGeneration, err := ReadSearchSnapshot(bytes.NewReader(snapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectTrue(t, loadedGeneration == generation, "Generation roundtrip")
+	ExpectTrue(t, loaded.Len() == 2, "Number of components")
+	result := loaded.Search("2N3904BU", 0).Results
+	ExpectTrue(t, len(result) == 1 && result[0].Id == 2, "Search in loaded index")
+
+	// Corrupted content is detected.
+	snapshot[len(snapshot)-1] ^= 0xff
+	_, _, err = ReadSearchSnapshot(bytes.NewReader(snapshot))
+	ExpectTrue(t, err != nil, "Corrupted snapshot")
+
+	_, _, err = ReadSearchSnapshot(bytes.NewReader(snapshot[:10]))
+	ExpectTrue(t, err != nil, "Truncated snapshot")
+}
+
+func TestSearchSnapshotBackend(t *testing.T) {
+	dbfile, _ := ioutil.TempFile("", "search-snapshot")
+	defer syscall.Unlink(dbfile.Name())
+	snapshotFile := dbfile.Name() + ".search-index"
+	defer os.Remove(snapshotFile)
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, _ := NewDBBackend(db, true, kSearchEngineMemory, snapshotFile)
+	searcher := store.searcher.(*MemorySearcher)
+	store.EditRecord(Editor{}, 1, func(c *Component) bool { c.Value = "foo"; return true })
+	before := searcher.searchGeneration()
+	store.EditRecord(Editor{}, 2, func(c *Component) bool { c.Value = "bar"; return true })
+	ExpectTrue(t, searcher.searchGeneration().Generation > before.Generation,
+		"Generation increments with each change")
+	ExpectTrue(t, searcher.searchGeneration().DatabaseId == before.DatabaseId,
+		"Database id stays the same")
+
+	// Persist the current state.
+	searcher.rebuild()
+	_, generation, err := LoadSearchSnapshot(snapshotFile)
+	ExpectTrue(t, err == nil, "Snapshot written")
+	ExpectTrue(t, generation == searcher.searchGeneration(), "Snapshot is current")
+
+	// Snapshot is current: loaded as-is.
+	store, _ = NewDBBackend(db, false, kSearchEngineMemory, snapshotFile)
+	ExpectTrue(t, len(store.Search("bar", 0).Results) == 1, "Search loaded snapshot")
+
+	// Change the database behind the back of the snapshot.
+	db.Exec("UPDATE component SET value='baz' WHERE id=2")
+	store, _ = NewDBBackend(db, false, kSearchEngineMemory, snapshotFile)
+	searcher = store.searcher.(*MemorySearcher)
+	searcher.rebuilding.Wait()
+	ExpectTrue(t, len(store.Search("bar", 0).Results) == 0, "Stale entry gone")
+	ExpectTrue(t, len(store.Search("baz", 0).Results) == 1, "Rebuilt index")
+	_, generation, _ = LoadSearchSnapshot(snapshotFile)
+	ExpectTrue(t, generation == searcher.searchGeneration(), "Snapshot updated")
+}
+
+func TestSearchSnapshotSavedOnClose(t *testing.T) {
+	dbfile, _ := ioutil.TempFile("", "search-snapshot")
+	defer syscall.Unlink(dbfile.Name())
+	snapshotFile := dbfile.Name() + ".search-index"
+	defer os.Remove(snapshotFile)
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, _ := NewDBBackend(db, true, kSearchEngineMemory, snapshotFile)
+	store.EditRecord(Editor{}, 1, func(c *Component) bool { c.Value = "foo"; return true })
+	ExpectTrue(t, store.Close() == nil, "Close")
+	fts, generation, err := LoadSearchSnapshot(snapshotFile)
+	ExpectTrue(t, err == nil, "Snapshot written")
+	expectEqualInt(t, fts.Len(), 1)
+
+	// Next start uses it right away.
+	store, _ = NewDBBackend(db, false, kSearchEngineMemory, snapshotFile)
+	ExpectTrue(t, generation == store.searcher.(*MemorySearcher).searchGeneration(), "Snapshot is current")
+	ExpectTrue(t, len(store.Search("foo", 0).Results) == 1, "Search loaded snapshot")
+}
+
+func TestSearchRemovedWhileRebuilding(t *testing.T) {
+	dbfile, _ := ioutil.TempFile("", "search-rebuild")
+	defer syscall.Unlink(dbfile.Name())
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, _ := NewDBBackend(db, true, kSearchEngineMemory, "")
+	store.EditRecord(Editor{}, 1, func(c *Component) bool { c.Value = "foo"; return true })
+	store.EditRecord(Editor{}, 2, func(c *Component) bool { c.Value = "bar"; return true })
+
+	// Removed after the rebuild read the database, before it is indexed.
+	searcher := store.searcher.(*MemorySearcher)
+	iterateAll := searcher.iterateAll
+	searcher.iterateAll = func(callback func(comp *Component) bool) {
+		iterateAll(callback)
+		searcher.Remove(2)
+	}
+	searcher.rebuild()
+	ExpectTrue(t, len(store.Search("bar", 0).Results) == 0, "Stays removed")
+	ExpectTrue(t, len(store.Search("foo", 0).Results) == 1, "Others indexed")
+}
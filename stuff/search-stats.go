@@ -0,0 +1,164 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Keep track of what people are searching for, in particular what they
+// don't find: that is our shopping list.
+// We only record the queries themselves, nothing about who asked.
+
+const kSearchStatsCapacity = 20000 // Number of recent queries to keep.
+
+var (
+	searchQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stuff_search_queries_total",
+		Help: "Number of search queries served.",
+	}, []string{"endpoint"})
+	searchZeroResultQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stuff_search_zero_result_queries_total",
+		Help: "Number of search queries without any result.",
+	}, []string{"endpoint"})
+	searchLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stuff_search_duration_seconds",
+		Help:    "Time to answer a search query.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8), // 100µs..1.6s
+	}, []string{"endpoint"})
+	searchResultCount = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stuff_search_results",
+		Help:    "Number of results per search query.",
+		Buckets: []float64{0, 1, 2, 5, 10, 24, 50, 100, 500, 1000},
+	}, []string{"endpoint"})
+)
+
+type SearchRecord struct {
+	Time      time.Time
+	Query     string // Original query
+	Rewritten string // Query after rewrite
+	Results   int
+}
+
+// Bounded store of the most recent search queries.
+type SearchStats struct {
+	lock    sync.Mutex
+	records []SearchRecord // Ring buffer
+	next    int            // Position of next record to write
+	full    bool           // Ring buffer wrapped around
+}
+
+func NewSearchStats(capacity int) *SearchStats {
+	return &SearchStats{
+		records: make([]SearchRecord, capacity),
+	}
+}
+
+// Update the metrics for a query answered at the given endpoint. If
+// submitted, also remember the query for the top queries; prefixes sent
+// while typing would just crowd out the real ones.
+func (s *SearchStats) Record(endpoint string, result *SearchResult, elapsed time.Duration, submitted bool) {
+	searchQueries.WithLabelValues(endpoint).Inc()
+	if result.TotalCount == 0 {
+		searchZeroResultQueries.WithLabelValues(endpoint).Inc()
+	}
+	searchLatency.WithLabelValues(endpoint).Observe(elapsed.Seconds())
+	searchResultCount.WithLabelValues(endpoint).Observe(float64(result.TotalCount))
+
+	if !submitted {
+		return
+	}
+	s.add(SearchRecord{
+		Time:      time.Now(),
+		Query:     result.OrignialQuery,
+		Rewritten: result.RewrittenQuery,
+		Results:   result.TotalCount,
+	})
+}
+
+func (s *SearchStats) add(record SearchRecord) {
+	if len(s.records) == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.records[s.next] = record
+	s.next++
+	if s.next == len(s.records) {
+		s.next = 0
+		s.full = true
+	}
+}
+
+// Aggregated statistics of one query.
+type QueryCount struct {
+	Query     string    `json:"query"`
+	Rewritten string    `json:"rewritten,omitempty"` // Most recent rewrite
+	Count     int       `json:"count"`
+	Results   int       `json:"results"` // Most recent result count
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Queries that only differ in case or spacing are considered the same.
+func normalizeQuery(query string) string {
+	return strings.ToLower(strings.Join(strings.Fields(query), " "))
+}
+
+// Returns the most frequent queries since the given time, at most
+// limit. If zeroResultsOnly is set, only queries that did not find
+// anything (the last time they were asked) are considered.
+func (s *SearchStats) TopQueries(since time.Time, limit int, zeroResultsOnly bool) []QueryCount {
+	byQuery := make(map[string]*QueryCount)
+	s.lock.Lock()
+	end := s.next
+	if s.full {
+		end = len(s.records)
+	}
+	for i := 0; i < end; i++ {
+		record := &s.records[i]
+		if record.Time.Before(since) {
+			continue
+		}
+		key := normalizeQuery(record.Query)
+		if key == "" {
+			continue
+		}
+		count, found := byQuery[key]
+		if !found {
+			count = &QueryCount{Query: key}
+			byQuery[key] = count
+		}
+		count.Count++
+		if record.Time.After(count.LastSeen) {
+			count.LastSeen = record.Time
+			count.Results = record.Results
+			count.Rewritten = ""
+			if record.Rewritten != record.Query {
+				count.Rewritten = record.Rewritten
+			}
+		}
+	}
+	s.lock.Unlock()
+
+	result := make([]QueryCount, 0, len(byQuery))
+	for _, count := range byQuery {
+		if zeroResultsOnly && count.Results > 0 {
+			continue
+		}
+		result = append(result, *count)
+	}
+	sort.Slice(result, func(a, b int) bool {
+		if result[a].Count != result[b].Count {
+			return result[a].Count > result[b].Count
+		}
+		return result[a].Query < result[b].Query
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSearchStatsTopQueries(t *testing.T) {
+	stats := NewSearchStats(10)
+	now := time.Now()
+	record := func(age time.Duration, query string, results int) {
+		stats.add(SearchRecord{
+			Time: now.Add(-age), Query: query, Rewritten: query, Results: results,
+		})
+	}
+	record(48*time.Hour, "old", 0)
+	record(time.Minute, "10k", 5)
+	record(time.Minute, "10K ", 5) // Same query
+	record(time.Minute, "ne555", 2)
+	record(time.Minute, "flux capacitor", 0)
+	record(time.Minute, "flux  capacitor", 0)
+	record(time.Minute, "unobtainium", 0)
+
+	top := stats.TopQueries(now.Add(-time.Hour), 10, false)
+	ExpectTrue(t, len(top) == 4, fmt.Sprintf("Expected 4, got %d", len(top)))
+	ExpectTrue(t, top[0].Query == "10k" && top[0].Count == 2, "Most popular first")
+	ExpectTrue(t, top[1].Query == "flux capacitor" && top[1].Count == 2, "Tie: alphabetical")
+
+	zero := stats.TopQueries(now.Add(-time.Hour), 10, true)
+	ExpectTrue(t, len(zero) == 2, "Zero result queries")
+	ExpectTrue(t, zero[0].Query == "flux capacitor" && zero[1].Query == "unobtainium",
+		"Zero result ordering")
+
+	// Larger window includes the old query.
+	ExpectTrue(t, len(stats.TopQueries(now.Add(-72*time.Hour), 10, true)) == 3, "Window")
+	ExpectTrue(t, len(stats.TopQueries(now.Add(-72*time.Hour), 1, false)) == 1, "Limit")
+
+	// Bounded: old records are overwritten.
+	for i := 0; i < 10; i++ {
+		record(time.Second, "resistor", 10)
+	}
+	top = stats.TopQueries(now.Add(-72*time.Hour), 10, false)
+	ExpectTrue(t, len(top) == 1 && top[0].Count == 10, "Only most recent kept")
+}
+
+func TestSearchStatsOnlySubmittedQueries(t *testing.T) {
+	store, cleanup := newConformanceStore(t, kSearchEngineMemory)
+	defer cleanup()
+	store.EditRecord(Editor{}, 1, func(c *Component) bool {
+		c.Value = "2N3904"
+		return true
+	})
+	imgdir, _ := ioutil.TempDir("", "search-stats-img")
+	defer os.RemoveAll(imgdir)
+	templates := NewTemplateRenderer("template", false)
+	stats := NewSearchStats(100)
+	handler := &SearchHandler{
+		store:        store,
+		template:     templates,
+		imagehandler: &ImageHandler{store: store, template: templates, imgPath: imgdir},
+		stats:        stats,
+	}
+	get := func(url string) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+	// Search as you type.
+	get("/api/search-formatted?q=2n")
+	get("/api/search-formatted?q=2n39")
+	get("/api/search-formatted?q=2n390")
+	get("/api/search-formatted?q=2n3904")
+	get("/api/search-formatted?q=2n3904&submit=1")
+	get("/api/search-formatted?q=2n3906&submit=0")
+	get("/api/search?q=ne555") // Programs don't type.
+
+	top := stats.TopQueries(time.Now().Add(-time.Hour), 10, false)
+	expectEqualInt(t, len(top), 2)
+	expectEqual(t, top[0].Query, "2n3904")
+	expectEqualInt(t, top[0].Count, 1)
+	expectEqual(t, top[1].Query, "ne555")
+}
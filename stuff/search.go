@@ -1,12 +1,15 @@
 package main
 
 import (
+	"container/heap"
 	"fmt"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -18,6 +21,20 @@ var (
 	likeTerm                = regexp.MustCompile(`(?i)like:([0-9]+)`)
 )
 
+// Searcher is a search engine over the components. The StuffStore
+// delegates searches to it and informs it about changes.
+type Searcher interface {
+	// Update the index with the new content of the component.
+	Update(c *Component)
+
+	// Forget the component with the given id; it does not exist anymore.
+	Remove(id int)
+
+	// Given a search term, returns the components that match, ordered
+	// by score. If limit > 0, at most limit components are returned.
+	Search(search_term string, limit int) *SearchResult
+}
+
 // componentResolver converts a componentID to a string containing the
 // component's terms or blank if the component doesn't exist.
 type componentResolver func(componentID int) string
@@ -122,13 +139,16 @@ func maxlist(values ...float32) (max float32) {
 //     multiple sub-terms in the OR expression match, this won't result in
 //     keyword stuffing (though one could consider adding a much smaller
 //     constant weight for number of sub-terms that do match).
-func (c *SearchComponent) scoreTerms(terms []string, start int) (float32, int) {
+//
+// Terms that look like part numbers also match the base part number of
+// the component (see basePartNumber()), scoring just below an exact match.
+func (c *SearchComponent) scoreTerms(terms []string, bases []string, start int) (float32, int) {
 	var last_or_term float32 = 0.0
 	var current_score float32 = 0.0
 	for i := start; i < len(terms); i++ {
 		part := terms[i]
 		if part == "(" && i < len(terms)-1 {
-			sub_score, subterm_end := c.scoreTerms(terms, i+1)
+			sub_score, subterm_end := c.scoreTerms(terms, bases, i+1)
 			if sub_score <= 0 {
 				current_score = -1000 // See below for reasoning
 			} else {
@@ -153,6 +173,14 @@ func (c *SearchComponent) scoreTerms(terms []string, start int) (float32, int) {
 			1.5*StringScore(part, c.preprocessed.Description),
 			1.2*StringScore(part, c.preprocessed.Notes),
 			1.0*StringScore(part, c.preprocessed.Footprint))
+		if bases[i] != "" && c.partBases != nil {
+			score = maxlist(score, kBasePartNumberWeight*maxlist(
+				2.0*StringScore(bases[i], c.partBases.Category),
+				3.0*StringScore(bases[i], c.partBases.Value),
+				1.5*StringScore(bases[i], c.partBases.Description),
+				1.2*StringScore(bases[i], c.partBases.Notes),
+				1.0*StringScore(bases[i], c.partBases.Footprint)))
+		}
 		if score == 0 {
 			// We essentially would do an early out here, but
 			// since we're in the middle of parsing until we reach
@@ -170,7 +198,12 @@ func (c *SearchComponent) scoreTerms(terms []string, start int) (float32, int) {
 
 // Matches the component and returns a score
 func (c *SearchComponent) MatchScore(term string) float32 {
-	score, _ := c.scoreTerms(strings.Fields(term), 0)
+	terms := strings.Fields(term)
+	bases := make([]string, len(terms))
+	for i, t := range terms {
+		bases[i] = basePartNumber(t)
+	}
+	score, _ := c.scoreTerms(terms, bases, 0)
 	return score
 }
 
@@ -193,70 +226,123 @@ func (c *SearchComponent) ToQuery() string {
 	return fmt.Sprintf("(%s)", strings.Join(strings.Fields(sb.String()), "|"))
 }
 
+// Base part number matches are weighted a little less than exact matches.
+const kBasePartNumberWeight = 0.95
+
 type SearchComponent struct {
 	orig         *Component
 	preprocessed *Component
+	partBases    *Component // Base part numbers found in preprocessed.
 }
-type FulltextSearch struct {
+
+// The components are distributed over shards, so that we can score them
+// in parallel and updates only need to lock the shard they are in.
+type searchShard struct {
 	lock         sync.RWMutex
 	id2Component map[int]*SearchComponent
 }
 
+type FulltextSearch struct {
+	generation uint64 // Incremented on each change. First for alignment.
+	shards     []*searchShard
+	cache      *queryCache
+}
+
 func NewFulltextSearch() *FulltextSearch {
-	return &FulltextSearch{
-		id2Component: make(map[int]*SearchComponent),
+	result := &FulltextSearch{
+		shards: make([]*searchShard, runtime.GOMAXPROCS(0)),
+		cache:  newQueryCache(kQueryCacheSize),
+	}
+	for i := range result.shards {
+		result.shards[i] = &searchShard{
+			id2Component: make(map[int]*SearchComponent),
+		}
 	}
+	return result
+}
+
+func (s *FulltextSearch) shard(componentID int) *searchShard {
+	return s.shards[uint(componentID)%uint(len(s.shards))]
+}
+
+// Number of components in the index.
+func (s *FulltextSearch) Len() int {
+	result := 0
+	for _, shard := range s.shards {
+		shard.lock.RLock()
+		result += len(shard.id2Component)
+		shard.lock.RUnlock()
+	}
+	return result
 }
 
 type ScoredComponent struct {
 	score float32
 	comp  *Component
 }
-type ScoreList []*ScoredComponent
 
-func (s ScoreList) Len() int {
-	return len(s)
-}
-func (s ScoreList) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
-}
-func (s ScoreList) Less(a, b int) bool {
-	diff := s[a].score - s[b].score
+// Returns if this component should be listed before the other one.
+func (a *ScoredComponent) rankedBefore(b *ScoredComponent) bool {
+	diff := a.score - b.score
 	if diff != 0 {
 		// We want to reverse score: highest match first
 		return diff > 0
 	}
 
-	if s[a].comp.Value != s[b].comp.Value {
+	if a.comp.Value != b.comp.Value {
 		// Items that have a value vs. none are scored higher.
-		if s[a].comp.Value == "" {
+		if a.comp.Value == "" {
 			return false
 		}
-		if s[b].comp.Value == "" {
+		if b.comp.Value == "" {
 			return true
 		}
 		// other than that: alphabetically
-		return s[a].comp.Value < s[b].comp.Value
+		return a.comp.Value < b.comp.Value
 	}
 
-	if s[a].comp.Description != s[b].comp.Description {
+	if a.comp.Description != b.comp.Description {
 		// Items that have a Description vs. none are scored higher.
-		if s[a].comp.Description == "" {
+		if a.comp.Description == "" {
 			return false
 		}
-		if s[b].comp.Description == "" {
+		if b.comp.Description == "" {
 			return true
 		}
 	}
 
 	// If we reach this, make it at least predictable.
-	return s[a].comp.Id < s[b].comp.Id // stable
+	return a.comp.Id < b.comp.Id // stable
 }
 
-func (s *FulltextSearch) Update(c *Component) {
-	if c == nil {
-		return
-	}
+type ScoreList []*ScoredComponent
+
+func (s ScoreList) Len() int {
+	return len(s)
+}
+func (s ScoreList) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s ScoreList) Less(a, b int) bool {
+	return s[a].rankedBefore(s[b])
+}
+
+// Heap with the lowest ranked component on top. Used to keep the top-K
+// components while scoring.
+type scoreHeap []*ScoredComponent
+
+func (h scoreHeap) Len() int            { return len(h) }
+func (h scoreHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h scoreHeap) Less(a, b int) bool  { return h[b].rankedBefore(h[a]) }
+func (h *scoreHeap) Push(x interface{}) { *h = append(*h, x.(*ScoredComponent)) }
+func (h *scoreHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+func newSearchComponent(c *Component) *SearchComponent {
 	lowerCased := &Component{
 		// Only the fields we are interested in.
 		Category:    preprocessTerm(c.Category),
@@ -265,14 +351,118 @@ func (s *FulltextSearch) Update(c *Component) {
 		Notes:       preprocessTerm(c.Notes),
 		Footprint:   preprocessTerm(c.Footprint),
 	}
-	s.lock.Lock()
-	s.id2Component[c.Id] = &SearchComponent{
+	partBases := &Component{
+		Category:    basePartNumbers(lowerCased.Category),
+		Value:       basePartNumbers(lowerCased.Value),
+		Description: basePartNumbers(lowerCased.Description),
+		Notes:       basePartNumbers(lowerCased.Notes),
+		Footprint:   basePartNumbers(lowerCased.Footprint),
+	}
+	return &SearchComponent{
 		orig:         c,
 		preprocessed: lowerCased,
+		partBases:    partBases,
 	}
-	s.lock.Unlock()
 }
-func (s *FulltextSearch) Search(search_term string) *SearchResult {
+
+func (s *FulltextSearch) Update(c *Component) {
+	if c == nil {
+		return
+	}
+	search_comp := newSearchComponent(c)
+	shard := s.shard(c.Id)
+	shard.lock.Lock()
+	shard.id2Component[c.Id] = search_comp
+	shard.lock.Unlock()
+	atomic.AddUint64(&s.generation, 1) // Invalidates cached queries.
+}
+
+func (s *FulltextSearch) Remove(id int) {
+	shard := s.shard(id)
+	shard.lock.Lock()
+	delete(shard.id2Component, id)
+	shard.lock.Unlock()
+	atomic.AddUint64(&s.generation, 1)
+}
+
+// Like Update(), but only adds the component if we don't know about it yet.
+// Used while populating an index that might already receive more recent
+// updates.
+func (s *FulltextSearch) addIfAbsent(c *Component) {
+	if c == nil {
+		return
+	}
+	search_comp := newSearchComponent(c)
+	shard := s.shard(c.Id)
+	shard.lock.Lock()
+	if _, exists := shard.id2Component[c.Id]; !exists {
+		shard.id2Component[c.Id] = search_comp
+	}
+	shard.lock.Unlock()
+	atomic.AddUint64(&s.generation, 1)
+}
+
+// Returns the component with the given ID or nil if it is not in the index.
+func (s *FulltextSearch) findById(componentID int) *Component {
+	shard := s.shard(componentID)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	if search_comp, ok := shard.id2Component[componentID]; ok {
+		return search_comp.orig
+	}
+	return nil
+}
+
+// Returns the cached result for the query if still current.
+func (s *FulltextSearch) cachedResult(key queryCacheKey, generation uint64) ([]*Component, int, bool) {
+	entry, found := s.cache.get(key, generation)
+	if !found {
+		return nil, 0, false
+	}
+	result := make([]*Component, len(entry.ids))
+	for i, id := range entry.ids {
+		if result[i] = s.findById(id); result[i] == nil {
+			return nil, 0, false // Raced with an update.
+		}
+	}
+	return result, entry.totalCount, true
+}
+
+// Score all components in this shard. If limit > 0, only the best limit
+// components are returned (in no particular order). Also returns the
+// total number of matching components.
+func (shard *searchShard) score(terms []string, bases []string, limit int) (ScoreList, int) {
+	result := make(scoreHeap, 0, 10)
+	count := 0
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	for _, search_comp := range shard.id2Component {
+		score, _ := search_comp.scoreTerms(terms, bases, 0)
+		if score <= 0 {
+			continue
+		}
+		count++
+		scored := &ScoredComponent{
+			score: score,
+			comp:  search_comp.orig,
+		}
+		switch {
+		case limit <= 0:
+			result = append(result, scored)
+		case len(result) < limit:
+			heap.Push(&result, scored)
+		case scored.rankedBefore(result[0]):
+			result[0] = scored
+			heap.Fix(&result, 0)
+		}
+	}
+	return ScoreList(result), count
+}
+
+// Search components matching the search term. If limit > 0, only return
+// up to limit best matches; TotalCount in the result still reflects all
+// matches.
+func (s *FulltextSearch) Search(search_term string, limit int) *SearchResult {
 	output := &SearchResult{
 		OrignialQuery: search_term,
 	}
@@ -280,31 +470,66 @@ func (s *FulltextSearch) Search(search_term string) *SearchResult {
 	search_term = queryRewrite(search_term, s.componentTerms)
 	output.RewrittenQuery = search_term
 	search_term = preprocessTerm(search_term)
-	s.lock.RLock()
+
+	// Results of the current generation are only valid if no update
+	// happened while we calculated them; check before we start.
+	generation := atomic.LoadUint64(&s.generation)
+	cacheKey := queryCacheKey{query: search_term, limit: limit}
+	if results, count, found := s.cachedResult(cacheKey, generation); found {
+		output.Results = results
+		output.TotalCount = count
+		return output
+	}
+
+	terms := strings.Fields(search_term)
+	bases := make([]string, len(terms))
+	for i, t := range terms {
+		bases[i] = basePartNumber(t)
+	}
+
+	// Score shards in parallel.
+	partial := make([]ScoreList, len(s.shards))
+	counts := make([]int, len(s.shards))
+	var wg sync.WaitGroup
+	for i, shard := range s.shards {
+		wg.Add(1)
+		go func(i int, shard *searchShard) {
+			defer wg.Done()
+			partial[i], counts[i] = shard.score(terms, bases, limit)
+		}(i, shard)
+	}
+	wg.Wait()
+
 	scoredlist := make(ScoreList, 0, 10)
-	for _, search_comp := range s.id2Component {
-		scored := &ScoredComponent{
-			score: search_comp.MatchScore(search_term),
-			comp:  search_comp.orig,
-		}
-		if scored.score > 0 {
-			scoredlist = append(scoredlist, scored)
-		}
+	for i := range partial {
+		scoredlist = append(scoredlist, partial[i]...)
+		output.TotalCount += counts[i]
+	}
+	sort.Sort(scoredlist)
+	if limit > 0 && len(scoredlist) > limit {
+		scoredlist = scoredlist[:limit]
 	}
-	s.lock.RUnlock()
-	sort.Sort(ScoreList(scoredlist))
 	output.Results = make([]*Component, len(scoredlist))
+	ids := make([]int, len(scoredlist))
 	for idx, scomp := range scoredlist {
 		output.Results[idx] = scomp.comp
+		ids[idx] = scomp.comp.Id
 	}
+	s.cache.put(&queryCacheEntry{
+		key:        cacheKey,
+		generation: generation,
+		ids:        ids,
+		totalCount: output.TotalCount,
+	})
 	return output
 }
 
 func (s *FulltextSearch) componentTerms(componentID int) string {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+	shard := s.shard(componentID)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
 
-	component, ok := s.id2Component[componentID]
+	component, ok := shard.id2Component[componentID]
 	if !ok {
 		return ""
 	}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 )
 
@@ -166,3 +173,282 @@ func TestSearchComponent_ToQuery(t *testing.T) {
 	}
 
 }
+
+func TestFts5Query(t *testing.T) {
+	expectEqual(t, fts5Query(""), "")
+	expectEqual(t, fts5Query("foo"), `"foo"*`)
+	expectEqual(t, fts5Query("foo bar"), `"foo"* AND "bar"*`)
+	expectEqual(t, fts5Query("foo | bar"), `"foo"* OR "bar"*`)
+	expectEqual(t, fts5Query("( foo | bar ) baz"), `("foo"* OR "bar"*) AND "baz"*`)
+	expectEqual(t, fts5Query("( foo | bar"), `("foo"* OR "bar"*)`) // unbalanced
+	expectEqual(t, fts5Query("foo | bar )"), `"foo"* OR "bar"*`)   // unbalanced
+	expectEqual(t, fts5Query("( )"), "")                           // empty
+	expectEqual(t, fts5Query(`3.9k 1/4w fo"o`), `"3.9k"* AND "1/4w"* AND "fo""o"*`)
+	expectEqual(t, fts5Query("ne555p"), `("ne555p"* OR "ne555"*)`)
+}
+
+// Searchers to run the conformance test on. Creates a store with the
+// given search engine on a fresh database.
+func newConformanceStore(t *testing.T, searchEngine string) (*DBBackend, func()) {
+	dbfile, _ := ioutil.TempFile("", "search-conformance")
+	cleanup := func() { syscall.Unlink(dbfile.Name()) }
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := NewDBBackend(db, true, searchEngine, "")
+	if err != nil {
+		cleanup()
+		if strings.Contains(err.Error(), "no such module") {
+			t.Skipf("%s not available in this build: %s", searchEngine, err)
+		}
+		t.Fatal(err)
+	}
+	return store, cleanup
+}
+
+// Behavior all Searchers have to agree on.
+func TestSearcherConformance(t *testing.T) {
+	components := []Component{
+		{Id: 1, Category: "Resistor", Value: "10k", Description: "1/4W; 5%"},
+		{Id: 2, Category: "Resistor", Value: "3.9k"},
+		{Id: 3, Category: "Capacitor (C)", Value: "100nF", Description: "ceramic"},
+		{Id: 4, Category: "Transistor", Value: "2N3904", Footprint: "TO-92"},
+		{Id: 5, Category: "Integrated Circuit (IC)", Value: "NE555P", Description: "Timer"},
+		{Id: 6, Category: "R-Network", Value: "10k", Footprint: "SIP-9"},
+		{Id: 7, Category: "Potentiometer", Value: "10k", Description: "linear"},
+		{Id: 8, Category: "Connector", Value: "foo", Description: "bar"},
+		{Id: 9, Category: "Transistor", Value: "Mosfet TO-220"},
+		{Id: 10, Category: "Connector", Description: "foo compatible"},
+	}
+	cases := []struct {
+		query  string
+		expect []int // Sorted IDs of matching components.
+	}{
+		{"nothing-here", []int{}},
+		{"foo", []int{8, 10}},
+		{"FOO", []int{8, 10}},
+		{"foo bar", []int{8}},
+		{"foo AND bar", []int{8}},
+		{"foo baz", []int{}},
+		{"foo | timer", []int{5, 8, 10}},
+		{"foo OR timer", []int{5, 8, 10}},
+		{"(foo | timer", []int{5, 8, 10}},
+		{"(foo | timer) bar", []int{8}},
+		{"(foo | timer) (bar | baz)", []int{8}},
+		{"10k", []int{1, 6, 7}},
+		{"10k linear", []int{7}},
+		{"10k Ohm", []int{1, 6, 7}},
+		{"3.9kOhm", []int{2}},
+		{"0.1u", []int{3}},
+		{"100n", []int{3}},
+		{"to-220", []int{9}},
+		{"to220", []int{9}},
+		{"r-network", []int{6}},
+		{"2N3904BU", []int{4}},
+		{"NE555", []int{5}},
+		{"like:7", []int{1, 6, 7}},
+		{"2n39", []int{4}},
+	}
+	// Where the engines deliberately differ: FTS5 only matches the start
+	// of words, the memory engine anywhere.
+	engine_cases := map[string][]struct {
+		query  string
+		expect []int
+	}{
+		kSearchEngineMemory: {{"3904", []int{4}}, {"imer", []int{5}}},
+		kSearchEngineFTS5:   {{"3904", []int{}}, {"imer", []int{}}},
+	}
+
+	for _, engine := range []string{kSearchEngineMemory, kSearchEngineFTS5} {
+		t.Run(engine, func(t *testing.T) {
+			store, cleanup := newConformanceStore(t, engine)
+			defer cleanup()
+			for _, c := range components {
+				c := c
+				store.EditRecord(Editor{}, c.Id, func(comp *Component) bool {
+					*comp = c
+					return true
+				})
+			}
+			for _, tc := range append(cases, engine_cases[engine]...) {
+				result := store.Search(tc.query, 0)
+				ids := make([]int, 0, len(result.Results))
+				for _, c := range result.Results {
+					ids = append(ids, c.Id)
+				}
+				sort.Ints(ids)
+				if fmt.Sprint(ids) != fmt.Sprint(tc.expect) {
+					t.Errorf("%s: '%s' expected %v, got %v",
+						engine, tc.query, tc.expect, ids)
+				}
+			}
+
+			// Limited results are the best of all results.
+			all := store.Search("10k | foo", 0)
+			limited := store.Search("10k | foo", 2)
+			ExpectTrue(t, all.TotalCount == 5 && limited.TotalCount == 5, "Total count")
+			ExpectTrue(t, len(limited.Results) == 2 &&
+				limited.Results[0].Id == all.Results[0].Id &&
+				limited.Results[1].Id == all.Results[1].Id, "Limited results")
+
+			// Best match first.
+			result := store.Search("NE555P", 0)
+			ExpectTrue(t, len(result.Results) > 0 && result.Results[0].Id == 5,
+				"NE555P first")
+			result = store.Search("foo", 0)
+			ExpectTrue(t, len(result.Results) == 2 && result.Results[0].Id == 8,
+				"Value match before description match")
+		})
+	}
+}
+
+func TestFTS5IndexesExistingComponents(t *testing.T) {
+	store, cleanup := newConformanceStore(t, kSearchEngineMemory)
+	defer cleanup()
+	store.EditRecord(Editor{}, 1, func(c *Component) bool { c.Value = "foo"; return true })
+
+	// Switching the engine on an existing database.
+	fts5Store, err := NewDBBackend(store.db, false, kSearchEngineFTS5, "")
+	if err != nil {
+		t.Skipf("%s not available in this build: %s", kSearchEngineFTS5, err)
+	}
+	ExpectTrue(t, len(fts5Store.Search("foo", 0).Results) == 1, "Existing component")
+	fts5Store.EditRecord(Editor{}, 1, func(c *Component) bool { c.Value = "bar"; return true })
+	ExpectTrue(t, len(fts5Store.Search("foo", 0).Results) == 0, "Updated away")
+	ExpectTrue(t, len(fts5Store.Search("bar", 0).Results) == 1, "Updated")
+
+	// Changed while the memory engine was used: rebuilt on startup.
+	store.EditRecord(Editor{}, 1, func(c *Component) bool { c.Value = "baz"; return true })
+	fts5Store, _ = NewDBBackend(store.db, false, kSearchEngineFTS5, "")
+	ExpectTrue(t, len(fts5Store.Search("bar", 0).Results) == 0, "Stale entry gone")
+	ExpectTrue(t, len(fts5Store.Search("baz", 0).Results) == 1, "Reindexed")
+	var triggers int
+	store.db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='trigger' AND name LIKE 'component_fts%'").Scan(&triggers)
+	expectEqualInt(t, triggers, 0)
+}
+
+// Triggers left by earlier versions of the FTS5 engine must not break
+// changes in a binary built without FTS5.
+func TestLegacyFTS5TriggersRemoved(t *testing.T) {
+	store, cleanup := newConformanceStore(t, kSearchEngineMemory)
+	defer cleanup()
+	_, err := store.db.Exec(`create trigger component_fts_insert after insert on component
+	    begin insert into component_fts (rowid, value) values (new.id, new.value); end`)
+	ExpectTrue(t, err == nil, "Create legacy trigger")
+
+	store, err = NewDBBackend(store.db, false, kSearchEngineMemory, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, _ := store.EditRecord(Editor{}, 1, func(c *Component) bool { c.Value = "foo"; return true })
+	ExpectTrue(t, ok, "Insert")
+	var triggers int
+	store.db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='trigger' AND name LIKE 'component_fts%'").Scan(&triggers)
+	expectEqualInt(t, triggers, 0)
+}
+
+// Inventory with n components and some typical values.
+func newBenchmarkSearch(n int) *FulltextSearch {
+	fts := NewFulltextSearch()
+	categories := []string{"Resistor", "Capacitor (C)", "Transistor", "IC Digital"}
+	for i := 0; i < n; i++ {
+		fts.Update(&Component{
+			Id:          i,
+			Category:    categories[i%len(categories)],
+			Value:       fmt.Sprintf("%dk", i%100),
+			Description: fmt.Sprintf("part %d; 1/4W, 5%%", i),
+			Footprint:   "TO-220",
+		})
+	}
+	return fts
+}
+
+func TestSearchLimitMatchesFullSort(t *testing.T) {
+	fts := newBenchmarkSearch(1000)
+	for _, query := range []string{"1k", "resistor | transistor", "part 1", "to220"} {
+		all := fts.Search(query, 0)
+		for _, limit := range []int{1, 5, 24, 100, 2000} {
+			limited := fts.Search(query, limit)
+			ExpectTrue(t, limited.TotalCount == all.TotalCount,
+				fmt.Sprintf("%s: total count", query))
+			expected := all.Results
+			if len(expected) > limit {
+				expected = expected[:limit]
+			}
+			if len(limited.Results) != len(expected) {
+				t.Errorf("%s/%d: expected %d results, got %d", query, limit,
+					len(expected), len(limited.Results))
+				continue
+			}
+			for i := range expected {
+				if expected[i].Id != limited.Results[i].Id {
+					t.Errorf("%s/%d: position %d: expected id %d, got %d",
+						query, limit, i, expected[i].Id, limited.Results[i].Id)
+				}
+			}
+		}
+	}
+}
+
+// Run with -race to check that searching while updating is safe.
+func TestSearchConcurrentUpdate(t *testing.T) {
+	const n = 500
+	fts := newBenchmarkSearch(n)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < n; i += 4 {
+				// Replaced by a component that still matches.
+				fts.Update(&Component{
+					Id:       i,
+					Category: "Resistor",
+					Value:    fmt.Sprintf("%dk", i),
+				})
+			}
+		}(w)
+	}
+	for r := 0; r < 20; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Every component either has 'k' in the old or new value.
+			result := fts.Search("k", 24)
+			if result.TotalCount != n || len(result.Results) != 24 {
+				t.Errorf("Expected %d/24 results, got %d/%d",
+					n, result.TotalCount, len(result.Results))
+			}
+		}()
+	}
+	wg.Wait()
+	ExpectTrue(t, fts.Len() == n, "Number of components")
+	ExpectTrue(t, fts.Search("resistor", 0).TotalCount == n, "All updated")
+}
+
+func BenchmarkSearchLimited(b *testing.B) {
+	fts := newBenchmarkSearch(5000)
+	fts.cache = newQueryCache(0) // Measure scoring, not the cache.
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fts.Search("part | resistor", 24)
+	}
+}
+
+func BenchmarkSearchUnlimited(b *testing.B) {
+	fts := newBenchmarkSearch(5000)
+	fts.cache = newQueryCache(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fts.Search("part | resistor", 0)
+	}
+}
+
+func BenchmarkSearchCached(b *testing.B) {
+	fts := newBenchmarkSearch(5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fts.Search("part | resistor", 24)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Where handlers register the paths they serve. In the server, this is
+// a *http.ServeMux.
+type Router interface {
+	Handle(pattern string, handler http.Handler)
+	HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+}
+
+// All the pages and APIs we serve. Without moderation queue, proposals
+// are not accepted.
+func AddHandlers(mux Router, store StuffStore, templates *TemplateRenderer,
+	imgPath string, static fs.FS, auth *Auth, moderation *ModerationQueue,
+	categories *CategoryStore, siteName string) {
+	imagehandler := AddImageHandler(mux, store, templates, imgPath, static, categories)
+	AddAuthHandler(mux, auth, templates)
+	if moderation != nil {
+		AddModerationHandler(mux, store, moderation, auth, templates)
+	}
+	AddFormHandler(mux, store, templates, imgPath, auth, moderation, categories)
+	AddHistoryHandler(mux, store, auth, templates)
+	AddCategoriesHandler(mux, categories, auth, templates)
+	AddApiV1Handler(mux, store, auth)
+	AddSearchHandler(mux, store, templates, imagehandler)
+	AddStatusHandler(mux, store, templates, imgPath)
+	AddSitemapHandler(mux, store, siteName)
+}
+
+type ServerTimeouts struct {
+	Read  time.Duration // Reading the whole request, including body.
+	Write time.Duration // From end of request header to end of response.
+	Idle  time.Duration // Keep-alive connections waiting for next request.
+}
+
+func NewServer(address string, handler http.Handler, timeouts ServerTimeouts) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.Read,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+	}
+}
+
+// Serve until we get SIGTERM or SIGINT, then stop accepting connections
+// and wait up to shutdown_timeout for running requests to finish. Only
+// returns after that, so that the caller can close the database.
+func RunServer(server *http.Server, ssl_cert, ssl_key string, shutdown_timeout time.Duration) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(stop)
+
+	serve_error := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %q", server.Addr)
+		if ssl_cert != "" && ssl_key != "" {
+			serve_error <- server.ListenAndServeTLS(ssl_cert, ssl_key)
+		} else {
+			serve_error <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serve_error:
+		log.Fatal(err) // Could not even start.
+	case sig := <-stop:
+		log.Printf("Got %s; shutting down", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown_timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %s", err)
+	}
+}
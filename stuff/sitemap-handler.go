@@ -14,12 +14,12 @@ type SitemapHandler struct {
 	siteprefix string
 }
 
-func AddSitemapHandler(store StuffStore, siteprefix string) {
+func AddSitemapHandler(mux Router, store StuffStore, siteprefix string) {
 	handler := &SitemapHandler{
 		store:      store,
 		siteprefix: siteprefix,
 	}
-	http.Handle(kSitemap, handler)
+	mux.Handle(kSitemap, handler)
 }
 
 func (h *SitemapHandler) ServeHTTP(out http.ResponseWriter, req *http.Request) {
@@ -7,7 +7,6 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"time"
 )
 
 const (
@@ -23,14 +22,14 @@ type StatusHandler struct {
 	imgPath  string
 }
 
-func AddStatusHandler(store StuffStore, template *TemplateRenderer, imgPath string) {
+func AddStatusHandler(mux Router, store StuffStore, template *TemplateRenderer, imgPath string) {
 	handler := &StatusHandler{
 		store:    store,
 		template: template,
 		imgPath:  imgPath,
 	}
-	http.Handle(kStatusPage, handler)
-	http.Handle(kApiStatus, handler)
+	mux.Handle(kStatusPage, handler)
+	mux.Handle(kApiStatus, handler)
 }
 
 type StatusItem struct {
@@ -54,7 +53,12 @@ type JsonApiStatusResult struct {
 }
 
 func fillStatusItem(store StuffStore, imageDir string, id int, item *StatusItem) {
-	comp := store.FindById(id)
+	fillComponentStatusItem(store.FindById(id), id, imageDir, item)
+}
+
+// Like fillStatusItem(), with the component already looked up; comp is
+// nil if there is no component with that id.
+func fillComponentStatusItem(comp *Component, id int, imageDir string, item *StatusItem) {
 	item.Number = id
 	if comp != nil {
 		// Ad-hoc categorization...
@@ -108,7 +112,6 @@ func (h *StatusHandler) ServeHTTP(out http.ResponseWriter, req *http.Request) {
 		if cookie, err := req.Cookie("last-edit"); err == nil {
 			current_edit_id, _ = strconv.Atoi(cookie.Value)
 		}
-		defer ElapsedPrint("Show status", time.Now())
 		out.Header().Set("Content-Type", "text/html; charset=utf-8")
 		maxStatus := 2100
 		page := &StatusPage{
@@ -135,6 +138,9 @@ func (h *StatusHandler) ServeHTTP(out http.ResponseWriter, req *http.Request) {
 
 // Similarly to the Search API, gather the status data and present it in an JSON endpoint.
 func (h *StatusHandler) apiStatus(out http.ResponseWriter, r *http.Request) {
+	if !readOnlyRequest(out, r) {
+		return
+	}
 	rawOffset := r.FormValue("offset")
 	rawLimit := r.FormValue("limit")
 	offset := kApiStatusDefaultOffset
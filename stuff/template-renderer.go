@@ -1,52 +1,130 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
+	"path"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Templates are the pages (*.html) and the images in component/:
+// category-<Category>.svg for a category, package-<Footprint>.svg for a
+// footprint and others to render values, such as the resistor color
+// bands. All are found by name, so new ones only need to be dropped in.
+
+// How often to look if templates in -templatedir changed.
+const kTemplateCheckInterval = 2 * time.Second
+
 type TemplateRenderer struct {
-	baseDir         string
+	files   fs.FS
+	doCache bool
+	watch   bool // Templates are in a directory and can change.
+
+	mutex           sync.Mutex
 	cachedTemplates *template.Template
-	doCache         bool
+	names           map[string]bool // Available templates.
+	signature       string          // Changes if any template file changes.
+	lastCheck       time.Time
 }
 
+// Templates built into the binary; the ones in baseDir, if given, are
+// used instead and reloaded when they change.
 func NewTemplateRenderer(baseDir string, doCache bool) *TemplateRenderer {
 	result := &TemplateRenderer{
-		baseDir: baseDir,
-		doCache: doCache,
+		files:     NewAssets("template", baseDir),
+		doCache:   doCache,
+		watch:     baseDir != "",
+		lastCheck: time.Now(),
 	}
+	paths := result.templateFiles()
 	if doCache {
-		// Ideally, we would like to register these later in the
-		// handlers, but looks like we need to do that in one bunch.
-		// So, TODO: wait until everything is registered, then
-		// do the registration. Lazy for now.
-		result.cachedTemplates = template.Must(template.ParseFiles(
-			// Application templates
-			baseDir+"/form-template.html",
-			baseDir+"/display-template.html",
-			baseDir+"/status-table.html",
-			baseDir+"/set-drag-drop.html",
-			// Templates to create component images
-			baseDir+"/component/category-Diode.svg",
-			baseDir+"/component/category-LED.svg",
-			baseDir+"/component/category-Capacitor.svg",
-			// Value rendering of resistors
-			baseDir+"/component/4-Band_Resistor.svg",
-			baseDir+"/component/5-Band_Resistor.svg",
-			// Some common packages
-			baseDir+"/component/package-TO-39.svg",
-			baseDir+"/component/package-TO-220.svg",
-			baseDir+"/component/package-DIP-14.svg",
-			baseDir+"/component/package-DIP-16.svg",
-			baseDir+"/component/package-DIP-28.svg"))
+		result.cachedTemplates = template.Must(template.ParseFS(result.files, paths...))
 	}
+	result.names = templateNames(paths)
+	result.signature = result.filesSignature(paths)
 	return result
 }
 
+func (h *TemplateRenderer) templateFiles() []string {
+	pages, _ := fs.Glob(h.files, "*.html")
+	images, _ := fs.Glob(h.files, "component/*.svg")
+	return append(pages, images...)
+}
+
+func templateNames(paths []string) map[string]bool {
+	result := make(map[string]bool)
+	for _, p := range paths {
+		result[path.Base(p)] = true
+	}
+	return result
+}
+
+func (h *TemplateRenderer) filesSignature(paths []string) string {
+	parts := []string{kServerStart}
+	for _, p := range paths {
+		if info, err := fs.Stat(h.files, p); err == nil {
+			parts = append(parts, fmt.Sprintf("%s %d %s", p, info.Size(), info.ModTime()))
+		}
+	}
+	return contentETag(parts...)
+}
+
+// Reload templates if files were changed, added or removed. Looks at the
+// files at most every kTemplateCheckInterval.
+func (h *TemplateRenderer) refresh() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.watch || time.Since(h.lastCheck) < kTemplateCheckInterval {
+		return
+	}
+	h.lastCheck = time.Now()
+	paths := h.templateFiles()
+	signature := h.filesSignature(paths)
+	if signature == h.signature {
+		return
+	}
+	h.signature = signature // Also if broken: only report again after next change.
+	if h.doCache {
+		templates, err := template.ParseFS(h.files, paths...)
+		if err != nil {
+			log.Printf("Templates not reloaded: %s", err)
+			return
+		}
+		h.cachedTemplates = templates
+	}
+	h.names = templateNames(paths)
+	log.Printf("Templates reloaded (%d)", len(paths))
+}
+
+// Is there a template with this name?
+func (h *TemplateRenderer) Has(template_name string) bool {
+	h.refresh()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.names[template_name]
+}
+
+// Changes whenever templates change, for ETags of what they render.
+func (h *TemplateRenderer) Version() string {
+	h.refresh()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.signature
+}
+
+func (h *TemplateRenderer) cached() *template.Template {
+	h.refresh()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.cachedTemplates
+}
+
 func setContentTypeFromTemplateName(template_name string, header http.Header) {
 	switch {
 	case strings.HasSuffix(template_name, ".svg"):
@@ -67,7 +145,7 @@ func (h *TemplateRenderer) RenderWithHttpCode(w http.ResponseWriter, output_writ
 		output_writer = w
 	}
 	if h.doCache {
-		templ := h.cachedTemplates.Lookup(template_name)
+		templ := h.cached().Lookup(template_name)
 		if templ == nil {
 			return false
 		}
@@ -75,9 +153,10 @@ func (h *TemplateRenderer) RenderWithHttpCode(w http.ResponseWriter, output_writ
 		w.WriteHeader(http_code)
 		err = templ.Execute(output_writer, p)
 	} else {
-		t, err := template.ParseFiles(h.baseDir + "/" + template_name)
+		var t *template.Template
+		t, err = template.ParseFS(h.files, template_name)
 		if err != nil {
-			t, err = template.ParseFiles(h.baseDir + "/component/" + template_name)
+			t, err = template.ParseFS(h.files, "component/"+template_name)
 			if err != nil {
 				log.Printf("%s: %s", template_name, err)
 				return false
@@ -93,3 +172,8 @@ func (h *TemplateRenderer) RenderWithHttpCode(w http.ResponseWriter, output_writ
 	}
 	return true
 }
+
+// Content of a file that is not a template.
+func (h *TemplateRenderer) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(h.files, name)
+}
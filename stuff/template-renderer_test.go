@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplatesDiscovered(t *testing.T) {
+	templates := NewTemplateRenderer("", true)
+	for _, name := range []string{
+		"form-template.html", "admin-categories.html",
+		"category-LED.svg", "4-Band_Resistor.svg",
+		// Not in any list, but there.
+		"package-DIP-6.svg", "package-DIP-8.svg", "package-DIP-40.svg",
+		"package-TO-3.svg", "package-TO-99.svg",
+	} {
+		ExpectTrue(t, templates.Has(name), name)
+	}
+	ExpectTrue(t, strings.Contains(renderToString(templates, "package-DIP-40.svg"), "<svg"),
+		"Render DIP-40")
+	ExpectTrue(t, !templates.Has("package-NOPE-1.svg"), "Unknown template")
+	ExpectTrue(t, !templates.Has("README"), "Only templates")
+}
+
+func renderToString(templates *TemplateRenderer, name string) string {
+	out := httptest.NewRecorder()
+	if !templates.Render(out, name, &Component{Value: "42"}) {
+		return "<not rendered>"
+	}
+	return out.Body.String()
+}
+
+func TestTemplatesReloaded(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/component", 0755)
+	templates := NewTemplateRenderer(dir, true)
+	version := templates.Version()
+	ExpectTrue(t, !templates.Has("package-SOT-23.svg"), "Not there yet")
+
+	ioutil.WriteFile(dir+"/component/package-SOT-23.svg", []byte("<svg>{{.Value}}</svg>"), 0644)
+	ExpectTrue(t, !templates.Has("package-SOT-23.svg"), "Only checked once in a while")
+	templates.lastCheck = time.Time{}
+	ExpectTrue(t, templates.Has("package-SOT-23.svg"), "Added")
+	ExpectTrue(t, templates.Version() != version, "New version")
+	expectEqual(t, renderToString(templates, "package-SOT-23.svg"), "<svg>42</svg>")
+
+	// Changed.
+	ioutil.WriteFile(dir+"/component/package-SOT-23.svg", []byte("<svg>[{{.Value}}]</svg>"), 0644)
+	templates.lastCheck = time.Time{}
+	expectEqual(t, renderToString(templates, "package-SOT-23.svg"), "<svg>[42]</svg>")
+
+	// Broken while editing: keep what worked.
+	ioutil.WriteFile(dir+"/component/package-SOT-23.svg", []byte("<svg>{{.Value</svg>"), 0644)
+	templates.lastCheck = time.Time{}
+	expectEqual(t, renderToString(templates, "package-SOT-23.svg"), "<svg>[42]</svg>")
+
+	// Overriding a built-in one.
+	ioutil.WriteFile(dir+"/component/package-SOT-23.svg", []byte("<svg></svg>"), 0644)
+	ioutil.WriteFile(dir+"/component/package-TO-3.svg", []byte("<svg>TO-3</svg>"), 0644)
+	templates.lastCheck = time.Time{}
+	expectEqual(t, renderToString(templates, "package-TO-3.svg"), "<svg>TO-3</svg>")
+
+	// Removed.
+	os.Remove(dir + "/component/package-SOT-23.svg")
+	templates.lastCheck = time.Time{}
+	ExpectTrue(t, !templates.Has("package-SOT-23.svg"), "Removed")
+	ExpectTrue(t, templates.Has("form-template.html"), "Built-in templates still there")
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User accounts, browser sessions and personal API tokens, stored in the
+// same database as the components. Passwords are stored as bcrypt hashes;
+// session and API tokens only as their SHA-256, so a copy of the database
+// does not allow to log in.
+var user_schema string = `
+create table if not exists users (
+       name          text constraint pk_users primary key,
+       password_hash text not null,  -- bcrypt
+       role          text not null,  -- viewer, editor or admin
+       created       timestamp
+);
+create table if not exists sessions (
+       token_hash    text constraint pk_sessions primary key,
+       user_name     text not null,
+       expires       timestamp not null,
+
+       foreign key(user_name) references users(name)
+);
+create table if not exists api_tokens (
+       id            integer constraint pk_api_tokens primary key,
+       token_hash    text not null unique,
+       user_name     text not null,
+       label         text,
+       created       timestamp,
+       last_used     timestamp,
+
+       foreign key(user_name) references users(name)
+);
+`
+
+type Role int
+
+const (
+	RoleNone   Role = iota
+	RoleViewer      // Can look at everything.
+	RoleEditor      // Can also modify components and sets.
+	RoleAdmin       // Can also manage users.
+)
+
+var roleNames = []string{"none", "viewer", "editor", "admin"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return "none"
+	}
+	return roleNames[r]
+}
+
+func ParseRole(name string) (Role, error) {
+	for i, n := range roleNames {
+		if i > 0 && n == name {
+			return Role(i), nil
+		}
+	}
+	return RoleNone, fmt.Errorf("Unknown role '%s'; need one of viewer, editor, admin", name)
+}
+
+type User struct {
+	Name    string
+	Role    Role
+	Created time.Time
+}
+
+type ApiToken struct {
+	Id       int
+	Label    string
+	Created  time.Time
+	LastUsed *time.Time // nil if never used.
+}
+
+const kMinPasswordLength = 8
+
+// How exact the last use of an API token is recorded. Scripts using the
+// API should not cause a write on every request.
+const kApiTokenUsageResolution = time.Minute
+
+var userNameRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,40}$`)
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+type UserStore struct {
+	db *sql.DB
+
+	lock     sync.Mutex
+	hasUsers bool // Once there are accounts, we don't ask anymore.
+}
+
+func NewUserStore(db *sql.DB) (*UserStore, error) {
+	if _, err := db.Exec(user_schema); err != nil {
+		return nil, err
+	}
+	return &UserStore{db: db}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < kMinPasswordLength {
+		return "", fmt.Errorf("Password needs at least %d characters", kMinPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// If there are any accounts at all. Accounts can be added from the
+// command line while the server is running, so without accounts, we
+// check again each time.
+func (s *UserStore) HasUsers() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.hasUsers {
+		var count int
+		s.db.QueryRow("SELECT count(*) FROM users").Scan(&count)
+		s.hasUsers = count > 0
+	}
+	return s.hasUsers
+}
+
+func (s *UserStore) CreateUser(name string, password string, role Role) error {
+	if !userNameRegex.MatchString(name) {
+		return errors.New("User name needs to be 1-40 letters, digits, '.', '_' or '-'")
+	}
+	if role == RoleNone {
+		return errors.New("User needs a role")
+	}
+	if s.FindUser(name) != nil {
+		return fmt.Errorf("User '%s' already exists", name)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO users (name, password_hash, role, created) VALUES (?1, ?2, ?3, ?4)",
+		name, hash, role.String(), time.Now())
+	return err
+}
+
+func (s *UserStore) FindUser(name string) *User {
+	user, _ := scanUser(s.db.QueryRow("SELECT name, role, created FROM users WHERE name = ?1", name))
+	return user
+}
+
+// Scans name, role and created; further columns go to extra.
+func scanUser(row *sql.Row, extra ...interface{}) (*User, error) {
+	var role string
+	user := &User{}
+	if err := row.Scan(append([]interface{}{&user.Name, &role, &user.Created}, extra...)...); err != nil {
+		return nil, err
+	}
+	user.Role, _ = ParseRole(role)
+	return user, nil
+}
+
+func (s *UserStore) Users() []User {
+	result := make([]User, 0, 10)
+	rows, err := s.db.Query("SELECT name, role, created FROM users ORDER BY name")
+	if err != nil {
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user User
+		var role string
+		rows.Scan(&user.Name, &role, &user.Created)
+		user.Role, _ = ParseRole(role)
+		result = append(result, user)
+	}
+	return result
+}
+
+// Setting a new password ends all sessions of that user.
+func (s *UserStore) SetPassword(name string, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec("UPDATE users SET password_hash = ?2 WHERE name = ?1", name, hash)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		return fmt.Errorf("No user '%s'", name)
+	}
+	_, err = s.db.Exec("DELETE FROM sessions WHERE user_name = ?1", name)
+	return err
+}
+
+func (s *UserStore) SetRole(name string, role Role) error {
+	if role == RoleNone {
+		return errors.New("User needs a role")
+	}
+	result, err := s.db.Exec("UPDATE users SET role = ?2 WHERE name = ?1", name, role.String())
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		return fmt.Errorf("No user '%s'", name)
+	}
+	return nil
+}
+
+// Delete user with all sessions and API tokens.
+func (s *UserStore) DeleteUser(name string) error {
+	for _, statement := range []string{
+		"DELETE FROM sessions WHERE user_name = ?1",
+		"DELETE FROM api_tokens WHERE user_name = ?1",
+		"DELETE FROM users WHERE name = ?1",
+	} {
+		if _, err := s.db.Exec(statement, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the user if the password matches, nil otherwise.
+func (s *UserStore) Authenticate(name string, password string) *User {
+	var hash string
+	err := s.db.QueryRow("SELECT password_hash FROM users WHERE name = ?1", name).Scan(&hash)
+	if err != nil {
+		// Same time spent as for an existing user, not to give away
+		// which users exist.
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil
+	}
+	return s.FindUser(name)
+}
+
+// Start a session and return its token, to be stored in a cookie.
+func (s *UserStore) NewSession(name string, duration time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	s.db.Exec("DELETE FROM sessions WHERE expires < ?1", now) // Expired ones.
+	_, err = s.db.Exec("INSERT INTO sessions (token_hash, user_name, expires) VALUES (?1, ?2, ?3)",
+		hashToken(token), name, now.Add(duration))
+	return token, err
+}
+
+func (s *UserStore) SessionUser(token string) *User {
+	user, _ := scanUser(s.db.QueryRow(`
+	    SELECT name, role, users.created FROM sessions JOIN users ON name = user_name
+	     WHERE token_hash = ?1 AND expires > ?2`, hashToken(token), time.Now()))
+	return user
+}
+
+func (s *UserStore) EndSession(token string) {
+	s.db.Exec("DELETE FROM sessions WHERE token_hash = ?1", hashToken(token))
+}
+
+// Create a new personal API token. The token itself is only returned
+// here, it can't be retrieved later.
+func (s *UserStore) NewApiToken(name string, label string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	token = "stuff_" + token
+	_, err = s.db.Exec("INSERT INTO api_tokens (token_hash, user_name, label, created) VALUES (?1, ?2, ?3, ?4)",
+		hashToken(token), name, label, time.Now())
+	return token, err
+}
+
+func (s *UserStore) ApiTokens(name string) []ApiToken {
+	result := make([]ApiToken, 0, 5)
+	rows, err := s.db.Query("SELECT id, label, created, last_used FROM api_tokens WHERE user_name = ?1 ORDER BY id", name)
+	if err != nil {
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var token ApiToken
+		var label sql.NullString
+		var last_used sql.NullTime
+		rows.Scan(&token.Id, &label, &token.Created, &last_used)
+		token.Label = label.String
+		if last_used.Valid {
+			token.LastUsed = &last_used.Time
+		}
+		result = append(result, token)
+	}
+	return result
+}
+
+func (s *UserStore) RevokeApiToken(name string, id int) error {
+	result, err := s.db.Exec("DELETE FROM api_tokens WHERE user_name = ?1 AND id = ?2", name, id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		return fmt.Errorf("No token %d", id)
+	}
+	return nil
+}
+
+func (s *UserStore) ApiTokenUser(token string) *User {
+	hash := hashToken(token)
+	var last_used sql.NullTime
+	user, err := scanUser(s.db.QueryRow(`
+	    SELECT name, role, users.created, last_used FROM api_tokens JOIN users ON name = user_name
+	     WHERE token_hash = ?1`, hash), &last_used)
+	if err != nil {
+		return nil
+	}
+	if now := time.Now(); !last_used.Valid || now.Sub(last_used.Time) >= kApiTokenUsageResolution {
+		s.db.Exec("UPDATE api_tokens SET last_used = ?2 WHERE token_hash = ?1", hash, now)
+	}
+	return user
+}
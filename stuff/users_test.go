@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestUserStore(t *testing.T) (*UserStore, func()) {
+	dbfile, _ := ioutil.TempFile("", "users")
+	db, err := sql.Open("sqlite3", dbfile.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, err := NewUserStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users, func() { syscall.Unlink(dbfile.Name()) }
+}
+
+func TestParseRole(t *testing.T) {
+	for _, role := range []Role{RoleViewer, RoleEditor, RoleAdmin} {
+		parsed, err := ParseRole(role.String())
+		ExpectTrue(t, err == nil && parsed == role, role.String())
+	}
+	_, err := ParseRole("none")
+	ExpectTrue(t, err != nil, "none is not a role to give")
+	_, err = ParseRole("wizard")
+	ExpectTrue(t, err != nil, "unknown")
+}
+
+func TestUserCreateAndAuthenticate(t *testing.T) {
+	users, cleanup := newTestUserStore(t)
+	defer cleanup()
+
+	ExpectTrue(t, !users.HasUsers(), "Empty initially")
+	ExpectTrue(t, users.CreateUser("alice", "secret-password", RoleEditor) == nil, "create")
+	ExpectTrue(t, users.HasUsers(), "Has users")
+	ExpectTrue(t, users.CreateUser("alice", "other-password", RoleViewer) != nil, "duplicate")
+	ExpectTrue(t, users.CreateUser("bob", "short", RoleViewer) != nil, "short password")
+	ExpectTrue(t, users.CreateUser("bob smith", "long enough", RoleViewer) != nil, "bad name")
+
+	user := users.Authenticate("alice", "secret-password")
+	ExpectTrue(t, user != nil && user.Name == "alice" && user.Role == RoleEditor, "login")
+	ExpectTrue(t, users.Authenticate("alice", "wrong-password") == nil, "wrong password")
+	ExpectTrue(t, users.Authenticate("nobody", "secret-password") == nil, "unknown user")
+
+	ExpectTrue(t, users.SetRole("alice", RoleAdmin) == nil, "set role")
+	ExpectTrue(t, users.FindUser("alice").Role == RoleAdmin, "role changed")
+	ExpectTrue(t, users.SetRole("nobody", RoleAdmin) != nil, "set role unknown")
+
+	ExpectTrue(t, users.SetPassword("alice", "new-password") == nil, "set password")
+	ExpectTrue(t, users.Authenticate("alice", "secret-password") == nil, "old password")
+	ExpectTrue(t, users.Authenticate("alice", "new-password") != nil, "new password")
+
+	ExpectTrue(t, users.DeleteUser("alice") == nil, "delete")
+	ExpectTrue(t, users.Authenticate("alice", "new-password") == nil, "deleted")
+}
+
+func TestUserSessions(t *testing.T) {
+	users, cleanup := newTestUserStore(t)
+	defer cleanup()
+	users.CreateUser("alice", "secret-password", RoleEditor)
+
+	token, err := users.NewSession("alice", time.Hour)
+	ExpectTrue(t, err == nil, "session")
+	user := users.SessionUser(token)
+	ExpectTrue(t, user != nil && user.Name == "alice", "session user")
+	ExpectTrue(t, users.SessionUser(token+"x") == nil, "wrong token")
+
+	expired, _ := users.NewSession("alice", -time.Second)
+	ExpectTrue(t, users.SessionUser(expired) == nil, "expired")
+
+	users.EndSession(token)
+	ExpectTrue(t, users.SessionUser(token) == nil, "logged out")
+
+	// New password ends all sessions.
+	token, _ = users.NewSession("alice", time.Hour)
+	users.SetPassword("alice", "new-password")
+	ExpectTrue(t, users.SessionUser(token) == nil, "password change")
+}
+
+func TestUserApiTokens(t *testing.T) {
+	users, cleanup := newTestUserStore(t)
+	defer cleanup()
+	users.CreateUser("alice", "secret-password", RoleEditor)
+	users.CreateUser("bob", "secret-password", RoleViewer)
+
+	token, err := users.NewApiToken("alice", "inventory script")
+	ExpectTrue(t, err == nil, "token")
+	tokens := users.ApiTokens("alice")
+	ExpectTrue(t, len(tokens) == 1 && tokens[0].LastUsed == nil, "unused")
+	expectEqual(t, tokens[0].Label, "inventory script")
+
+	user := users.ApiTokenUser(token)
+	ExpectTrue(t, user != nil && user.Name == "alice", "token user")
+	ExpectTrue(t, user.Role == RoleEditor, "token user role")
+	first_use := users.ApiTokens("alice")[0].LastUsed
+	ExpectTrue(t, first_use != nil, "used")
+	ExpectTrue(t, users.ApiTokenUser("stuff_bogus") == nil, "unknown token")
+
+	// Not written again right away, but after a while.
+	users.ApiTokenUser(token)
+	ExpectTrue(t, users.ApiTokens("alice")[0].LastUsed.Equal(*first_use), "not rewritten")
+	users.db.Exec("UPDATE api_tokens SET last_used = ?1", first_use.Add(-2*kApiTokenUsageResolution))
+	users.ApiTokenUser(token)
+	ExpectTrue(t, !users.ApiTokens("alice")[0].LastUsed.Before(*first_use), "updated later")
+
+	ExpectTrue(t, users.RevokeApiToken("bob", tokens[0].Id) != nil, "not bob's")
+	ExpectTrue(t, users.RevokeApiToken("alice", tokens[0].Id) == nil, "revoke")
+	ExpectTrue(t, users.ApiTokenUser(token) == nil, "revoked")
+}
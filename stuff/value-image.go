@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Images showing the value of a component the way it is marked on the
+// part: printed codes, color bands or text on the case. Which one is used
+// is the Image of the category.
+
+const (
+	kCapacitorImage    = "capacitor"    // Ceramic with 3-digit code; can if large.
+	kElectrolyticImage = "electrolytic" // Can with value and voltage.
+	kInductorImage     = "inductor"     // Color bands in µH.
+	kCrystalImage      = "crystal"      // Metal can with the frequency.
+	kFuseImage         = "fuse"         // Glass tube with the rating.
+)
+
+// Renders the image if the value can be shown; false (and nothing sent)
+// otherwise. The value parameter, if given, overrides the component's.
+type valueImage func(component *Component, value string, tmpl *TemplateRenderer, out http.ResponseWriter) bool
+
+var kValueImages = map[string]valueImage{
+	kResistorImage:     serveResistorImage,
+	kCapacitorImage:    serveCapacitorImage,
+	kElectrolyticImage: serveElectrolyticImage,
+	kInductorImage:     serveInductorImage,
+	kCrystalImage:      serveCrystalImage,
+	kFuseImage:         serveFuseImage,
+}
+
+func valueImageNames() []string {
+	var result []string
+	for name := range kValueImages {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+var (
+	capacitanceRegexp   = regexp.MustCompile(`(?i)^(\d*\.?\d+)\s*([pnuµm]?)F?$`)
+	capacitorCodeRegexp = regexp.MustCompile(`^(\d\d)(\d)$`) // 104: 10 * 10^4 pF
+	inductanceRegexp    = regexp.MustCompile(`(?i)^(\d*\.?\d+)\s*([pnuµm]?)H?$`)
+	frequencyRegexp     = regexp.MustCompile(`(?i)^(\d*\.?\d+)\s*([kmg]?)(Hz)?$`)
+	currentRegexp       = regexp.MustCompile(`(?i)^([TF]\s*)?(\d*\.?\d+)\s*(m?)A(\s*[TF])?$`)
+	voltageRegexp       = regexp.MustCompile(`(?i)(?:^|[^\w.])(\d*\.?\d+)\s*V(?:olt|DC)?\b`)
+	slowBlowRegexp      = regexp.MustCompile(`(?i)\b(slow|time.?lag|delay)`)
+	fastBlowRegexp      = regexp.MustCompile(`(?i)\b(fast|quick)`)
+)
+
+// Value to show and what else we know about the component.
+func valueAndDescription(component *Component, value string) (string, string) {
+	description := ""
+	if component != nil {
+		if value == "" {
+			value = component.Value
+		}
+		description = component.Description
+	}
+	return strings.TrimSpace(value), description
+}
+
+// Factor of the SI prefix character; 0 if unknown.
+func siFactor(prefix string) float64 {
+	switch prefix {
+	case "":
+		return 1
+	case "p", "P":
+		return 1e-12
+	case "n", "N":
+		return 1e-9
+	case "u", "U", "µ":
+		return 1e-6
+	case "m":
+		return 1e-3
+	case "k", "K":
+		return 1e3
+	case "M":
+		return 1e6
+	case "G", "g":
+		return 1e9
+	}
+	return 0
+}
+
+// Number with unit as written, e.g. "100nF"; also the 3-digit code ("104").
+func parseCapacitance(value string) (float64, bool) {
+	if match := capacitorCodeRegexp.FindStringSubmatch(value); match != nil {
+		digits, _ := strconv.Atoi(match[1])
+		exp, _ := strconv.Atoi(match[2])
+		return float64(digits) * math.Pow(10, float64(exp)) * 1e-12, true
+	}
+	match := capacitanceRegexp.FindStringSubmatch(value)
+	if match == nil {
+		return 0, false
+	}
+	prefix := match[2]
+	if prefix == "M" { // Mega-Farad is unlikely; somebody meant micro.
+		prefix = "u"
+	}
+	number, err := strconv.ParseFloat(match[1], 64)
+	factor := siFactor(prefix)
+	if err != nil || factor == 0 || number <= 0 {
+		return 0, false
+	}
+	if prefix == "" && !strings.HasSuffix(strings.ToUpper(value), "F") {
+		return 0, false // Plain number that is not a code; unit unknown.
+	}
+	return number * factor, true
+}
+
+// Two significant digits and the exponent to multiply with, for the color
+// or printed codes: 4700 is 47 * 10^2.
+func significantDigits(value float64) (int, int) {
+	exp := int(math.Floor(math.Log10(value))) - 1
+	digits := int(math.Round(value / math.Pow(10, float64(exp))))
+	if digits >= 100 { // Rounded up to the next decade.
+		digits /= 10
+		exp++
+	}
+	return digits, exp
+}
+
+// Number from significantDigits(), without rounding errors.
+func digitsValue(digits int, exp int) string {
+	if exp >= 0 {
+		return strconv.Itoa(digits * int(math.Pow10(exp)))
+	}
+	return strconv.FormatFloat(float64(digits)/math.Pow10(-exp), 'f', -1, 64)
+}
+
+// The code printed on ceramic capacitors: picofarads as two digits and
+// the number of zeros; small values with R as decimal point (4R7).
+func capacitorCode(farad float64) string {
+	picofarad := farad * 1e12
+	if picofarad < 10 {
+		return strings.Replace(fmtFloatNoZero(picofarad), ".", "R", 1)
+	}
+	digits, exp := significantDigits(picofarad)
+	if exp > 9 {
+		return ""
+	}
+	return fmt.Sprintf("%02d%d", digits, exp)
+}
+
+// Voltage rating mentioned in value or description, e.g. "25V".
+func voltageRating(value string, description string) string {
+	for _, text := range []string{value, description} {
+		if match := voltageRegexp.FindStringSubmatch(text); match != nil {
+			return match[1] + "V"
+		}
+	}
+	return ""
+}
+
+type CapacitorTemplate struct {
+	Value   string // As it is readable, e.g. "100nF".
+	Code    string // Printed on ceramic capacitors, e.g. "104".
+	Voltage string // Empty if unknown.
+
+	farad float64
+}
+
+func newCapacitorTemplate(component *Component, value string) *CapacitorTemplate {
+	value, description := valueAndDescription(component, value)
+	// Voltage might be written with the value, e.g. "100uF 25V".
+	capacitance := strings.Fields(voltageRegexp.ReplaceAllString(value, ""))
+	if len(capacitance) == 0 {
+		return nil
+	}
+	farad, ok := parseCapacitance(capacitance[0])
+	if !ok {
+		return nil
+	}
+	return &CapacitorTemplate{
+		Value:   strings.Replace(makeCapacitanceString(farad), "uF", "µF", 1),
+		Code:    capacitorCode(farad),
+		Voltage: voltageRating(value, description),
+		farad:   farad,
+	}
+}
+
+// Ceramic capacitors show their code, but large capacitances or those
+// described as electrolytic are cans.
+func serveCapacitorImage(component *Component, value string, tmpl *TemplateRenderer, out http.ResponseWriter) bool {
+	capacitor := newCapacitorTemplate(component, value)
+	if capacitor == nil {
+		return false
+	}
+	_, description := valueAndDescription(component, value)
+	if capacitor.farad >= 10e-6 || capacitor.Code == "" ||
+		strings.Contains(strings.ToLower(description), "electrolytic") {
+		return tmpl.Render(out, "Electrolytic_Capacitor.svg", capacitor)
+	}
+	return tmpl.Render(out, "Ceramic_Capacitor.svg", capacitor)
+}
+
+func serveElectrolyticImage(component *Component, value string, tmpl *TemplateRenderer, out http.ResponseWriter) bool {
+	capacitor := newCapacitorTemplate(component, value)
+	if capacitor == nil {
+		return false
+	}
+	return tmpl.Render(out, "Electrolytic_Capacitor.svg", capacitor)
+}
+
+type InductorTemplate struct {
+	Value         string
+	First, Second ResistorDigit
+	Multiplier    ResistorDigit
+	Tolerance     ResistorDigit
+}
+
+func parseInductance(value string) (float64, bool) {
+	match := inductanceRegexp.FindStringSubmatch(value)
+	if match == nil {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(match[1], 64)
+	factor := siFactor(match[2])
+	if err != nil || factor == 0 || number <= 0 {
+		return 0, false
+	}
+	if match[2] == "" && !strings.HasSuffix(strings.ToUpper(value), "H") {
+		return 0, false
+	}
+	return number * factor, true
+}
+
+// Color bands like a resistor, but the value is in µH. Returns nil if
+// the value can't be shown that way.
+func newInductorTemplate(component *Component, value string) *InductorTemplate {
+	value, description := valueAndDescription(component, value)
+	henry, ok := parseInductance(value)
+	if !ok {
+		return nil
+	}
+	digits, exp := significantDigits(henry * 1e6)
+	multiplier := expToIndex(exp)
+	if multiplier < 0 {
+		return nil
+	}
+	tolerance := ""
+	if match := tolerance_regexp.FindStringSubmatch(description); match != nil {
+		tolerance = match[1]
+	}
+	result := &InductorTemplate{
+		Value:      digitsValue(digits, exp) + "µH",
+		First:      resistorColorConstants[digits/10],
+		Second:     resistorColorConstants[digits%10],
+		Multiplier: resistorColorConstants[multiplier],
+		Tolerance:  resistorColorConstants[toleranceFromString(tolerance /*default 10%:*/, 11)],
+	}
+	result.Multiplier.Multiplier = strings.Replace(result.Multiplier.Multiplier, "Ω", "µH", 1)
+	return result
+}
+
+func serveInductorImage(component *Component, value string, tmpl *TemplateRenderer, out http.ResponseWriter) bool {
+	inductor := newInductorTemplate(component, value)
+	if inductor == nil {
+		return false
+	}
+	return tmpl.Render(out, "Inductor.svg", inductor)
+}
+
+type CrystalTemplate struct {
+	Frequency string // As printed on the can, e.g. "16.000".
+	Unit      string // "MHz" or "kHz".
+}
+
+func newCrystalTemplate(component *Component, value string) *CrystalTemplate {
+	value, _ = valueAndDescription(component, value)
+	match := frequencyRegexp.FindStringSubmatch(value)
+	if match == nil {
+		return nil
+	}
+	number, err := strconv.ParseFloat(match[1], 64)
+	factor := siFactor(match[2])
+	if match[2] == "m" || match[2] == "M" {
+		factor = 1e6 // Nobody has milli-Hertz crystals.
+	}
+	if err != nil || factor == 0 || number <= 0 {
+		return nil
+	}
+	if match[2] == "" && match[3] == "" {
+		return nil // Just a number.
+	}
+	hertz := number * factor
+	if hertz < 1e6 {
+		return &CrystalTemplate{strconv.FormatFloat(hertz/1e3, 'f', 3, 64), "kHz"}
+	}
+	return &CrystalTemplate{strconv.FormatFloat(hertz/1e6, 'f', 3, 64), "MHz"}
+}
+
+func serveCrystalImage(component *Component, value string, tmpl *TemplateRenderer, out http.ResponseWriter) bool {
+	crystal := newCrystalTemplate(component, value)
+	if crystal == nil {
+		return false
+	}
+	return tmpl.Render(out, "Crystal.svg", crystal)
+}
+
+type FuseTemplate struct {
+	Rating  string // Current, e.g. "500mA" or "2A".
+	Speed   string // "T" for slow blow, "F" for fast; empty if unknown.
+	Voltage string
+}
+
+func newFuseTemplate(component *Component, value string) *FuseTemplate {
+	value, description := valueAndDescription(component, value)
+	rating := strings.TrimSpace(voltageRegexp.ReplaceAllString(value, ""))
+	rating = strings.TrimRight(rating, " ,;")
+	match := currentRegexp.FindStringSubmatch(rating)
+	if match == nil {
+		return nil
+	}
+	number, err := strconv.ParseFloat(match[2], 64)
+	if err != nil || number <= 0 {
+		return nil
+	}
+	result := &FuseTemplate{
+		Rating:  strconv.FormatFloat(number, 'f', -1, 64) + strings.ToLower(match[3]) + "A",
+		Voltage: voltageRating(value, description),
+	}
+	speed := strings.ToUpper(strings.TrimSpace(match[1] + match[4]))
+	switch {
+	case speed != "":
+		result.Speed = speed[:1]
+	case slowBlowRegexp.MatchString(description):
+		result.Speed = "T"
+	case fastBlowRegexp.MatchString(description):
+		result.Speed = "F"
+	}
+	return result
+}
+
+func serveFuseImage(component *Component, value string, tmpl *TemplateRenderer, out http.ResponseWriter) bool {
+	fuse := newFuseTemplate(component, value)
+	if fuse == nil {
+		return false
+	}
+	return tmpl.Render(out, "Fuse.svg", fuse)
+}
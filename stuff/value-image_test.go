@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCapacitorValues(t *testing.T) {
+	for _, test := range []struct{ value, readable, code string }{
+		{"100nF", "100nF", "104"},
+		{"104", "100nF", "104"},
+		{".1uF", "100nF", "104"},
+		{"22pF", "22pF", "220"},
+		{"4.7pF", "4.7pF", "4R7"},
+		{"4.7nF", "4.7nF", "472"},
+		{"1uF", "1µF", "105"},
+		{"470uF 25V", "470µF", "477"},
+	} {
+		capacitor := newCapacitorTemplate(nil, test.value)
+		if capacitor == nil {
+			t.Errorf("%s: not recognized", test.value)
+			continue
+		}
+		expectEqual(t, capacitor.Value, test.readable)
+		expectEqual(t, capacitor.Code, test.code)
+	}
+	ExpectTrue(t, newCapacitorTemplate(nil, "") == nil, "empty")
+	ExpectTrue(t, newCapacitorTemplate(nil, "100") != nil, "3-digit code")
+	ExpectTrue(t, newCapacitorTemplate(nil, "47") == nil, "number without unit")
+	ExpectTrue(t, newCapacitorTemplate(nil, "bipolar") == nil, "no value")
+
+	expectEqual(t, newCapacitorTemplate(nil, "470uF 25V").Voltage, "25V")
+	expectEqual(t, newCapacitorTemplate(nil, "100nF").Voltage, "")
+	component := &Component{Value: "10uF", Description: "Tantalum, 16V"}
+	expectEqual(t, newCapacitorTemplate(component, "").Voltage, "16V")
+	expectEqual(t, newCapacitorTemplate(component, "22uF").Value, "22µF")
+}
+
+func TestInductorBands(t *testing.T) {
+	inductor := newInductorTemplate(nil, "4.7uH")
+	expectEqual(t, inductor.Value, "4.7µH")
+	expectEqual(t, inductor.First.Color, resistorColorConstants[4].Color)
+	expectEqual(t, inductor.Second.Color, resistorColorConstants[7].Color)
+	expectEqual(t, inductor.Multiplier.Color, resistorColorConstants[10].Color) // x0.1
+	expectEqual(t, inductor.Multiplier.Multiplier, "x0.1µH (Gold)")
+	expectEqual(t, inductor.Tolerance.Color, resistorColorConstants[11].Color) // 10%
+
+	inductor = newInductorTemplate(&Component{Description: "Choke 5%"}, "1mH")
+	expectEqual(t, inductor.Value, "1000µH")
+	expectEqual(t, inductor.Multiplier.Color, resistorColorConstants[2].Color)
+	expectEqual(t, inductor.Tolerance.Color, resistorColorConstants[10].Color)
+
+	ExpectTrue(t, newInductorTemplate(nil, "10") == nil, "no unit")
+	ExpectTrue(t, newInductorTemplate(nil, "1000H") == nil, "too large for bands")
+}
+
+func TestCrystalFrequency(t *testing.T) {
+	for value, expected := range map[string]string{
+		"16MHz":     "16.000 MHz",
+		"16 mhz":    "16.000 MHz",
+		"32.768kHz": "32.768 kHz",
+		"4M":        "4.000 MHz",
+		"3579545Hz": "3.580 MHz",
+	} {
+		crystal := newCrystalTemplate(nil, value)
+		if crystal == nil {
+			t.Errorf("%s: not recognized", value)
+			continue
+		}
+		expectEqual(t, crystal.Frequency+" "+crystal.Unit, expected)
+	}
+	ExpectTrue(t, newCrystalTemplate(nil, "16") == nil, "just a number")
+	ExpectTrue(t, newCrystalTemplate(nil, "HC-49") == nil, "no frequency")
+}
+
+func TestFuseRating(t *testing.T) {
+	for _, test := range []struct{ value, description, rating, speed, voltage string }{
+		{"T2A", "", "2A", "T", ""},
+		{"500mA", "", "500mA", "", ""},
+		{"1.6A F", "", "1.6A", "F", ""},
+		{"2A 250V", "", "2A", "", "250V"},
+		{"315mA", "slow blow, 5x20mm", "315mA", "T", ""},
+		{"3.15A", "Quick acting 250V", "3.15A", "F", "250V"},
+	} {
+		fuse := newFuseTemplate(&Component{Description: test.description}, test.value)
+		if fuse == nil {
+			t.Errorf("%s: not recognized", test.value)
+			continue
+		}
+		expectEqual(t, fuse.Rating, test.rating)
+		expectEqual(t, fuse.Speed, test.speed)
+		expectEqual(t, fuse.Voltage, test.voltage)
+	}
+	ExpectTrue(t, newFuseTemplate(nil, "5x20") == nil, "no rating")
+}
+
+func TestValueImagesFromParameters(t *testing.T) {
+	store, cleanup := newHistoryTestStore(t)
+	defer cleanup()
+	categories, categories_cleanup := newTestCategoryStore(t)
+	defer categories_cleanup()
+	handler := &ImageHandler{store: store, categories: categories,
+		template: NewTemplateRenderer("", false)}
+
+	for url, expected := range map[string]string{
+		"/img/0?c=Capacitor&v=100nF":   ">104<",
+		"/img/0?c=Capacitor&v=1000uF":  ">1000µF<",
+		"/img/0?c=Electrolytic&v=10uF": ">10µF<",
+		"/img/0?c=L&v=100uH":           ">100µH<",
+		"/img/0?c=Crystal&v=16MHz":     ">16.000<",
+		"/img/0?c=Fuse&v=T500mA":       ">T500mA<",
+	} {
+		r := httptest.NewRequest("GET", url, nil)
+		out := httptest.NewRecorder()
+		handler.ServeHTTP(out, r)
+		expectEqualInt(t, out.Code, http.StatusOK)
+		body := out.Body.String()
+		ExpectTrue(t, strings.HasPrefix(body, "<svg"), url)
+		ExpectTrue(t, strings.Contains(body, expected), url+" shows "+expected)
+	}
+
+	// A value that can't be shown falls back to the category picture.
+	r := httptest.NewRequest("GET", "/img/0?c=Capacitor&v=bipolar", nil)
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, r)
+	expectEqualInt(t, out.Code, http.StatusOK)
+	ExpectTrue(t, strings.Contains(out.Body.String(), `docname="category-Capacitor.svg"`), "category picture")
+
+	ExpectTrue(t, categories.Save("", Category{Name: "Foo", Image: kFuseImage}) == nil, "value image")
+	ExpectTrue(t, categories.Save("", Category{Name: "Bar", Image: "fuses"}) != nil, "unknown image")
+}
+
+func TestValueImageFailingHalfwayNotSent(t *testing.T) {
+	store, cleanup := newHistoryTestStore(t)
+	defer cleanup()
+	categories, categories_cleanup := newTestCategoryStore(t)
+	defer categories_cleanup()
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/component", 0755)
+	ioutil.WriteFile(dir+"/component/Fuse.svg", []byte("<svg>{{.NoSuchField}}</svg>"), 0644)
+	ioutil.WriteFile(dir+"/component/category-Fuse.svg", []byte("<svg>fuse</svg>"), 0644)
+	handler := &ImageHandler{store: store, categories: categories,
+		template: NewTemplateRenderer(dir, false)}
+
+	out := httptest.NewRecorder()
+	handler.ServeHTTP(out, httptest.NewRequest("GET", "/img/0?c=Fuse&v=T500mA", nil))
+	expectEqualInt(t, out.Code, http.StatusOK)
+	expectEqual(t, out.Body.String(), "<svg>fuse</svg>")
+}